@@ -0,0 +1,280 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type CompactOplogCommand struct {
+	OlderThan        time.Duration        `env:"COMPACT_OPLOG__OLDER_THAN" default:"24h" help:"Only compact oplog backups that ended longer ago than this (Default: 24h)"`
+	Period           time.Duration        `env:"COMPACT_OPLOG__PERIOD" default:"24h" help:"Merge the oplog backups that start in the same period, aligned to UTC (Default: 24h)"`
+	BackupDir        string               `required:"" env:"COMPACT_OPLOG__BACKUP_DIR" help:"The directory to download and merge the oplog backups in"`
+	Database         string               `env:"COMPACT_OPLOG__DATABASE" help:"Compact the oplog backups of the backups of this database instead of the full backups"`
+	DryRun           bool                 `env:"COMPACT_OPLOG__DRY_RUN" help:"Only print the merges that would be done"`
+	Compression      string               `env:"COMPACT_OPLOG__COMPRESSION" enum:"gzip,zstd,none" default:"gzip" help:"How the merged oplog backups are compressed, gzip, zstd or none (Default: gzip)"`
+	CompressionLevel int                  `env:"COMPACT_OPLOG__COMPRESSION_LEVEL" default:"0" help:"The compression level of the merged oplog backups, 0 uses the default of the compression"`
+	S3               flags.S3Flags        `embed:"" group:"S3 Flags:"`
+	Verbosity        flags.VerbosityFlags `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
+}
+
+func (command CompactOplogCommand) Run() error {
+	command.Verbosity.SetGlobalLogLevel()
+
+	ctx := context.Background()
+	s3Service := services.NewS3Service(command.S3)
+
+	// ######################
+	// List the oplog backups old enough to be compacted
+	// ######################
+	objects, err := s3Service.ListAll(ctx, command.S3.Bucket, helpers.S3OplogPrefix(command.S3.Prefix, command.Database))
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-command.OlderThan)
+	segments := make([]models.OplogBackup, 0, len(objects))
+
+	for _, object := range objects {
+		if strings.HasSuffix(*object.Key, helpers.ConfigFileName) {
+			continue
+		}
+
+		segment := helpers.PrepareOplogBackup(*object.Key)
+		if segment.ToTime.Before(cutoff) {
+			segments = append(segments, segment)
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].ToTime.Before(segments[j].ToTime)
+	})
+
+	// ######################
+	// Merge every contiguous run of segments within a period
+	// ######################
+	groups := groupOplogSegments(segments, command.Period)
+
+	log.Info().Msgf("Found %d oplog backups older than %s, grouped into %d oplog backups", len(segments), command.OlderThan, len(groups))
+
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+
+		if command.DryRun {
+			log.Info().Msgf("Would merge %d oplog backups into %s", len(group), command.mergedOplogSegmentFileName(group))
+			continue
+		}
+
+		if err := command.mergeOplogSegments(ctx, s3Service, group); err != nil {
+			return err
+		}
+	}
+
+	log.Info().Msg("Oplog compaction completed successfully")
+	return nil
+}
+
+// groupOplogSegments splits the sorted segments into runs that start in the same period
+// and where every segment starts exactly where the previous one ended
+func groupOplogSegments(segments []models.OplogBackup, period time.Duration) [][]models.OplogBackup {
+	groups := make([][]models.OplogBackup, 0)
+
+	for i, segment := range segments {
+		if i > 0 {
+			previous := segments[i-1]
+
+			samePeriod := previous.FromTime.UTC().Truncate(period).Equal(segment.FromTime.UTC().Truncate(period))
+			contiguous := oplogSegmentBoundary(previous, 1) == oplogSegmentBoundary(segment, 0)
+
+			if samePeriod && contiguous {
+				groups[len(groups)-1] = append(groups[len(groups)-1], segment)
+				continue
+			}
+		}
+
+		groups = append(groups, []models.OplogBackup{segment})
+	}
+
+	return groups
+}
+
+// oplogSegmentBoundary returns the exact from (0) or to (1) part of the segment name
+func oplogSegmentBoundary(segment models.OplogBackup, index int) string {
+	return strings.Split(segment.FileNameWithoutExtension, "_")[index]
+}
+
+func (command *CompactOplogCommand) mergedOplogSegmentFileName(group []models.OplogBackup) string {
+	return oplogSegmentBoundary(group[0], 0) + "_" + oplogSegmentBoundary(group[len(group)-1], 1) + helpers.OplogSegmentExtension(command.Compression)
+}
+
+func (command *CompactOplogCommand) mergeOplogSegments(ctx context.Context, s3Service *services.S3Service, group []models.OplogBackup) error {
+	mergedFileName := command.mergedOplogSegmentFileName(group)
+	mergedKey := helpers.S3OplogPrefix(command.S3.Prefix, command.Database) + mergedFileName
+
+	workDir := filepath.Join(command.BackupDir, "compact")
+	downloadsDir := filepath.Join(workDir, "downloads")
+	mergedDir := filepath.Join(workDir, "local") + "/"
+
+	defer os.RemoveAll(workDir)
+
+	log.Info().Msgf("Merging %d oplog backups into %s", len(group), mergedFileName)
+
+	// ######################
+	// Download the segments and the boundaries recorded with them
+	// ######################
+	metadata := make([]map[string]string, len(group))
+
+	for i, segment := range group {
+		head, err := s3Service.Head(ctx, command.S3.Bucket, segment.Key)
+		if err != nil {
+			return err
+		}
+
+		metadata[i] = head.Metadata
+
+		obj, err := s3Service.Get(ctx, command.S3.Bucket, segment.Key)
+		if err != nil {
+			return err
+		}
+
+		if err := helpers.WriteToFile(obj.Body, obj.ContentLength, downloadsDir, segment.FileName); err != nil {
+			return err
+		}
+	}
+
+	// ######################
+	// Write the entries of every segment into one
+	// ######################
+	merged, err := createOplogSegment(mergedDir, primitive.Timestamp{})
+	if err != nil {
+		return err
+	}
+
+	var entries int64
+
+	for i, segment := range group {
+		from, fromErr := helpers.ParseOplogTimestamp(metadata[i][helpers.OplogFromMetadataKey])
+		to, toErr := helpers.ParseOplogTimestamp(metadata[i][helpers.OplogToMetadataKey])
+		hasBounds := fromErr == nil && toErr == nil
+
+		err := helpers.ForEachOplogEntry(filepath.Join(downloadsDir, segment.FileName), func(entry bson.Raw) error {
+			t, inc := entry.Lookup("ts").Timestamp()
+			ts := primitive.Timestamp{T: t, I: inc}
+
+			if entries > 0 && !ts.After(merged.to) {
+				return fmt.Errorf("oplog entry %d:%d of %s is not after the previous entry %d:%d", ts.T, ts.I, segment.Key, merged.to.T, merged.to.I)
+			}
+
+			if hasBounds && (!ts.After(from) || ts.After(to)) {
+				return fmt.Errorf("oplog entry %d:%d of %s is outside of its boundaries", ts.T, ts.I, segment.Key)
+			}
+
+			entries++
+			return merged.write(entry, ts)
+		})
+
+		if err != nil {
+			merged.close()
+			log.Error().Err(err).Msgf("Skipping the merge into %s, the oplog backups are left untouched", mergedFileName)
+			return nil
+		}
+	}
+
+	if err := merged.close(); err != nil {
+		return err
+	}
+
+	// ######################
+	// Upload the merged segment, keeping the boundaries of the first and last segments
+	// ######################
+	mergedMetadata := map[string]string{}
+
+	if from, ok := metadata[0][helpers.OplogFromMetadataKey]; ok {
+		mergedMetadata[helpers.OplogFromMetadataKey] = from
+	}
+
+	if to, ok := metadata[len(group)-1][helpers.OplogToMetadataKey]; ok {
+		mergedMetadata[helpers.OplogToMetadataKey] = to
+	}
+
+	if err := uploadOplogSegment(ctx, s3Service, command.S3.Bucket, mergedKey, mergedDir, command.Compression, command.CompressionLevel, mergedMetadata); err != nil {
+		return err
+	}
+
+	// ######################
+	// Verify the uploaded segment holds exactly the entries that were merged
+	// ######################
+	if err := verifyMergedOplogSegment(ctx, s3Service, command.S3.Bucket, mergedKey, downloadsDir, entries, merged.to); err != nil {
+		log.Error().Err(err).Msgf("Removing %s, the oplog backups are left untouched", mergedKey)
+
+		if deleteErr := s3Service.Delete(ctx, command.S3.Bucket, []types.ObjectIdentifier{{Key: aws.String(mergedKey)}}); deleteErr != nil {
+			return errors.Join(err, deleteErr)
+		}
+
+		return err
+	}
+
+	// ######################
+	// Only then delete the merged segments
+	// ######################
+	objectsToDelete := make([]types.ObjectIdentifier, 0, len(group))
+
+	for _, segment := range group {
+		if segment.Key != mergedKey {
+			objectsToDelete = append(objectsToDelete, types.ObjectIdentifier{Key: aws.String(segment.Key)})
+		}
+	}
+
+	if err := s3Service.Delete(ctx, command.S3.Bucket, objectsToDelete); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Merged %d oplog backups with %d entries into %s", len(group), entries, mergedFileName)
+	return nil
+}
+
+func verifyMergedOplogSegment(ctx context.Context, s3Service *services.S3Service, bucket string, key string, downloadsDir string, expectedEntries int64, expectedTo primitive.Timestamp) error {
+	obj, err := s3Service.Get(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+
+	if err := helpers.WriteToFile(obj.Body, obj.ContentLength, downloadsDir, "merged"); err != nil {
+		return err
+	}
+
+	var entries int64
+	var to primitive.Timestamp
+
+	if err := helpers.ForEachOplogEntry(filepath.Join(downloadsDir, "merged"), func(entry bson.Raw) error {
+		t, i := entry.Lookup("ts").Timestamp()
+		to = primitive.Timestamp{T: t, I: i}
+		entries++
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if entries != expectedEntries || !to.Equal(expectedTo) {
+		return fmt.Errorf("the merged oplog backup %s holds %d entries up to %d:%d, expected %d entries up to %d:%d", key, entries, to.T, to.I, expectedEntries, expectedTo.T, expectedTo.I)
+	}
+
+	return nil
+}
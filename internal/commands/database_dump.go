@@ -6,21 +6,23 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awsHttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
-
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/ditkrg/mongodb-backup/internal/flags"
 	"github.com/ditkrg/mongodb-backup/internal/helpers"
 	"github.com/ditkrg/mongodb-backup/internal/models"
 	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/mongodb/mongo-tools/mongodump"
 	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type DumpCommand struct {
@@ -32,10 +34,23 @@ type DumpCommand struct {
 func (command DumpCommand) Run() error {
 
 	command.Verbosity.SetGlobalLogLevel()
+	command.Mongo.ApplyDeprecatedFlags()
+
+	// only archive backups are taken on demand, oplog and sharded backups are always scheduled
+	if command.Mongo.Class != models.BackupClassScheduled && (command.Mongo.Sharded || command.Mongo.OutputOptions.OpLog) {
+		err := fmt.Errorf("only full and database backups can be %s backups", command.Mongo.Class)
+		log.Error().Err(err).Send()
+		return err
+	}
 
-	if command.Mongo.OutputOptions.OpLog {
+	switch {
+	case command.Mongo.Sharded:
+		return startShardedBackup(&command)
+	case command.Mongo.NamespaceOptions.AllDatabases:
+		return startFanOutBackup(&command)
+	case command.Mongo.OutputOptions.OpLog:
 		return startOplogBackup(&command)
-	} else {
+	default:
 		return startBackup(&command)
 	}
 }
@@ -43,12 +58,29 @@ func (command DumpCommand) Run() error {
 func startBackup(command *DumpCommand) error {
 	timeNow := time.Now().UTC().Format(helpers.TimeFormat)
 
-	s3FileKey := fmt.Sprintf("%s.archive", timeNow)
-	if command.Mongo.OutputOptions.Gzip {
-		s3FileKey = fmt.Sprintf("%s.gzip", s3FileKey)
+	s3FileKey := timeNow + helpers.ArchiveExtension(command.Mongo.OutputOptions.Compression)
+	s3FileKeyWithPrefix := helpers.S3BackupPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database) + s3FileKey
+
+	// ######################
+	// Fingerprint the source cluster
+	// ######################
+	ctx := context.Background()
+
+	mongodbService, err := services.NewMongodbService(command.Mongo.ConnectionString, ctx)
+	if err != nil {
+		return err
 	}
 
-	s3FileKeyWithPrefix := helpers.S3BackupPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database) + s3FileKey
+	source, err := mongodbService.Fingerprint(ctx)
+	if err != nil {
+		return err
+	}
+
+	// only the members of a replica set have an oplog for mongodump --oplog to capture
+	if command.Mongo.OutputOptions.PointInTime && command.Mongo.NamespaceOptions.Database == "" && source.ReplicaSetName == "" {
+		log.Warn().Msg("The server is not a member of a replica set, the backup is taken without the oplog written during the dump and is not consistent as of its end")
+		command.Mongo.OutputOptions.PointInTime = false
+	}
 
 	// ######################
 	// Prepare MongoDump
@@ -68,17 +100,85 @@ func startBackup(command *DumpCommand) error {
 		return err
 	}
 
-	if err := mongoDump.Dump(); err != nil {
+	manifest := &models.BackupManifest{
+		Key:           s3FileKeyWithPrefix,
+		CreatedAt:     timeNow,
+		Class:         command.Mongo.Class,
+		Note:          command.Mongo.Note,
+		Source:        source,
+		Compression:   command.Mongo.OutputOptions.Compression,
+		Filter:        command.Mongo.NamespaceFilter(),
+		OplogCaptured: mongoDump.OutputOptions.Oplog,
+	}
+
+	// ######################
+	// Narrow the dump down to the namespaces matching the patterns
+	// ######################
+	var isIncluded func(database string, collection string) bool
+
+	if command.Mongo.HasNamespacePatterns() {
+		isIncluded = command.Mongo.IsDumpedNamespaceIncluded
+
+		if err := skipExcludedCollections(ctx, mongodbService, command, mongoDump); err != nil {
+			return err
+		}
+	}
+
+	archivePath, err := dumpArchive(mongoDump, command.Mongo.BackupDir, command.Mongo.OutputOptions.Compression, command.Mongo.OutputOptions.CompressionLevel, isIncluded)
+	if err != nil {
 		log.Error().Err(err).Msg("Error dumping database")
 		return err
 	}
 
+	// ######################
+	// Read back what mongodump actually wrote to the archive, the oplog captured during the dump
+	// makes the backup consistent as of the last entry it holds
+	// ######################
+	inspection, err := inspectLocalArchive(archivePath)
+	if err != nil {
+		return err
+	}
+
+	if manifest.OplogCaptured {
+		manifest.OplogFrom, manifest.OplogTo = inspection.OplogFirst, inspection.OplogLast
+
+		log.Info().Msgf("Captured the oplog from %s to %s", helpers.OplogTimestampString(manifest.OplogFrom), helpers.OplogTimestampString(manifest.OplogTo))
+	}
+
 	log.Info().Msg("Database dump completed successfully")
 
+	// ######################
+	// Record what the backup contains
+	// ######################
+	databases := []string{command.Mongo.NamespaceOptions.Database}
+
+	if command.Mongo.NamespaceOptions.Database == "" {
+		if databases, err = mongodbService.ListDatabaseNames(ctx); err != nil {
+			return err
+		}
+
+		databases = slices.DeleteFunc(databases, func(database string) bool {
+			return database == "local" || database == "config" || !command.Mongo.IsDatabaseIncluded(database)
+		})
+	}
+
+	// the dbHash hashes the whole collection, it never matches a dump narrowed by a query
+	recordDbHash := command.Mongo.OutputOptions.RecordDbHash
+	if recordDbHash && (command.Mongo.QueryOptions.Query != "" || command.Mongo.QueryOptions.QueryFile != "") {
+		log.Warn().Msg("The dbHash is not recorded for a dump narrowed by a query")
+		recordDbHash = false
+	}
+
+	namespaces, err := mongodbService.NamespaceManifests(ctx, databases, command.Mongo.IsNamespaceIncluded, recordDbHash)
+	if err != nil {
+		return err
+	}
+
+	manifest.Namespaces = dumpedNamespaceManifests(namespaces, inspection, manifest.OplogCaptured)
+
 	// ######################
 	// Prepare S3 Service
 	// ######################
-	ctx := context.Background()
 	s3Service := services.NewS3Service(command.S3)
 
 	// ######################
@@ -88,17 +188,24 @@ func startBackup(command *DumpCommand) error {
 		ctx,
 		command.S3.Bucket,
 		s3FileKeyWithPrefix,
-		mongoDump.OutputOptions.Archive,
+		archivePath,
 	); err != nil {
 		return err
 	}
 
-	os.Remove(mongoDump.OutputOptions.Archive)
+	os.Remove(archivePath)
+
+	// ######################
+	// Upload the backup manifest
+	// ######################
+	if err := uploadBackupManifest(ctx, s3Service, command.S3.Bucket, command.S3.Prefix, manifest); err != nil {
+		return err
+	}
 
 	//  ######################
-	//  Keep the latest N backups
+	//  Apply the retention policy
 	//  ######################
-	if err := keepRecentBackups(ctx, s3Service, command); err != nil {
+	if err := applyRetention(ctx, s3Service, command, true); err != nil {
 		return err
 	}
 
@@ -118,17 +225,17 @@ func startOplogBackup(command *DumpCommand) error {
 	// ######################
 	// Check if a backup Exists
 	// ######################
-	bucketObjects, err := s3Service.List(ctx, command.S3.Bucket, helpers.S3BackupPrefix(command.S3.Prefix, ""))
+	bucketObjects, err := s3Service.List(ctx, command.S3.Bucket, helpers.S3BackupPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database))
 	if err != nil {
 		return err
 	}
 
 	if len(bucketObjects.Contents) == 0 {
-		log.Info().Msgf("no backups found in %s/%s, there must be a full backup before oplog backup", command.S3.Bucket, helpers.S3BackupPrefix(command.S3.Prefix, ""))
+		log.Info().Msgf("no backups found in %s/%s, there must be a full backup before oplog backup", command.S3.Bucket, helpers.S3BackupPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database))
 		return nil
 	}
 
-	log.Info().Msgf("Found %d objects in %s/%s", len(bucketObjects.Contents), command.S3.Bucket, helpers.S3BackupPrefix(command.S3.Prefix, ""))
+	log.Info().Msgf("Found %d objects in %s/%s", len(bucketObjects.Contents), command.S3.Bucket, helpers.S3BackupPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database))
 
 	// ######################
 	// Get the latest oplog config
@@ -138,6 +245,56 @@ func startOplogBackup(command *DumpCommand) error {
 		return err
 	}
 
+	// ######################
+	// The segment starts right after the last entry of the previous one
+	// ######################
+	mongodbService, err := services.NewMongodbService(command.Mongo.ConnectionString, ctx)
+	if err != nil {
+		return err
+	}
+
+	oplogFrom, err := getOplogRunStart(ctx, s3Service, command, previousOplogRunInfo, bucketObjects.Contents)
+	if errors.Is(err, errOplogChainBroken) {
+		return handleOplogGap(ctx, s3Service, mongodbService, command, previousOplogRunInfo, oplogFrom, primitive.Timestamp{})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// ######################
+	// The segment ends at the last entry currently in the oplog, the range query stops the dump there
+	// so the next segment starts right after the last entry this one holds
+	// ######################
+	oplogTo, err := mongodbService.LatestOplogTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	// ######################
+	// Make sure nothing rolled off the oplog since the previous run
+	// ######################
+	oplogOldest, err := mongodbService.OldestOplogTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	if oplogOldest.After(oplogFrom) {
+		return handleOplogGap(ctx, s3Service, mongodbService, command, previousOplogRunInfo, oplogFrom, oplogOldest)
+	}
+
+	oplogRunInfo := &models.PreviousOplogRunInfo{
+		OplogTakenFromTimestamp: oplogFrom,
+		OplogTakenToTimestamp:   oplogTo,
+	}
+
+	reportOplogWindow(oplogRunInfo, oplogOldest)
+
+	if !oplogTo.After(oplogFrom) {
+		log.Info().Msgf("No oplog entries after %s, skipping the oplog backup", helpers.OplogTimestampString(oplogFrom))
+		return nil
+	}
+
 	// ######################
 	// Prepare MongoDump
 	// ######################
@@ -149,22 +306,17 @@ func startOplogBackup(command *DumpCommand) error {
 	// ######################
 	// Prepare OpLog Backup Key
 	// ######################
-	startTime := time.Now().UTC().Format(helpers.TimeFormat)
-	var s3OpLogBackupKey string
+	oplogRunInfo.OplogTakenFrom = helpers.OplogTimestampTime(oplogFrom).Format(helpers.TimeFormat)
+	oplogRunInfo.OplogTakenTo = helpers.OplogTimestampTime(oplogTo).Format(helpers.TimeFormat)
 
-	if previousOplogRunInfo == nil {
-		helpers.SortByKeyTimeStamp(bucketObjects.Contents, helpers.S3BackupPrefix(command.S3.Prefix, ""))
-		key := *bucketObjects.Contents[0].Key
-		key = strings.TrimPrefix(key, helpers.S3BackupPrefix(command.S3.Prefix, ""))
-		key = strings.TrimSuffix(key, ".gzip")
-		key = strings.TrimSuffix(key, ".archive")
-		previousOplogRunInfo = &models.PreviousOplogRunInfo{OplogTakenFrom: "0", OplogTakenTo: key}
+	s3OpLogBackupKey := oplogRunInfo.OplogTakenFrom + "_" + oplogRunInfo.OplogTakenTo + helpers.OplogSegmentExtension(command.Mongo.OutputOptions.OplogCompression)
+	// a database backup only keeps the oplog entries of its database
+	if mongoDump.InputOptions.Query, err = helpers.OplogRangeQuery(oplogFrom, oplogTo, command.Mongo.NamespaceOptions.Database); err != nil {
+		log.Error().Err(err).Send()
+		return err
 	}
 
-	s3OpLogBackupKey = fmt.Sprintf("%s_%s.tar.gz", previousOplogRunInfo.OplogTakenTo, startTime)
-	mongoDump.InputOptions.Query = fmt.Sprintf(helpers.OplogQuery, previousOplogRunInfo.OplogTakenTo, startTime)
-
-	log.Info().Msgf("Taking OpLog from %s to %s", previousOplogRunInfo.OplogTakenTo, startTime)
+	log.Info().Msgf("Taking OpLog from %s to %s", helpers.OplogTimestampString(oplogFrom), helpers.OplogTimestampString(oplogTo))
 
 	// ######################
 	// dump oplog
@@ -181,23 +333,33 @@ func startOplogBackup(command *DumpCommand) error {
 		return err
 	}
 
-	log.Info().Msg("Oplog dump completed successfully")
-
 	// ######################
-	// Tar Oplog Directory
+	// A transaction is dumped as a whole when any of its operations touches the database,
+	// the operations on other databases are left out so they are never replayed
 	// ######################
-	if err := helpers.TarDirectory(tarFileDir, s3OpLogBackupKey); err != nil {
-		return err
+	if command.Mongo.NamespaceOptions.Database != "" {
+		if err := helpers.FilterOplogFile(filepath.Join(tarFileDir, "oplog.rs.bson"), helpers.IsDatabaseNamespace(command.Mongo.NamespaceOptions.Database)); err != nil {
+			return err
+		}
 	}
 
+	log.Info().Msg("Oplog dump completed successfully")
+
 	// ######################
-	// Upload oplog to S3
+	// Stream the compressed oplog to S3
 	// ######################
-	if err := s3Service.UploadFile(
+	if err := uploadOplogSegment(
 		ctx,
+		s3Service,
 		command.S3.Bucket,
-		helpers.S3OplogPrefix(command.S3.Prefix)+s3OpLogBackupKey,
-		tarFileDir+s3OpLogBackupKey,
+		helpers.S3OplogPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database)+s3OpLogBackupKey,
+		tarFileDir,
+		command.Mongo.OutputOptions.OplogCompression,
+		command.Mongo.OutputOptions.OplogCompressionLevel,
+		map[string]string{
+			helpers.OplogFromMetadataKey: helpers.OplogTimestampString(oplogFrom),
+			helpers.OplogToMetadataKey:   helpers.OplogTimestampString(oplogTo),
+		},
 	); err != nil {
 		return err
 	}
@@ -207,10 +369,24 @@ func startOplogBackup(command *DumpCommand) error {
 	// ######################
 	// Upload a new oplog config
 	// ######################
-	log.Info().Msg("Upload the current oplog run info")
+	if err := uploadOplogConfig(ctx, s3Service, command, oplogRunInfo); err != nil {
+		return err
+	}
+
+	// ######################
+	// Clean up the oplog backups the retention policy no longer needs
+	// ######################
+	if err := applyRetention(ctx, s3Service, command, false); err != nil {
+		return err
+	}
+
+	return nil
+}
 
-	oplogConfigByteArray, err := json.Marshal(&models.PreviousOplogRunInfo{OplogTakenFrom: previousOplogRunInfo.OplogTakenTo, OplogTakenTo: startTime})
+func uploadOplogConfig(ctx context.Context, s3Service *services.S3Service, command *DumpCommand, oplogRunInfo *models.PreviousOplogRunInfo) error {
+	log.Info().Msg("Upload the current oplog run info")
 
+	oplogConfigByteArray, err := json.Marshal(oplogRunInfo)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to marshal oplog config")
 		return err
@@ -218,159 +394,256 @@ func startOplogBackup(command *DumpCommand) error {
 
 	if _, err := s3Service.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(command.S3.Bucket),
-		Key:    aws.String(helpers.S3OplogPrefix(command.S3.Prefix) + helpers.ConfigFileName),
+		Key:    aws.String(helpers.S3OplogPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database) + helpers.ConfigFileName),
 		Body:   bytes.NewReader(oplogConfigByteArray),
 	}); err != nil {
 		log.Error().Err(err).Msg("Failed to upload content")
 		return err
 	}
 
-	// ######################
-	// Keep Relative oplog backups
-	// ######################
-	if err := keepRelativeOplogBackups(ctx, s3Service, command); err != nil {
-		return err
-	}
-
 	return nil
 }
 
-func keepRecentBackups(ctx context.Context, s3Service *services.S3Service, command *DumpCommand) error {
-	if command.Mongo.KeepRecentN <= 0 {
-		return nil
-	}
+func getPreviousOplogRunData(ctx context.Context, s3Service *services.S3Service, command *DumpCommand) (*models.PreviousOplogRunInfo, error) {
+	log.Info().Msg("Getting the latest oplog config")
 
-	log.Info().Msgf("Keep most Recent %d Backups", command.Mongo.KeepRecentN)
+	oplogKeyWithPrefix := helpers.S3OplogPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database) + helpers.ConfigFileName
 
-	resp, err := s3Service.List(
-		ctx,
-		command.S3.Bucket,
-		helpers.S3BackupPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database),
-	)
+	resp, err := s3Service.Get(ctx, command.S3.Bucket, oplogKeyWithPrefix)
 
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to list backups")
-		return err
-	}
+		if services.IsNotFound(err) {
+			log.Info().Msg("No oplog config found")
+			return nil, nil
+		}
 
-	s3BackupCount := len(resp.Contents)
+		log.Error().Err(err).Msg("Failed to get config file from S3")
+		return nil, err
+	}
 
-	log.Info().Msgf("Found %d backups", s3BackupCount)
+	defer resp.Body.Close()
 
-	if s3BackupCount > command.Mongo.KeepRecentN {
+	var oplogConfig models.PreviousOplogRunInfo
+	if err := json.NewDecoder(resp.Body).Decode(&oplogConfig); err != nil {
+		log.Error().Err(err).Msg("Failed to decode the config file")
+		return nil, err
+	}
 
-		backupsToDeleteCount := s3BackupCount - command.Mongo.KeepRecentN
-		objectsToDelete := make([]types.ObjectIdentifier, backupsToDeleteCount)
+	log.Info().Msg("Got the latest oplog config")
+	return &oplogConfig, nil
+}
 
-		helpers.SortByKeyTimeStamp(resp.Contents, helpers.S3BackupPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database))
+func getOplogRunStart(ctx context.Context, s3Service *services.S3Service, command *DumpCommand, previousOplogRunInfo *models.PreviousOplogRunInfo, backups []types.Object) (primitive.Timestamp, error) {
+	if previousOplogRunInfo != nil && previousOplogRunInfo.ChainBroken {
+		return getBrokenChainRestart(ctx, s3Service, command, previousOplogRunInfo, backups)
+	}
 
-		for i, obj := range resp.Contents[:backupsToDeleteCount] {
-			objectsToDelete[i] = types.ObjectIdentifier{
-				Key: obj.Key,
-			}
+	if previousOplogRunInfo != nil {
+		if !previousOplogRunInfo.OplogTakenToTimestamp.IsZero() {
+			return previousOplogRunInfo.OplogTakenToTimestamp, nil
 		}
 
-		if err := s3Service.Delete(ctx, command.S3.Bucket, objectsToDelete); err != nil {
-			return err
+		// ######################
+		// Configs written before timestamps were recorded only have the wall clock time,
+		// starting at the beginning of its second may repeat a few entries but never skips one
+		// ######################
+		takenTo, err := time.Parse(helpers.TimeFormat, previousOplogRunInfo.OplogTakenTo)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to parse the end of the previous oplog run")
+			return primitive.Timestamp{}, err
 		}
-	}
 
-	return nil
-}
+		return primitive.Timestamp{T: uint32(takenTo.Unix())}, nil
+	}
 
-func keepRelativeOplogBackups(ctx context.Context, s3Service *services.S3Service, command *DumpCommand) error {
-	log.Info().Msg("Keep Relative Oplog Backups")
+	// ######################
+	// The first oplog run starts from the oldest full backup
+	// ######################
+	helpers.SortByKeyTimeStamp(backups, helpers.S3BackupPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database))
 
-	listResp, err := s3Service.List(ctx, command.S3.Bucket, helpers.S3BackupPrefix(command.S3.Prefix, ""))
+	return getBackupOplogAnchor(ctx, s3Service, command, *backups[0].Key)
+}
 
+// getBackupOplogAnchor returns the oplog timestamp an oplog chain starting at the full backup continues from,
+// the start of the dump so the first segment overlaps it, replaying the overlap again is harmless
+func getBackupOplogAnchor(ctx context.Context, s3Service *services.S3Service, command *DumpCommand, backupKey string) (primitive.Timestamp, error) {
+	manifest, err := getBackupManifest(ctx, s3Service, command.S3.Bucket, command.S3.Prefix, backupKey)
 	if err != nil {
-		return err
+		return primitive.Timestamp{}, err
 	}
 
-	helpers.SortByKeyTimeStamp(listResp.Contents, helpers.S3BackupPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database))
-
-	oldestBackupKey := strings.TrimPrefix(*listResp.Contents[0].Key, helpers.S3BackupPrefix(command.S3.Prefix, ""))
-	oldestBackupKey = strings.TrimSuffix(oldestBackupKey, ".gzip")
-	oldestBackupKey = strings.TrimSuffix(oldestBackupKey, ".archive")
-
-	oldestBackupTime, err := time.Parse(helpers.TimeFormat, oldestBackupKey)
+	if manifest != nil && manifest.OplogCaptured {
+		return manifest.OplogFrom, nil
+	}
 
+	backupTime, err := helpers.BackupKeyTime(backupKey)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to parse the oldest backup time")
-		return err
+		return primitive.Timestamp{}, err
 	}
 
-	// ######################
-	// Get all oplog backups older than the oldest backup
-	// ######################
-	oplogBackupListResp, err := s3Service.List(ctx, command.S3.Bucket, helpers.S3OplogPrefix(command.S3.Prefix))
-	if err != nil {
-		return err
+	return primitive.Timestamp{T: uint32(backupTime.Unix())}, nil
+}
+
+// skipExcludedCollections hands mongodump the collection names that are left out of every database they are in,
+// mongodump only excludes collections by name, so these are not read just to be filtered out of the archive
+func skipExcludedCollections(ctx context.Context, mongodbService *services.MongodbService, command *DumpCommand, mongoDump *mongodump.MongoDump) error {
+	if command.Mongo.NamespaceOptions.Collection != "" {
+		return nil
 	}
 
-	objectsToDelete := make([]types.ObjectIdentifier, 0)
+	databases := []string{command.Mongo.NamespaceOptions.Database}
 
-	for _, obj := range oplogBackupListResp.Contents {
-		if (*obj.Key) == helpers.S3OplogPrefix(command.S3.Prefix)+helpers.ConfigFileName {
-			continue
+	if command.Mongo.NamespaceOptions.Database == "" {
+		names, err := mongodbService.ListDatabaseNames(ctx)
+		if err != nil {
+			return err
 		}
 
-		fileKey := strings.TrimPrefix(*obj.Key, helpers.S3OplogPrefix(command.S3.Prefix))
-		fileKey = strings.TrimSuffix(fileKey, ".tar.gz")
+		databases = slices.DeleteFunc(names, func(database string) bool { return database == "local" })
+	}
 
-		fileKey = strings.Split(fileKey, "_")[1]
-		toTimeOfLastBackup, err := time.Parse(helpers.TimeFormat, fileKey)
+	mongoDump.OutputOptions.ExcludedCollections = slices.Clone(mongoDump.OutputOptions.ExcludedCollections)
+	isExcluded := make(map[string]bool)
 
+	for _, database := range databases {
+		collections, err := mongodbService.ListCollectionNames(ctx, database)
 		if err != nil {
-			log.Error().Err(err).Msgf("Failed to parse the time of %s", fileKey)
 			return err
 		}
 
-		shouldKeepObject := toTimeOfLastBackup.After(oldestBackupTime)
-		if !shouldKeepObject {
-			objectsToDelete = append(objectsToDelete, types.ObjectIdentifier{Key: obj.Key})
+		for _, collection := range collections {
+			excluded, seen := isExcluded[collection]
+			isExcluded[collection] = (excluded || !seen) && !command.Mongo.IsDumpedNamespaceIncluded(database, collection)
 		}
 	}
 
-	if err := s3Service.Delete(ctx, command.S3.Bucket, objectsToDelete); err != nil {
-		return err
+	for collection, excluded := range isExcluded {
+		if excluded {
+			mongoDump.OutputOptions.ExcludedCollections = append(mongoDump.OutputOptions.ExcludedCollections, collection)
+		}
 	}
 
+	log.Info().Msgf("Skipping %d collections left out by the patterns, the rest are filtered out of the archive", len(mongoDump.OutputOptions.ExcludedCollections)-len(command.Mongo.OutputOptions.ExcludedCollections))
 	return nil
 }
 
-func getPreviousOplogRunData(ctx context.Context, s3Service *services.S3Service, command *DumpCommand) (*models.PreviousOplogRunInfo, error) {
-	log.Info().Msg("Getting the latest oplog config")
+// dumpArchive runs the dump into a local archive that is compressed as it is written and returns its path
+func dumpArchive(mongoDump *mongodump.MongoDump, backupDir string, compression string, compressionLevel int, isIncluded func(database string, collection string) bool) (string, error) {
+	archivePath := fmt.Sprintf("%s/dump_%d", strings.TrimSuffix(backupDir, "/"), time.Now().UnixNano())
 
-	oplogKeyWithPrefix := helpers.S3OplogPrefix(command.S3.Prefix) + helpers.ConfigFileName
+	file, err := os.Create(archivePath)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to create %s", archivePath)
+		return "", err
+	}
 
-	resp, err := s3Service.Get(ctx, command.S3.Bucket, oplogKeyWithPrefix)
+	defer file.Close()
 
+	writer, err := helpers.NewCompressionWriter(file, compression, compressionLevel)
 	if err != nil {
-		var responseError *awsHttp.ResponseError
+		os.Remove(archivePath)
+		return "", err
+	}
+
+	mongoDump.OutputWriter = writer
+
+	// ######################
+	// The namespaces left out by the patterns are filtered out of the archive as it is written
+	// ######################
+	var pipeWriter *io.PipeWriter
+	filterErr := make(chan error, 1)
+
+	if isIncluded != nil {
+		var pipeReader *io.PipeReader
+		pipeReader, pipeWriter = io.Pipe()
+
+		go func() {
+			err := helpers.FilterArchive(pipeReader, writer, isIncluded)
+			pipeReader.CloseWithError(err)
+			filterErr <- err
+		}()
+
+		mongoDump.OutputWriter = pipeWriter
+	}
+
+	dumpErr := mongoDump.Dump()
+
+	if pipeWriter != nil {
+		pipeWriter.CloseWithError(dumpErr)
+		dumpErr = errors.Join(dumpErr, <-filterErr)
+	}
+
+	if dumpErr != nil {
+		writer.Close()
+		os.Remove(archivePath)
+		return "", dumpErr
+	}
+
+	if err := writer.Close(); err != nil {
+		log.Error().Err(err).Msgf("Failed to compress %s", archivePath)
+		os.Remove(archivePath)
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		log.Error().Err(err).Msgf("Failed to write %s", archivePath)
+		os.Remove(archivePath)
+		return "", err
+	}
 
-		if ok := errors.As(err, &responseError); !ok {
-			log.Error().Err(err).Msg("Failed to get config file from S3")
-			return nil, err
+	return archivePath, nil
+}
+
+// dumpedNamespaceManifests keeps the manifests of the collections the archive holds with the number of documents
+// that were dumped, the options, indexes and dbHash are read from the collections once the dump is done
+func dumpedNamespaceManifests(namespaces []models.NamespaceManifest, inspection *models.ArchiveInspection, oplogCaptured bool) []models.NamespaceManifest {
+	dumped := make([]models.NamespaceManifest, 0, len(namespaces))
+
+	for _, namespace := range namespaces {
+		collection := findInspectedCollection(inspection, namespace.Database, namespace.Collection)
+		if collection == nil {
+			log.Warn().Msgf("%s was not dumped, it is left out of the manifest", namespace.Namespace())
+			continue
 		}
 
-		if responseError.ResponseError.HTTPStatusCode() == http.StatusNotFound {
-			log.Info().Msg("No oplog config found")
-			return nil, nil
+		namespace.Count = collection.Documents
+		namespace.ChangedDuringDump = inspection.OplogNamespaces[namespace.Namespace()] > 0
+
+		// the dbHash is taken after the dump, it only matches when nothing wrote to the collection during the dump,
+		// which is only known from the oplog captured with it
+		namespace.DbHashApproximate = namespace.DbHash != "" && (!oplogCaptured || namespace.ChangedDuringDump)
+
+		dumped = append(dumped, namespace)
+	}
+
+	return dumped
+}
+
+func findInspectedCollection(inspection *models.ArchiveInspection, database string, name string) *models.CollectionInspection {
+	for _, inspected := range inspection.Databases {
+		if inspected.Name != database {
+			continue
 		}
 
-		log.Error().Err(err).Msg("Failed to get config file from S3")
-		return nil, err
+		for _, collection := range inspected.Collections {
+			if collection.Name == name {
+				return &collection
+			}
+		}
 	}
 
-	defer resp.Body.Close()
+	return nil
+}
 
-	var oplogConfig models.PreviousOplogRunInfo
-	if err := json.NewDecoder(resp.Body).Decode(&oplogConfig); err != nil {
-		log.Error().Err(err).Msg("Failed to decode the config file")
+// inspectLocalArchive reads back the archive dumpArchive wrote
+func inspectLocalArchive(archivePath string) (*models.ArchiveInspection, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to open %s", archivePath)
 		return nil, err
 	}
 
-	log.Info().Msg("Got the latest oplog config")
-	return &oplogConfig, nil
+	defer file.Close()
+
+	return inspectArchive(file, archivePath)
 }
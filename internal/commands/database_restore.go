@@ -2,6 +2,8 @@ package commands
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"slices"
@@ -23,16 +25,31 @@ import (
 
 type DatabaseRestoreCommand struct {
 	Key                string                  `optional:"" env:"S3__KEY" prefix:"s3-" help:"The key of the backup to restore."`
+	ShardedBackup      string                  `optional:"" env:"SHARDED_BACKUP" help:"The id of the sharded backup to restore."`
+	Class              string                  `optional:"" env:"BACKUP_CLASS" enum:",scheduled,manual,pre-deploy" default:"" help:"Only offer, or only restore, the backups of this class, scheduled, manual or pre-deploy."`
+	ShardTargets       map[string]string       `optional:"" env:"SHARD_TARGETS" help:"The connection string to restore each shard of a sharded backup to, as shard=connection-string pairs separated by ';', the config server is named config."`
 	UsersToSkipDisable []string                `required:"" env:"USERS_TO_SKIP_DISABLE" help:"List of users to skip disabling, make sure to provide the admin user and the user that will be used to restore the backup."`
 	S3                 flags.S3Flags           `embed:"" group:"S3 Flags:"`
 	Mongo              flags.MongoRestoreFlags `embed:"" envprefix:"MONGO_RESTORE__"`
 	Verbosity          flags.VerbosityFlags    `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
 }
 
+// errOplogTargetNotReached is returned once the oplog replayed by a restore stops short of the requested point in time
+var errOplogTargetNotReached = errors.New("the oplog does not reach the requested restore target")
+
 func (command DatabaseRestoreCommand) Run() error {
 	command.Verbosity.SetGlobalLogLevel()
+	command.Mongo.WarnDeprecatedFlags()
+
+	if command.ShardedBackup != "" {
+		return command.RestoreShardedBackup(context.Background())
+	}
+
+	_, err := command.Restore(context.Background())
+	return err
+}
 
-	ctx := context.Background()
+func (command *DatabaseRestoreCommand) Restore(ctx context.Context) (*models.RestoreReport, error) {
 	s3Service := services.NewS3Service(command.S3)
 
 	var err error
@@ -42,7 +59,7 @@ func (command DatabaseRestoreCommand) Run() error {
 	mongodbService, err := services.NewMongodbService(command.Mongo.ConnectionString, ctx)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	backupDir := strings.TrimSuffix(command.Mongo.BackupDir, "/")
@@ -51,16 +68,43 @@ func (command DatabaseRestoreCommand) Run() error {
 	// If key is not provided, let user choose the backup to restore
 	// ########################
 	if command.Key == "" {
-		if command.Key, err = chooseDatabaseToRestore(s3Service, ctx, command.S3.Bucket, command.S3.Prefix); err != nil {
-			return err
+		if command.Key, err = chooseDatabaseToRestore(s3Service, ctx, command.S3.Bucket, command.S3.Prefix, command.Class); err != nil {
+			return nil, err
 		}
 	}
 
+	// ########################
+	// Make sure the target is the intended one
+	// ########################
+	manifest, err := getBackupManifest(ctx, s3Service, command.S3.Bucket, command.S3.Prefix, command.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if command.Class != "" && manifest.BackupClass() != command.Class {
+		err := fmt.Errorf("%s is a %s backup, not a %s backup", command.Key, manifest.BackupClass(), command.Class)
+		log.Error().Err(err).Send()
+		return nil, err
+	}
+
+	var source *models.ClusterFingerprint
+	if manifest != nil {
+		source = manifest.Source
+	}
+
+	if err := guardRestoreTarget(ctx, mongodbService, &command.Mongo, source); err != nil {
+		return nil, err
+	}
+
+	report := &models.RestoreReport{Key: command.Key}
+
 	// ########################
 	// Get backup from S3
 	// ########################
+	phaseStartedAt := time.Now()
+
 	if backup, err = s3Service.Get(ctx, command.S3.Bucket, command.Key); err != nil {
-		return err
+		return nil, err
 	}
 
 	// ########################
@@ -68,11 +112,45 @@ func (command DatabaseRestoreCommand) Run() error {
 	// ########################
 	fileName := strconv.FormatInt(time.Now().Unix(), 10)
 	if err := helpers.WriteToFile(backup.Body, backup.ContentLength, backupDir, fileName); err != nil {
-		return err
+		return nil, err
+	}
+
+	report.AddPhase("download", phaseStartedAt)
+
+	prelude, err := helpers.ReadArchivePrelude(filepath.Join(backupDir, fileName))
+	if err != nil {
+		return nil, err
+	}
+
+	report.Databases = helpers.PreludeDatabases(prelude)
+
+	if manifest != nil {
+		checkArchiveNamespaces(prelude, manifest)
+	}
+
+	// ########################
+	// Snapshot the namespaces that will be dropped
+	// ########################
+	if command.Mongo.RestoreOptions.PreRestoreSnapshot {
+		phaseStartedAt = time.Now()
+
+		if !command.Mongo.RestoreOptions.Drop || command.Mongo.RestoreOptions.DryRun {
+			log.Info().Msg("Skipping pre-restore snapshot as nothing will be dropped")
+		} else if err := command.takePreRestoreSnapshot(ctx, s3Service, mongodbService, filepath.Join(backupDir, fileName)); err != nil {
+			log.Err(err).Msg("Failed to take pre-restore snapshot")
+			return nil, err
+		}
+
+		report.AddPhase("snapshot", phaseStartedAt)
 	}
 
 	log.Info().Msgf("Restoring backup %s", command.Key)
 
+	isRestored, err := command.Mongo.NamespaceMatcher()
+	if err != nil {
+		return nil, err
+	}
+
 	// ########################
 	// Check if we should Run users restore.
 	// ########################
@@ -87,32 +165,115 @@ func (command DatabaseRestoreCommand) Run() error {
 	// Prepare restore options
 	// ########################
 	command.Mongo.InputOptions.SkipUsersAndRoles = true
-	if mongoRestore, err = command.Mongo.PrepareBackupMongoRestoreOptions(filepath.Join(backupDir, fileName)); err != nil {
+
+	// ########################
+	// Replay the oplog captured during the dump, mongorestore does not allow it with namespace filters
+	// ########################
+	isFullRestore := command.Mongo.NamespaceOptions.Database == "" && command.Mongo.NamespaceOptions.Collection == "" &&
+		len(command.Mongo.NamespaceOptions.NSExclude) == 0 && len(command.Mongo.NamespaceOptions.NSInclude) == 0
+
+	replayArchiveOplog := command.Mongo.InputOptions.OplogReplay && isFullRestore && helpers.PreludeHasOplog(prelude)
+
+	oplogLimit, err := getOplogLimit(command)
+	if err != nil {
+		return nil, err
+	}
+
+	archiveOplogLimit := ""
+	if replayArchiveOplog {
+		if oplogLimit != nil {
+			archiveOplogLimit = oplogLimit.Value
+		}
+
+		log.Info().Msg("Replaying the oplog captured during the dump")
+	}
+
+	// ########################
+	// The compression of the archive is detected from its content
+	// ########################
+	archiveReader, err := helpers.OpenArchive(filepath.Join(backupDir, fileName))
+	if err != nil {
+		return nil, err
+	}
+
+	defer archiveReader.Close()
+
+	if mongoRestore, err = command.Mongo.PrepareBackupMongoRestoreOptions(archiveReader, replayArchiveOplog, archiveOplogLimit); err != nil {
 		log.Err(err).Msg("Failed to prepare restore options")
-		return err
+		return nil, err
 	}
 
 	// ########################
 	// Restore backup
 	// ########################
+	phaseStartedAt = time.Now()
+
 	result := mongoRestore.Restore()
 
 	if result.Err != nil {
 		log.Err(result.Err).Msg("Failed to restore backup")
-		return result.Err
+		return nil, result.Err
 	}
 
 	log.Info().Msgf("Successfully restored %d, Failed to restore %d", result.Successes, result.Failures)
 
+	report.AddPhase("restore", phaseStartedAt)
+
+	if backupTime, err := helpers.BackupKeyTime(command.Key); err == nil {
+		report.RestoredTo = backupTime.Format(helpers.TimeFormat)
+	}
+
+	if replayArchiveOplog && manifest != nil && manifest.OplogCaptured {
+		restoredTo := time.Unix(int64(manifest.OplogTo.T), 0).UTC()
+
+		if oplogLimit != nil && oplogLimit.Time.Before(restoredTo) {
+			restoredTo = oplogLimit.Time
+		}
+
+		report.RestoredTo = restoredTo.Format(helpers.TimeFormat)
+	}
+
+	oplogReplayed := false
+
+	// the oplog that did not reach the requested point in time, the restore goes on and fails at the end
+	var oplogErr error
+
+	// ########################
+	// A database backup replays the oplog of its database when it is restored as a whole
+	// ########################
+	backupDatabase := helpers.BackupKeyDatabase(command.S3.Prefix, command.Key)
+
+	isDatabaseRestore := backupDatabase != "" && command.Mongo.NamespaceOptions.Database == backupDatabase && command.Mongo.NamespaceOptions.Collection == "" &&
+		len(command.Mongo.NamespaceOptions.NSExclude) == 0 && len(command.Mongo.NamespaceOptions.NSInclude) == 0
+
 	if command.Mongo.InputOptions.OplogReplay {
-		if command.Mongo.NamespaceOptions.Database == "" && command.Mongo.NamespaceOptions.Collection == "" &&
-			len(command.Mongo.NamespaceOptions.NSExclude) == 0 && len(command.Mongo.NamespaceOptions.NSInclude) == 0 {
+		if isFullRestore || isDatabaseRestore {
 
 			log.Info().Msg("Restoring Oplog")
 
-			if err := command.RestoreOplog(ctx, s3Service, command.Key); err != nil {
+			phaseStartedAt = time.Now()
+
+			oplogRestored, err := command.RestoreOplog(ctx, s3Service, command.Key)
+			if errors.Is(err, errOplogTargetNotReached) {
+				report.Incomplete = true
+				oplogErr = err
+			} else if err != nil {
 				log.Err(err).Msg("Failed to restore oplog")
-				return err
+				return nil, err
+			}
+
+			report.AddPhase("oplog", phaseStartedAt)
+			report.OplogSegments = len(oplogRestored)
+			oplogReplayed = len(oplogRestored) > 0
+
+			if oplogReplayed {
+				restoredTo := oplogRestored[len(oplogRestored)-1].ToTime
+
+				if oplogLimit != nil && oplogLimit.Time.Before(restoredTo) {
+					restoredTo = oplogLimit.Time
+				}
+
+				report.RestoredTo = restoredTo.Format(helpers.TimeFormat)
 			}
 		} else {
 			log.Info().Msg("Skipping Oplog restore as database or collection is provided")
@@ -125,14 +286,24 @@ func (command DatabaseRestoreCommand) Run() error {
 		// ########################
 		log.Info().Msg("Restoring users")
 
+		phaseStartedAt = time.Now()
+
 		// ########################
 		// Prepare restore options
 		// ########################
 		command.Mongo.InputOptions.SkipUsersAndRoles = false
 		command.Mongo.NamespaceOptions.NSInclude = []string{"admin.*"}
-		if mongoRestore, err = command.Mongo.PrepareBackupMongoRestoreOptions(filepath.Join(backupDir, fileName)); err != nil {
+
+		usersArchiveReader, err := helpers.OpenArchive(filepath.Join(backupDir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		defer usersArchiveReader.Close()
+
+		if mongoRestore, err = command.Mongo.PrepareBackupMongoRestoreOptions(usersArchiveReader, false, ""); err != nil {
 			log.Err(err).Msg("Failed to prepare restore user options")
-			return err
+			return nil, err
 		}
 
 		// ########################
@@ -142,18 +313,40 @@ func (command DatabaseRestoreCommand) Run() error {
 
 		if result.Err != nil {
 			log.Err(result.Err).Msg("Failed to restore backup")
-			return result.Err
+			return nil, result.Err
 		}
+
+		report.AddPhase("users", phaseStartedAt)
 	}
 
 	if err := mongodbService.SetOriginalUserRoles(ctx, command.UsersToSkipDisable); err != nil {
-		return err
+		return nil, err
+	}
+
+	// ########################
+	// Validate the restore
+	// ########################
+	switch {
+	case !command.Mongo.ValidationOptions.Validate || command.Mongo.RestoreOptions.DryRun:
+		log.Info().Msg("Skipping restore validation")
+	case manifest == nil || len(manifest.Namespaces) == 0:
+		log.Info().Msgf("Skipping restore validation as %s has no manifest", command.Key)
+	default:
+		phaseStartedAt = time.Now()
+
+		report.Validation, err = validateRestore(ctx, mongodbService, manifest, isRestored, oplogReplayed, replayArchiveOplog, command.Mongo.ValidationOptions.ValidateDbHash)
+
+		report.AddPhase("validation", phaseStartedAt)
+
+		if err != nil {
+			return report, errors.Join(oplogErr, err)
+		}
 	}
 
-	return nil
+	return report, oplogErr
 }
 
-func chooseDatabaseToRestore(s3Service *services.S3Service, ctx context.Context, bucket string, prefix string) (string, error) {
+func chooseDatabaseToRestore(s3Service *services.S3Service, ctx context.Context, bucket string, prefix string, class string) (string, error) {
 	var response *s3.ListObjectsV2Output
 	var backupToRestore string
 	var err error
@@ -162,11 +355,24 @@ func chooseDatabaseToRestore(s3Service *services.S3Service, ctx context.Context,
 		return "", err
 	}
 
+	// the backups without a manifest are scheduled backups
+	manifests := make(map[string]*models.BackupManifest)
+
+	if class != "" {
+		if manifests, err = getBackupManifests(ctx, s3Service, bucket, prefix, ""); err != nil {
+			return "", err
+		}
+	}
+
 	list := make([]huh.Option[string], 0)
 
 	for _, object := range response.Contents {
 		key := *object.Key
-		if !strings.Contains(key, "oplog") {
+		if !strings.Contains(key, "oplog") && !strings.HasPrefix(key, helpers.S3PreRestorePrefix(prefix)) && !strings.HasPrefix(key, helpers.S3ManifestPrefix(prefix)) {
+			if class != "" && manifests[key].BackupClass() != class {
+				continue
+			}
+
 			list = append(list, huh.NewOption(key, key))
 		}
 	}
@@ -185,51 +391,54 @@ func chooseDatabaseToRestore(s3Service *services.S3Service, ctx context.Context,
 	return backupToRestore, nil
 }
 
-func (command *DatabaseRestoreCommand) RestoreOplog(ctx context.Context, s3Service *services.S3Service, keyRestored string) error {
+func (command *DatabaseRestoreCommand) RestoreOplog(ctx context.Context, s3Service *services.S3Service, keyRestored string) ([]models.OplogBackup, error) {
 
-	keyPath := helpers.S3BackupPrefix(command.S3.Prefix, "")
+	// ###############################
+	// Database backups have their own oplog chain
+	// ###############################
+	backupDatabase := helpers.BackupKeyDatabase(command.S3.Prefix, keyRestored)
+	keyPath := helpers.S3BackupPrefix(command.S3.Prefix, backupDatabase)
 
 	backupRestoreTime := strings.TrimPrefix(keyRestored, keyPath)
-	backupRestoreTime = strings.TrimSuffix(backupRestoreTime, ".gzip")
-	backupRestoreTime = strings.TrimSuffix(backupRestoreTime, ".archive")
+	backupRestoreTime = helpers.TrimArchiveExtension(backupRestoreTime)
 
 	// ###############################
 	// List all the backups
 	// ###############################
-	resp, err := s3Service.List(
+	objects, err := s3Service.ListAll(
 		ctx,
 		command.S3.Bucket,
-		helpers.S3OplogPrefix(command.S3.Prefix),
+		helpers.S3OplogPrefix(command.S3.Prefix, backupDatabase),
 	)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(resp.Contents) == 0 {
+	if len(objects) == 0 {
 		log.Info().Msg("No Oplog backups found")
-		return nil
+		return nil, nil
 	}
 
 	// ###############################
 	// Filter out the config file
 	// ###############################
-	resp.Contents = slices.DeleteFunc(resp.Contents, func(i types.Object) bool {
+	objects = slices.DeleteFunc(objects, func(i types.Object) bool {
 		return strings.Contains(*i.Key, helpers.ConfigFileName)
 	})
 
 	// ###############################
 	// Prepare the list of oplog backups and oplog backups to be restored
 	// ###############################
-	oplogBackupList := make([]models.OplogBackup, len(resp.Contents))
+	oplogBackupList := make([]models.OplogBackup, len(objects))
 	oplogToRestore := make([]models.OplogBackup, 0)
 
 	// ###############################
 	// Change backups to models.oplogBackup
 	// ###############################
-	for i, obj := range resp.Contents {
+	for i, obj := range objects {
 		key := *obj.Key
-		oplogBackupList[i] = helpers.PrepareOplogBackup(key, command.S3.Prefix)
+		oplogBackupList[i] = helpers.PrepareOplogBackup(key)
 	}
 
 	// ###############################
@@ -244,9 +453,17 @@ func (command *DatabaseRestoreCommand) RestoreOplog(ctx context.Context, s3Servi
 	// ###############################
 	// change the oplog limits to time
 	// ###############################
-	oplogLimitToTime, err := getOplogLimit(command)
+	limit, err := getOplogLimit(command)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	var oplogLimitToTime *time.Time
+	oplogLimit := ""
+
+	if limit != nil {
+		oplogLimitToTime = &limit.Until
+		oplogLimit = limit.Value
 	}
 
 	// ###############################
@@ -255,13 +472,15 @@ func (command *DatabaseRestoreCommand) RestoreOplog(ctx context.Context, s3Servi
 	time, err := time.Parse(helpers.TimeFormat, backupRestoreTime)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to parse backup time into a from Limit")
-		return err
+		return nil, err
 	}
 	oplogLimitFromTime := &time
 
 	// ###############################
 	// prepare the directories
 	// ###############################
+	var chainErr error
+
 	downloadsDir := filepath.Join(command.Mongo.BackupDir, "downloads")
 	restoreDir := filepath.Join(command.Mongo.BackupDir, "toBeRestored")
 	outputDir := filepath.Join(restoreDir, "local")
@@ -285,6 +504,24 @@ func (command *DatabaseRestoreCommand) RestoreOplog(ctx context.Context, s3Servi
 			continue
 		}
 
+		// ###############################
+		// Stop at the first gap in the oplog chain, what comes before it is still replayed
+		// ###############################
+		if len(oplogToRestore) > 0 {
+			previous := oplogToRestore[len(oplogToRestore)-1]
+
+			if oplogBackup.FromTime.After(previous.ToTime) {
+				target := command.Mongo.InputOptions.OplogLimit
+				if target == "" {
+					target = oplogBackupList[len(oplogBackupList)-1].ToString
+				}
+
+				chainErr = fmt.Errorf("%w: the oplog chain is broken between %s and %s, the oplog is only replayed up to %s instead of %s", errOplogTargetNotReached, previous.ToString, oplogBackup.FromString, previous.ToString, target)
+				log.Error().Err(chainErr).Send()
+				break
+			}
+		}
+
 		// ###############################
 		// Add the backup to the list of backups to be restored
 		// ###############################
@@ -295,14 +532,14 @@ func (command *DatabaseRestoreCommand) RestoreOplog(ctx context.Context, s3Servi
 		// ###############################
 		obj, err := s3Service.Get(ctx, command.S3.Bucket, oplogBackup.Key)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// ###############################
 		// Write the backup to file
 		// ###############################
 		if err := helpers.WriteToFile(obj.Body, obj.ContentLength, downloadsDir, oplogBackup.FileName); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -315,8 +552,8 @@ func (command *DatabaseRestoreCommand) RestoreOplog(ctx context.Context, s3Servi
 		// ###############################
 		// Extract the tar file
 		// ###############################
-		if err := helpers.ExtractTar(tarPath, outputDir); err != nil {
-			return err
+		if err := helpers.ExtractOplogSegment(tarPath, outputDir); err != nil {
+			return nil, err
 		}
 
 		// ###############################
@@ -329,9 +566,9 @@ func (command *DatabaseRestoreCommand) RestoreOplog(ctx context.Context, s3Servi
 		// ###############################
 		// Prepare the mongodb options
 		// ###############################
-		oplogOptions, err := command.Mongo.PrepareOplogMongoRestoreOptions(restoreDir, oplogLimitToTime)
+		oplogOptions, err := command.Mongo.PrepareOplogMongoRestoreOptions(restoreDir, oplogLimit)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// ###############################
@@ -342,7 +579,7 @@ func (command *DatabaseRestoreCommand) RestoreOplog(ctx context.Context, s3Servi
 
 		if result.Err != nil {
 			log.Err(result.Err).Msg("Failed to restore oplog")
-			return result.Err
+			return nil, result.Err
 		}
 
 		// ###############################
@@ -353,26 +590,43 @@ func (command *DatabaseRestoreCommand) RestoreOplog(ctx context.Context, s3Servi
 		}
 	}
 
-	return nil
+	return oplogToRestore, chainErr
 }
 
-func getOplogLimit(command *DatabaseRestoreCommand) (*time.Time, error) {
-	if command.Mongo.InputOptions.OplogLimit != "" {
-		log.Info().Msg("Parsing oplog limits")
+// restoreOplogLimit is the --oplog-limit of a restore, every oplog entry before it is replayed
+type restoreOplogLimit struct {
+	// the point in time the restore reaches
+	Time time.Time
+
+	// the oplog backups that start before it are downloaded, mongorestore leaves out the entries past the limit
+	Until time.Time
+
+	// the mongorestore --oplogLimit
+	Value string
+}
+
+// getOplogLimit parses --oplog-limit, either a time that only has the precision of a second
+// or the exact timestamp of an oplog entry written as seconds:increment
+func getOplogLimit(command *DatabaseRestoreCommand) (*restoreOplogLimit, error) {
+	if command.Mongo.InputOptions.OplogLimit == "" {
+		return nil, nil
 	}
 
-	var oplogLimitToTime *time.Time = nil
+	if ts, err := helpers.ParseOplogTimestamp(command.Mongo.InputOptions.OplogLimit); err == nil {
+		limitTime := helpers.OplogTimestampTime(ts)
 
-	if command.Mongo.InputOptions.OplogLimit != "" {
-		time, err := time.Parse(helpers.TimeFormat, command.Mongo.InputOptions.OplogLimit)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to parse provided To Limit")
-			return nil, err
-		}
-		oplogLimitToTime = &time
+		// the entries of the same second before the timestamp are replayed too
+		return &restoreOplogLimit{Time: limitTime, Until: limitTime.Add(time.Second), Value: helpers.OplogTimestampString(ts)}, nil
+	}
+
+	limitTime, err := time.Parse(helpers.TimeFormat, command.Mongo.InputOptions.OplogLimit)
+	if err != nil {
+		err := fmt.Errorf("invalid --oplog-limit %s, expected a time such as %s or an oplog timestamp such as 1700000000:3", command.Mongo.InputOptions.OplogLimit, helpers.TimeFormat)
+		log.Error().Err(err).Send()
+		return nil, err
 	}
 
-	return oplogLimitToTime, nil
+	return &restoreOplogLimit{Time: limitTime, Until: limitTime, Value: strconv.FormatInt(limitTime.Unix(), 10)}, nil
 }
 
 func shouldRestoreBackup(from *time.Time, to *time.Time, backup models.OplogBackup) bool {
@@ -0,0 +1,286 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/charmbracelet/huh"
+	"github.com/charmbracelet/lipgloss/table"
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+type DeleteCommand struct {
+	Key       string               `arg:"" help:"The key of the backup to delete, or the sharded_backup.json of a sharded backup"`
+	Force     bool                 `env:"DELETE__FORCE" help:"Delete the backup even when it is pinned"`
+	Yes       bool                 `env:"DELETE__YES" help:"Delete without asking for confirmation"`
+	S3        flags.S3Flags        `embed:"" group:"S3 Flags:"`
+	Verbosity flags.VerbosityFlags `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
+}
+
+// backupDeletion holds a backup and the objects that depend on it
+type backupDeletion struct {
+	Objects []models.RetentionDecision
+
+	OplogPrefix string
+
+	// the oplog config is deleted along with the last oplog backups when no backup is left to restore them from
+	DeletesOplogConfig bool
+}
+
+func (command DeleteCommand) Run() error {
+	command.Verbosity.SetGlobalLogLevel()
+
+	ctx := context.Background()
+	s3Service := services.NewS3Service(command.S3)
+
+	// ######################
+	// Pinned backups are only deleted on purpose
+	// ######################
+	pin, err := getActivePin(ctx, s3Service, command.S3.Bucket, command.S3.Prefix, command.Key, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if pin != nil && !command.Force {
+		err := fmt.Errorf("%s is %s, use --force to delete it anyway", command.Key, pinReason(pin))
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	// ######################
+	// Work out what depends on the backup
+	// ######################
+	var deletion *backupDeletion
+
+	if strings.HasPrefix(command.Key, helpers.S3ShardedBackupPrefix(command.S3.Prefix)) && strings.HasSuffix(command.Key, "/"+helpers.ShardedBackupFileName) {
+		deletion, err = planShardedBackupDeletion(ctx, s3Service, command.S3, command.Key)
+	} else {
+		deletion, err = planBackupDeletion(ctx, s3Service, command.S3, command.Key)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	printBackupDeletion(deletion)
+
+	// ######################
+	// Confirm the deletion
+	// ######################
+	if !command.Yes {
+		confirmed := false
+
+		if err := huh.NewConfirm().
+			Title(fmt.Sprintf("Delete %s and the %d objects that depend on it?", command.Key, len(deletion.Objects)-1)).
+			Value(&confirmed).
+			Run(); err != nil {
+			log.Error().Err(err).Msg("Failed to confirm the deletion")
+			return err
+		}
+
+		if !confirmed {
+			log.Info().Msg("Nothing was deleted")
+			return nil
+		}
+	}
+
+	// ######################
+	// Delete the oplog config first, so oplog backups never continue a chain that is gone
+	// ######################
+	if deletion.DeletesOplogConfig {
+		log.Info().Msgf("No backup is left to restore the oplog backups of %s from, deleting its oplog config", deletion.OplogPrefix)
+
+		if err := s3Service.Delete(ctx, command.S3.Bucket, []types.ObjectIdentifier{{Key: aws.String(deletion.OplogPrefix + helpers.ConfigFileName)}}); err != nil {
+			return err
+		}
+	}
+
+	// ######################
+	// Delete the backup along with everything that depends on it, in batches of S3 deletes that are not atomic
+	// ######################
+	if err := deleteRetentionDecisions(ctx, s3Service, command.S3.Bucket, deletion.Objects); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Deleted %s and %d objects that depended on it, reclaimed %s", command.Key, len(deletion.Objects)-1, helpers.FormatBytes(retentionDecisionsSize(deletion.Objects)))
+	return nil
+}
+
+// planBackupDeletion finds the objects that go with a full or database backup: its manifest and, when it is
+// the oldest backup of its prefix, the oplog backups between it and the next backup. A restore from an older
+// backup replays the whole oplog chain after it, so the oplog backups of any other backup are kept
+func planBackupDeletion(ctx context.Context, s3Service *services.S3Service, s3Flags flags.S3Flags, key string) (*backupDeletion, error) {
+	backupTime, err := helpers.BackupKeyTime(key)
+	if err != nil {
+		err := fmt.Errorf("%s is not a backup, only full, database and sharded backups can be deleted", key)
+		log.Error().Err(err).Send()
+		return nil, err
+	}
+
+	database := helpers.BackupKeyDatabase(s3Flags.Prefix, key)
+	deletion := &backupDeletion{OplogPrefix: helpers.S3OplogPrefix(s3Flags.Prefix, database)}
+
+	// ######################
+	// The backup, its manifest, and the backups of the same prefix before and after it
+	// ######################
+	backupObjects, err := s3Service.ListAll(ctx, s3Flags.Bucket, helpers.S3BackupPrefix(s3Flags.Prefix, database))
+	if err != nil {
+		return nil, err
+	}
+
+	var previousBackup, nextBackup *models.RetentionDecision
+
+	for _, obj := range backupObjects {
+		if *obj.Key == key {
+			deletion.Objects = append(deletion.Objects, models.RetentionDecision{Key: key, Time: backupTime, Size: aws.ToInt64(obj.Size), Reason: "the backup"})
+			continue
+		}
+
+		objTime, err := helpers.BackupKeyTime(*obj.Key)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case !objTime.After(backupTime):
+			if previousBackup == nil || objTime.After(previousBackup.Time) {
+				previousBackup = &models.RetentionDecision{Key: *obj.Key, Time: objTime}
+			}
+		case nextBackup == nil || objTime.Before(nextBackup.Time):
+			nextBackup = &models.RetentionDecision{Key: *obj.Key, Time: objTime}
+		}
+	}
+
+	if len(deletion.Objects) == 0 {
+		err := errors.New("there is no backup " + key)
+		log.Error().Err(err).Send()
+		return nil, err
+	}
+
+	if manifest, err := s3Service.Head(ctx, s3Flags.Bucket, helpers.S3ManifestKey(s3Flags.Prefix, key)); err == nil {
+		deletion.Objects = append(deletion.Objects, models.RetentionDecision{
+			Key:    helpers.S3ManifestKey(s3Flags.Prefix, key),
+			Time:   backupTime,
+			Size:   aws.ToInt64(manifest.ContentLength),
+			Reason: "the manifest of the backup",
+		})
+	} else if !services.IsNotFound(err) {
+		return nil, err
+	}
+
+	// ######################
+	// Restores from the previous backup, pinned or not, replay the oplog backups after this one
+	// ######################
+	if previousBackup != nil {
+		log.Info().Msgf("Keeping the oplog backups after %s, point-in-time restores from %s replay them", key, previousBackup.Key)
+		return deletion, nil
+	}
+
+	// ######################
+	// The oplog backups only point-in-time restores from the backup replay, up to the next backup
+	// ######################
+	oplogObjects, err := s3Service.ListAll(ctx, s3Flags.Bucket, deletion.OplogPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	hasConfig := false
+
+	for _, obj := range oplogObjects {
+		if *obj.Key == deletion.OplogPrefix+helpers.ConfigFileName {
+			hasConfig = true
+			continue
+		}
+
+		if len(strings.Split(helpers.TrimOplogSegmentExtension(path.Base(*obj.Key)), "_")) != 2 {
+			log.Warn().Msgf("Skipping %s as it is not named after the times of an oplog backup", *obj.Key)
+			continue
+		}
+
+		segment := helpers.PrepareOplogBackup(*obj.Key)
+
+		// the oplog backups that reach past the start of the next backup are needed by it
+		if !segment.ToTime.After(backupTime) || (nextBackup != nil && segment.ToTime.After(nextBackup.Time)) {
+			continue
+		}
+
+		reason := "needed by point-in-time restores from the backup, which is the only one"
+		if nextBackup != nil {
+			reason = "needed by point-in-time restores from the backup, up to the next backup " + nextBackup.Key
+		}
+
+		deletion.Objects = append(deletion.Objects, models.RetentionDecision{Key: segment.Key, Time: segment.ToTime, Size: aws.ToInt64(obj.Size), Reason: reason})
+	}
+
+	// ######################
+	// The oplog chain only goes away with the last backup, otherwise it continues where it is
+	// ######################
+	deletion.DeletesOplogConfig = hasConfig && nextBackup == nil
+
+	return deletion, nil
+}
+
+// planShardedBackupDeletion finds the objects of a sharded backup, the archives and the oplog backups of its shards live under it
+func planShardedBackupDeletion(ctx context.Context, s3Service *services.S3Service, s3Flags flags.S3Flags, key string) (*backupDeletion, error) {
+	objects, err := s3Service.ListAll(ctx, s3Flags.Bucket, strings.TrimSuffix(key, helpers.ShardedBackupFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	deletion := &backupDeletion{}
+
+	for _, obj := range objects {
+		reason := "a part of the sharded backup"
+		if *obj.Key == key {
+			reason = "the sharded backup"
+		}
+
+		deletion.Objects = append(deletion.Objects, models.RetentionDecision{Key: *obj.Key, Size: aws.ToInt64(obj.Size), Reason: reason})
+	}
+
+	if !slices.ContainsFunc(deletion.Objects, func(decision models.RetentionDecision) bool { return decision.Key == key }) {
+		err := errors.New("there is no sharded backup " + key)
+		log.Error().Err(err).Send()
+		return nil, err
+	}
+
+	if manifest, err := s3Service.Head(ctx, s3Flags.Bucket, helpers.S3ManifestKey(s3Flags.Prefix, key)); err == nil {
+		deletion.Objects = append(deletion.Objects, models.RetentionDecision{
+			Key:    helpers.S3ManifestKey(s3Flags.Prefix, key),
+			Size:   aws.ToInt64(manifest.ContentLength),
+			Reason: "the manifest of the sharded backup",
+		})
+	} else if !services.IsNotFound(err) {
+		return nil, err
+	}
+
+	return deletion, nil
+}
+
+func printBackupDeletion(deletion *backupDeletion) {
+	fmt.Println("Objects to delete:")
+
+	report := table.New().Headers("Key", "Size", "Reason")
+
+	for _, object := range deletion.Objects {
+		report = report.Row(object.Key, helpers.FormatBytes(object.Size), object.Reason)
+	}
+
+	fmt.Println(report)
+	fmt.Printf("%d objects, %s\n", len(deletion.Objects), helpers.FormatBytes(retentionDecisionsSize(deletion.Objects)))
+
+	if deletion.DeletesOplogConfig {
+		fmt.Printf("No backup is left to restore the oplog backups of %s from, its oplog config is deleted\n", deletion.OplogPrefix)
+	}
+}
@@ -0,0 +1,213 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+type DrillCommand struct {
+	Pick               string                  `env:"DRILL__PICK" enum:"latest,random" default:"latest" help:"Which full backup to restore, the latest or a random one (latest, random)"`
+	UsersToSkipDisable []string                `required:"" env:"USERS_TO_SKIP_DISABLE" help:"List of users to skip disabling, make sure to provide the admin user and the user that will be used to restore the backup."`
+	S3                 flags.S3Flags           `embed:"" group:"S3 Flags:"`
+	Mongo              flags.MongoRestoreFlags `embed:"" envprefix:"MONGO_RESTORE__"`
+	Verbosity          flags.VerbosityFlags    `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
+}
+
+func (command DrillCommand) Run() error {
+	command.Verbosity.SetGlobalLogLevel()
+	command.Mongo.WarnDeprecatedFlags()
+
+	ctx := context.Background()
+	s3Service := services.NewS3Service(command.S3)
+
+	report := &models.DrillReport{
+		StartedAt: time.Now().UTC().Format(helpers.TimeFormat),
+		Pick:      command.Pick,
+	}
+
+	drillErr := command.drill(ctx, s3Service, report)
+
+	report.FinishedAt = time.Now().UTC().Format(helpers.TimeFormat)
+	report.Passed = drillErr == nil
+	if drillErr != nil {
+		report.Error = drillErr.Error()
+	}
+
+	// ######################
+	// Upload the drill report next to the backups
+	// ######################
+	reportByteArray, err := json.Marshal(report)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal the drill report")
+		return err
+	}
+
+	if _, err := s3Service.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(command.S3.Bucket),
+		Key:    aws.String(helpers.S3DrillPrefix(command.S3.Prefix) + report.StartedAt + ".json"),
+		Body:   bytes.NewReader(reportByteArray),
+	}); err != nil {
+		log.Error().Err(err).Msg("Failed to upload the drill report")
+		return err
+	}
+
+	if drillErr != nil {
+		log.Error().Err(drillErr).Msg("Restore drill failed")
+		return drillErr
+	}
+
+	log.Info().Msgf("Restore drill passed, restored data lags %.0f seconds behind", report.LagSeconds)
+	return nil
+}
+
+func (command *DrillCommand) drill(ctx context.Context, s3Service *services.S3Service, report *models.DrillReport) (drillErr error) {
+
+	// ######################
+	// Pick the full backup to restore
+	// ######################
+	resp, err := s3Service.List(ctx, command.S3.Bucket, helpers.S3BackupPrefix(command.S3.Prefix, ""))
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Contents) == 0 {
+		return errors.New("no full backups found to drill")
+	}
+
+	helpers.SortByKeyTimeStamp(resp.Contents, helpers.S3BackupPrefix(command.S3.Prefix, ""))
+
+	backup := resp.Contents[len(resp.Contents)-1]
+	if command.Pick == "random" {
+		backup = resp.Contents[rand.IntN(len(resp.Contents))]
+	}
+
+	log.Info().Msgf("Drilling the restore of %s", *backup.Key)
+
+	// ######################
+	// The archive and the oplog backups are downloaded into a directory of the drill,
+	// so they are removed with it however the restore ends
+	// ######################
+	if err := os.MkdirAll(command.Mongo.BackupDir, 0755); err != nil {
+		log.Error().Err(err).Msgf("Failed to create %s", command.Mongo.BackupDir)
+		return err
+	}
+
+	drillDir, err := os.MkdirTemp(command.Mongo.BackupDir, "drill_")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create the drill directory")
+		return err
+	}
+
+	// ######################
+	// Drop everything that was restored, even when the restore failed half way
+	// ######################
+	defer func() {
+		phaseStartedAt := time.Now()
+
+		drillErr = errors.Join(drillErr, command.dropRestoredDatabases(ctx, drillDir))
+
+		if report.Restore != nil {
+			report.Restore.AddPhase("cleanup", phaseStartedAt)
+		}
+
+		if err := os.RemoveAll(drillDir); err != nil {
+			log.Error().Err(err).Msgf("Failed to remove %s", drillDir)
+		}
+	}()
+
+	// ######################
+	// Run the complete restore path up to the latest oplog
+	// ######################
+	restoreCommand := DatabaseRestoreCommand{
+		Key:                *backup.Key,
+		UsersToSkipDisable: command.UsersToSkipDisable,
+		S3:                 command.S3,
+		Mongo:              command.Mongo,
+		Verbosity:          command.Verbosity,
+	}
+
+	restoreCommand.Mongo.BackupDir = drillDir
+	restoreCommand.Mongo.RestoreOptions.Drop = true
+	restoreCommand.Mongo.RestoreOptions.DryRun = false
+	restoreCommand.Mongo.RestoreOptions.PreRestoreSnapshot = false
+	restoreCommand.Mongo.InputOptions.OplogReplay = true
+	restoreCommand.Mongo.InputOptions.OplogLimit = ""
+	restoreCommand.Mongo.ValidationOptions.Validate = true
+	restoreCommand.Mongo.NamespaceOptions.Database = ""
+	restoreCommand.Mongo.NamespaceOptions.Collection = ""
+	restoreCommand.Mongo.NamespaceOptions.NSInclude = nil
+	restoreCommand.Mongo.NamespaceOptions.NSExclude = nil
+
+	restoreReport, restoreErr := restoreCommand.Restore(ctx)
+	report.Restore = restoreReport
+
+	if restoreReport != nil {
+		if restoredTo, err := time.Parse(helpers.TimeFormat, restoreReport.RestoredTo); err == nil {
+			report.LagSeconds = time.Since(restoredTo).Seconds()
+		}
+	}
+
+	return restoreErr
+}
+
+// dropRestoredDatabases drops the databases of the archive downloaded into the drill directory,
+// nothing was restored when the archive never got there
+func (command *DrillCommand) dropRestoredDatabases(ctx context.Context, drillDir string) error {
+	entries, err := os.ReadDir(drillDir)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to read %s", drillDir)
+		return err
+	}
+
+	databases := make([]string, 0)
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		prelude, err := helpers.ReadArchivePrelude(filepath.Join(drillDir, entry.Name()))
+		if err != nil {
+			log.Warn().Msgf("Skipping the cleanup of %s, its prelude cannot be read so nothing of it was restored", entry.Name())
+			continue
+		}
+
+		databases = append(databases, helpers.PreludeDatabases(prelude)...)
+	}
+
+	if len(databases) == 0 {
+		return nil
+	}
+
+	mongodbService, err := services.NewMongodbService(command.Mongo.ConnectionString, ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, database := range databases {
+		if slices.Contains(snapshotSkippedDatabases, database) {
+			continue
+		}
+
+		if err := mongodbService.DropDatabase(ctx, database); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
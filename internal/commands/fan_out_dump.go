@@ -0,0 +1,121 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+// the databases of MongoDB itself are never dumped on their own
+var fanOutSkippedDatabases = []string{"admin", "config", "local"}
+
+func startFanOutBackup(command *DumpCommand) error {
+	ctx := context.Background()
+
+	if err := command.Mongo.ValidateNamespacePatterns(); err != nil {
+		return err
+	}
+
+	// ######################
+	// Find the databases to dump
+	// ######################
+	mongodbService, err := services.NewMongodbService(command.Mongo.ConnectionString, ctx)
+	if err != nil {
+		return err
+	}
+
+	names, err := mongodbService.ListDatabaseNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	databases := make([]string, 0, len(names))
+
+	for _, name := range names {
+		if !slices.Contains(fanOutSkippedDatabases, name) && command.Mongo.IsDatabaseIncluded(name) {
+			databases = append(databases, name)
+		}
+	}
+
+	if len(databases) == 0 {
+		log.Warn().Msg("No databases match the include and exclude patterns, nothing to dump")
+		return nil
+	}
+
+	log.Info().Msgf("Dumping %d databases: %s", len(databases), strings.Join(databases, ", "))
+
+	// ######################
+	// Dump the databases in parallel, a failed database does not stop the others
+	// ######################
+	semaphore := make(chan struct{}, max(command.Mongo.OutputOptions.NumParallelDatabases, 1))
+
+	var waitGroup sync.WaitGroup
+	dumpErrors := make([]error, len(databases))
+
+	for i, database := range databases {
+		waitGroup.Add(1)
+
+		go func(i int, database string) {
+			defer waitGroup.Done()
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			dumpErrors[i] = dumpFanOutDatabase(command, database)
+		}(i, database)
+	}
+
+	waitGroup.Wait()
+
+	if err := errors.Join(dumpErrors...); err != nil {
+		failed := len(slices.DeleteFunc(slices.Clone(dumpErrors), func(err error) bool { return err == nil }))
+
+		log.Error().Err(err).Msgf("Failed to dump %d of %d databases", failed, len(databases))
+		return err
+	}
+
+	log.Info().Msgf("Dumped %d databases", len(databases))
+	return nil
+}
+
+// dumpFanOutDatabase runs the dump of a single database, exactly as with --database, in a directory of its own
+func dumpFanOutDatabase(command *DumpCommand, database string) error {
+	databaseCommand := *command
+	databaseCommand.Mongo.NamespaceOptions.AllDatabases = false
+	databaseCommand.Mongo.NamespaceOptions.Database = database
+	// the database patterns are done with once the database is picked, the namespace patterns still apply
+	databaseCommand.Mongo.NamespaceOptions.IncludeDatabases = nil
+	databaseCommand.Mongo.NamespaceOptions.ExcludeDatabases = nil
+	databaseCommand.Mongo.BackupDir = filepath.Join(command.Mongo.BackupDir, database)
+
+	if err := os.MkdirAll(databaseCommand.Mongo.BackupDir, 0755); err != nil {
+		log.Error().Err(err).Msgf("Failed to create the backup directory of %s", database)
+		return err
+	}
+
+	defer os.RemoveAll(databaseCommand.Mongo.BackupDir)
+
+	log.Info().Msgf("Starting the dump of database %s", database)
+
+	var err error
+
+	if databaseCommand.Mongo.OutputOptions.OpLog {
+		err = startOplogBackup(&databaseCommand)
+	} else {
+		err = startBackup(&databaseCommand)
+	}
+
+	if err != nil {
+		return fmt.Errorf("database %s: %w", database, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss/table"
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+type InspectCommand struct {
+	Key       string               `arg:"" help:"The key of the backup or the oplog backup to inspect"`
+	Output    string               `enum:"table,json" default:"table" help:"How the content is printed, table or json (Default: table)"`
+	S3        flags.S3Flags        `embed:"" group:"S3 Flags:"`
+	Verbosity flags.VerbosityFlags `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
+}
+
+func (command InspectCommand) Run() error {
+	command.Verbosity.SetGlobalLogLevel()
+
+	ctx := context.Background()
+	s3Service := services.NewS3Service(command.S3)
+
+	// ######################
+	// Stream the backup from S3, nothing is written to disk
+	// ######################
+	obj, err := s3Service.Get(ctx, command.S3.Bucket, command.Key)
+	if err != nil {
+		return err
+	}
+
+	defer obj.Body.Close()
+
+	var inspection interface{}
+
+	if helpers.IsOplogBackupKey(command.Key) {
+		inspection, err = helpers.InspectOplogSegment(obj.Body, command.Key)
+	} else {
+		inspection, err = inspectArchive(obj.Body, command.Key)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// ######################
+	// Print what the backup holds
+	// ######################
+	if command.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(inspection)
+	}
+
+	switch inspection := inspection.(type) {
+	case *models.ArchiveInspection:
+		printArchiveInspection(inspection)
+	case *models.OplogInspection:
+		printOplogInspection(inspection)
+	}
+
+	return nil
+}
+
+func inspectArchive(body io.Reader, key string) (*models.ArchiveInspection, error) {
+	reader, err := helpers.NewDecompressionReader(body)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to open the decompression reader for %s", key)
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	inspection, err := helpers.InspectArchive(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	inspection.Key = key
+	return inspection, nil
+}
+
+func printArchiveInspection(inspection *models.ArchiveInspection) {
+	fmt.Printf("Backup: %s\n", inspection.Key)
+	fmt.Printf("Dumped from MongoDB %s with mongodump %s\n", inspection.ServerVersion, inspection.ToolVersion)
+
+	content := table.New().Headers("Namespace", "Type", "Documents", "Size", "Indexes", "Options")
+
+	var documents, size int64
+
+	for _, database := range inspection.Databases {
+		for _, collection := range database.Collections {
+			indexes := make([]string, 0, len(collection.Indexes))
+
+			for _, index := range collection.Indexes {
+				description := fmt.Sprintf("%s %s", index.Name, index.Key)
+				if len(index.Options) > 0 {
+					description += " " + string(index.Options)
+				}
+
+				indexes = append(indexes, description)
+			}
+
+			content = content.Row(
+				database.Name+"."+collection.Name,
+				collection.Type,
+				fmt.Sprint(collection.Documents),
+				helpers.FormatBytes(collection.Size),
+				strings.Join(indexes, "\n"),
+				string(collection.Options),
+			)
+
+			documents += collection.Documents
+			size += collection.Size
+		}
+	}
+
+	fmt.Println(content)
+	fmt.Printf("%d databases, %d documents, %s of documents\n", len(inspection.Databases), documents, helpers.FormatBytes(size))
+
+	if inspection.UsersAndRoles.Included {
+		fmt.Printf("Users and roles: included, %d users and %d roles\n", inspection.UsersAndRoles.Users, inspection.UsersAndRoles.Roles)
+	} else {
+		fmt.Println("Users and roles: not included")
+	}
+
+	if inspection.OplogCaptured {
+		fmt.Printf("Oplog captured during the dump: %d entries from %s to %s\n", inspection.OplogEntries, helpers.OplogTimestampString(inspection.OplogFirst), helpers.OplogTimestampString(inspection.OplogLast))
+	} else {
+		fmt.Println("Oplog captured during the dump: none")
+	}
+}
+
+func printOplogInspection(inspection *models.OplogInspection) {
+	fmt.Printf("Oplog backup: %s\n", inspection.Key)
+
+	if inspection.Entries == 0 {
+		fmt.Println("No oplog entries")
+		return
+	}
+
+	fmt.Printf("First entry: %s (%s)\n", helpers.OplogTimestampString(inspection.First), inspection.FirstTime.Format(helpers.HumanReadableTimeFormat))
+	fmt.Printf("Last entry: %s (%s)\n", helpers.OplogTimestampString(inspection.Last), inspection.LastTime.Format(helpers.HumanReadableTimeFormat))
+
+	counts := table.New().Headers("Namespace", "Operation", "Entries")
+
+	for _, count := range inspection.Counts {
+		counts = counts.Row(count.Namespace, count.Operation, fmt.Sprint(count.Count))
+	}
+
+	fmt.Println(counts)
+	fmt.Printf("%d entries\n", inspection.Entries)
+}
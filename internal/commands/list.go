@@ -2,94 +2,390 @@ package commands
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"path"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/charmbracelet/lipgloss/list"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/charmbracelet/lipgloss/table"
 	"github.com/ditkrg/mongodb-backup/internal/flags"
 	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
 	"github.com/ditkrg/mongodb-backup/internal/services"
 	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
 )
 
 type ListCommand struct {
 	S3          flags.S3Flags        `embed:"" group:"Common S3 Flags:"`
 	Verbosity   flags.VerbosityFlags `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
-	Oplog       bool                 `required:"" xor:"list" help:"List oplog backups"`
-	FullBackups bool                 `required:"" xor:"list" help:"List full backups"`
-	Database    string               `required:"" xor:"list" help:"List backups for a specific database"`
+	Oplog       bool                 `help:"Show every oplog backup rather than a summary of the oplog backups of each backup"`
+	FullBackups bool                 `xor:"list" help:"Only list the full backups"`
+	Database    string               `xor:"list" help:"Only list the backups of the databases matching this glob or /regex/ pattern"`
+	Class       string               `optional:"" enum:",scheduled,manual,pre-deploy" default:"" help:"Only list the backups of this class, scheduled, manual or pre-deploy"`
+	Since       string               `optional:"" help:"Only list what was taken after this, an age (7d), a day (2026-12-31) or a time (2026-12-31T18:00:00Z)"`
+	Until       string               `optional:"" help:"Only list what was taken before this, an age (7d), a day (2026-12-31) or a time (2026-12-31T18:00:00Z)"`
+	Output      string               `enum:"table,json,yaml" default:"table" help:"How the backups are printed, table, json or yaml (Default: table)"`
 }
 
 func (command *ListCommand) Run() error {
 
 	command.Verbosity.SetGlobalLogLevel()
 
-	var resp *s3.ListObjectsV2Output
-	var prefix string
-	var err error
-
 	ctx := context.Background()
 	s3Service := services.NewS3Service(command.S3)
+	now := time.Now()
 
-	if command.Oplog {
-		prefix = helpers.S3OplogPrefix(command.S3.Prefix)
-	} else if command.FullBackups {
-		prefix = helpers.S3BackupPrefix(command.S3.Prefix, "")
-	} else {
-		prefix = helpers.S3BackupPrefix(command.S3.Prefix, command.Database)
+	since, err := helpers.ParseTimeBound(command.Since, now, false)
+	if err != nil {
+		return err
 	}
 
-	if resp, err = s3Service.List(ctx, command.S3.Bucket, prefix); err != nil {
+	until, err := helpers.ParseTimeBound(command.Until, now, true)
+	if err != nil {
 		return err
 	}
 
-	if len(resp.Contents) == 0 {
-		message := "No backups found"
-		log.Info().Msg(message)
-		fmt.Println(message)
-		return nil
+	if command.Database != "" {
+		if err := helpers.ValidatePattern(command.Database); err != nil {
+			return err
+		}
+	}
+
+	// ######################
+	// Find the backup prefixes to list
+	// ######################
+	databases, err := listBackupDatabases(ctx, s3Service, command.S3)
+	if err != nil {
+		return err
 	}
 
-	list := list.New()
+	chains := make([]models.BackupChain, 0, len(databases))
 
-	for _, object := range resp.Contents {
-		key := *object.Key
-		if strings.Contains(key, helpers.ConfigFileName) {
+	for _, database := range databases {
+		if command.FullBackups && database != "" || command.Database != "" && (database == "" || !helpers.MatchPattern(command.Database, database)) {
 			continue
 		}
 
-		if command.Oplog {
-			list = list.Item(FormatOplogTime(key, command.S3.Prefix))
-		} else {
-			list = list.Item(key)
+		chain, err := getBackupChain(ctx, s3Service, command.S3, database, now)
+		if err != nil {
+			return err
 		}
+
+		chains = append(chains, filterBackupChain(chain, command.Class, since, until))
 	}
 
-	fmt.Println("List of Available Backups:")
-	fmt.Println(list)
+	// ######################
+	// Print the catalog
+	// ######################
+	switch command.Output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(chains)
+	case "yaml":
+		return yaml.NewEncoder(os.Stdout).Encode(chains)
+	default:
+		printBackupChains(chains, command.Oplog, now)
+		return nil
+	}
+}
 
-	return nil
+// listBackupDatabases returns the databases that have database backups, "" stands for the full backups and comes first
+func listBackupDatabases(ctx context.Context, s3Service *services.S3Service, s3Flags flags.S3Flags) ([]string, error) {
+	rootPrefix := ""
+	if s3Flags.Prefix != "" {
+		rootPrefix = s3Flags.Prefix + "/"
+	}
 
+	// only the directories right under the prefix are listed, not the backups and oplog backups in them
+	directories, err := s3Service.ListDirectories(ctx, s3Flags.Bucket, rootPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	databases := []string{""}
+
+	for _, directory := range directories {
+		if database := helpers.BackupKeyDatabase(s3Flags.Prefix, directory); database != "" && !slices.Contains(databases, database) {
+			databases = append(databases, database)
+		}
+	}
+
+	return databases, nil
 }
 
-func FormatOplogTime(key string, prefix string) string {
-	key = strings.TrimSuffix(key, ".tar.gz")
-	key = strings.TrimPrefix(key, helpers.S3OplogPrefix(prefix))
+// getBackupChain lists the backups of a prefix with the oplog backups between each of them and the next one
+func getBackupChain(ctx context.Context, s3Service *services.S3Service, s3Flags flags.S3Flags, database string, now time.Time) (models.BackupChain, error) {
+	chain := models.BackupChain{
+		Database:     database,
+		BackupPrefix: helpers.S3BackupPrefix(s3Flags.Prefix, database),
+		OplogPrefix:  helpers.S3OplogPrefix(s3Flags.Prefix, database),
+		Backups:      make([]models.CatalogBackup, 0),
+	}
 
-	fromString := strings.Split(key, "_")[0]
-	toString := strings.Split(key, "_")[1]
+	// ######################
+	// The backups, with the class, the note and the pin from their manifests
+	// ######################
+	backupObjects, err := s3Service.ListAll(ctx, s3Flags.Bucket, chain.BackupPrefix)
+	if err != nil {
+		return chain, err
+	}
 
-	fromTime, err := time.Parse(helpers.TimeFormat, fromString)
+	manifests, err := getBackupManifests(ctx, s3Service, s3Flags.Bucket, s3Flags.Prefix, chain.BackupPrefix)
 	if err != nil {
-		log.Panic().Err(err).Msg("Failed to parse time")
+		return chain, err
+	}
+
+	for _, obj := range backupObjects {
+		backupTime, err := helpers.BackupKeyTime(*obj.Key)
+		if err != nil {
+			log.Warn().Msgf("Skipping %s as it is not named after the time of a backup", *obj.Key)
+			continue
+		}
+
+		backup := models.CatalogBackup{
+			Key:          *obj.Key,
+			Time:         backupTime,
+			ConsistentAt: backupTime,
+			AgeSeconds:   int64(now.Sub(backupTime).Seconds()),
+			Size:         aws.ToInt64(obj.Size),
+			Class:        manifests[*obj.Key].BackupClass(),
+		}
+
+		if manifest := manifests[*obj.Key]; manifest != nil {
+			backup.Note = manifest.Note
+
+			if oplogTo := helpers.OplogTimestampTime(manifest.OplogTo); manifest.OplogCaptured && oplogTo.After(backupTime) {
+				backup.ConsistentAt = oplogTo
+			}
+
+			if manifest.Pin.IsActive(now) {
+				backup.Pin = manifest.Pin
+			}
+		}
+
+		chain.Backups = append(chain.Backups, backup)
 	}
 
-	toTime, err := time.Parse(helpers.TimeFormat, toString)
+	slices.SortFunc(chain.Backups, func(a, b models.CatalogBackup) int { return a.Time.Compare(b.Time) })
+
+	// ######################
+	// Every oplog backup extends the newest backup taken before it ends
+	// ######################
+	oplogObjects, err := s3Service.ListAll(ctx, s3Flags.Bucket, chain.OplogPrefix)
 	if err != nil {
-		log.Panic().Err(err).Msg("Failed to parse time")
+		return chain, err
+	}
+
+	segments := make([]models.CatalogOplogBackup, 0, len(oplogObjects))
+
+	for _, obj := range oplogObjects {
+		if *obj.Key == chain.OplogPrefix+helpers.ConfigFileName {
+			continue
+		}
+
+		if len(strings.Split(helpers.TrimOplogSegmentExtension(path.Base(*obj.Key)), "_")) != 2 {
+			log.Warn().Msgf("Skipping %s as it is not named after the times of an oplog backup", *obj.Key)
+			continue
+		}
+
+		oplogBackup := helpers.PrepareOplogBackup(*obj.Key)
+		segments = append(segments, models.CatalogOplogBackup{Key: *obj.Key, From: oplogBackup.FromTime, To: oplogBackup.ToTime, Size: aws.ToInt64(obj.Size)})
 	}
 
-	return fmt.Sprintf("%s ~ %s", fromTime.Format(helpers.HumanReadableTimeFormat), toTime.Format(helpers.HumanReadableTimeFormat))
+	slices.SortFunc(segments, func(a, b models.CatalogOplogBackup) int { return a.From.Compare(b.From) })
+
+	for i := range segments {
+		segments[i].GapBefore = i > 0 && segments[i].From.After(segments[i-1].To)
+
+		owner := -1
+		for j := range chain.Backups {
+			if chain.Backups[j].Time.Before(segments[i].To) {
+				owner = j
+			}
+		}
+
+		if owner < 0 {
+			chain.OrphanedOplog = append(chain.OrphanedOplog, segments[i])
+		} else {
+			chain.Backups[owner].Oplog = append(chain.Backups[owner].Oplog, segments[i])
+		}
+	}
+
+	chain.Windows = pointInTimeWindows(chain.Backups, segments)
+
+	return chain, nil
+}
+
+// pointInTimeWindows returns the continuous time ranges restores can reach, a range starts at a backup
+// and runs through the oplog backups that start before the end of its dump until the first gap
+func pointInTimeWindows(backups []models.CatalogBackup, segments []models.CatalogOplogBackup) []models.PointInTimeWindow {
+	windows := make([]models.PointInTimeWindow, 0)
+
+	var window *models.PointInTimeWindow
+	nextSegment := 0
+
+	for _, backup := range backups {
+		// a backup inside the current window only matters when the window ended before it
+		if window != nil && !backup.Time.After(window.To) {
+			continue
+		}
+
+		if window != nil {
+			windows = append(windows, *window)
+		}
+
+		window = &models.PointInTimeWindow{From: backup.Time, To: backup.ConsistentAt}
+
+		for nextSegment < len(segments) && !segments[nextSegment].To.After(backup.Time) {
+			nextSegment++
+		}
+
+		for nextSegment < len(segments) && !segments[nextSegment].From.After(window.To) {
+			window.To = segments[nextSegment].To
+			nextSegment++
+		}
+	}
+
+	if window != nil {
+		windows = append(windows, *window)
+	}
+
+	return windows
+}
+
+// filterBackupChain leaves out the backups of other classes and what was taken outside of the time range
+func filterBackupChain(chain models.BackupChain, class string, since time.Time, until time.Time) models.BackupChain {
+	isOutside := func(from time.Time, to time.Time) bool {
+		return (!since.IsZero() && to.Before(since)) || (!until.IsZero() && from.After(until))
+	}
+
+	chain.Backups = slices.DeleteFunc(chain.Backups, func(backup models.CatalogBackup) bool {
+		return (class != "" && backup.Class != class) || isOutside(backup.Time, backup.Time)
+	})
+
+	for i := range chain.Backups {
+		chain.Backups[i].Oplog = slices.DeleteFunc(chain.Backups[i].Oplog, func(segment models.CatalogOplogBackup) bool {
+			return isOutside(segment.From, segment.To)
+		})
+	}
+
+	chain.OrphanedOplog = slices.DeleteFunc(chain.OrphanedOplog, func(segment models.CatalogOplogBackup) bool {
+		return isOutside(segment.From, segment.To)
+	})
+
+	chain.Windows = slices.DeleteFunc(chain.Windows, func(window models.PointInTimeWindow) bool {
+		return isOutside(window.From, window.To)
+	})
+
+	return chain
+}
+
+func printBackupChains(chains []models.BackupChain, withOplog bool, now time.Time) {
+	for _, chain := range chains {
+		title := "Full backups"
+		if chain.Database != "" {
+			title = fmt.Sprintf("Backups of the %s database", chain.Database)
+		}
+
+		fmt.Printf("%s (%s)\n", title, chain.BackupPrefix)
+
+		if len(chain.Backups) == 0 && len(chain.OrphanedOplog) == 0 {
+			fmt.Println("No backups found")
+			fmt.Println()
+			continue
+		}
+
+		catalog := table.New().Headers("Key", "Class", "Size", "Age", "Note")
+
+		for _, backup := range chain.Backups {
+			note := backup.Note
+			if backup.Pin != nil {
+				note = strings.TrimSpace(note + " (" + pinReason(backup.Pin) + ")")
+			}
+
+			catalog = catalog.Row(backup.Key, backup.Class, helpers.FormatBytes(backup.Size), formatAge(now.Sub(backup.Time)), note)
+			catalog = addOplogRows(catalog, backup.Oplog, withOplog, now)
+		}
+
+		if len(chain.OrphanedOplog) > 0 {
+			catalog = catalog.Row("no backup", "", "", "", "oplog backups that end before the oldest backup")
+			catalog = addOplogRows(catalog, chain.OrphanedOplog, withOplog, now)
+		}
+
+		fmt.Println(catalog)
+
+		windows := make([]string, 0, len(chain.Windows))
+		for _, window := range chain.Windows {
+			windows = append(windows, fmt.Sprintf("%s ~ %s", window.From.Format(helpers.HumanReadableTimeFormat), window.To.Format(helpers.HumanReadableTimeFormat)))
+		}
+
+		if len(windows) == 0 {
+			windows = append(windows, "none")
+		}
+
+		fmt.Printf("Point-in-time restore windows: %s\n\n", strings.Join(windows, ", "))
+	}
+}
+
+// addOplogRows adds the oplog backups of a backup under it, one row each or a single summary row
+func addOplogRows(catalog *table.Table, segments []models.CatalogOplogBackup, withOplog bool, now time.Time) *table.Table {
+	if len(segments) == 0 {
+		return catalog
+	}
+
+	if withOplog {
+		for _, segment := range segments {
+			note := ""
+			if segment.GapBefore {
+				note = "gap before this oplog backup"
+			}
+
+			catalog = catalog.Row("  └ "+formatOplogRange(segment.From, segment.To), "oplog", helpers.FormatBytes(segment.Size), formatAge(now.Sub(segment.To)), note)
+		}
+
+		return catalog
+	}
+
+	var size int64
+	gaps := 0
+
+	for _, segment := range segments {
+		size += segment.Size
+
+		if segment.GapBefore {
+			gaps++
+		}
+	}
+
+	note := ""
+	if gaps > 0 {
+		note = fmt.Sprintf("%d gaps", gaps)
+	}
+
+	summary := fmt.Sprintf("  └ %d oplog backups, %s", len(segments), formatOplogRange(segments[0].From, segments[len(segments)-1].To))
+	return catalog.Row(summary, "oplog", helpers.FormatBytes(size), formatAge(now.Sub(segments[len(segments)-1].To)), note)
+}
+
+func formatOplogRange(from time.Time, to time.Time) string {
+	return fmt.Sprintf("%s ~ %s", from.Format(helpers.HumanReadableTimeFormat), to.Format(helpers.HumanReadableTimeFormat))
+}
+
+// formatAge formats how long ago something was taken, e.g. 3d 4h
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return "now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh %dm", int(age.Hours()), int(age.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dd %dh", int(age.Hours())/24, int(age.Hours())%24)
+	}
 }
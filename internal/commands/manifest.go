@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+func uploadBackupManifest(ctx context.Context, s3Service *services.S3Service, bucket string, prefix string, manifest *models.BackupManifest) error {
+	log.Info().Msgf("Uploading the manifest of %s", manifest.Key)
+
+	manifestByteArray, err := json.Marshal(manifest)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal the backup manifest")
+		return err
+	}
+
+	if _, err := s3Service.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(helpers.S3ManifestKey(prefix, manifest.Key)),
+		Body:   bytes.NewReader(manifestByteArray),
+	}); err != nil {
+		log.Error().Err(err).Msg("Failed to upload the backup manifest")
+		return err
+	}
+
+	return nil
+}
+
+func getBackupManifest(ctx context.Context, s3Service *services.S3Service, bucket string, prefix string, key string) (*models.BackupManifest, error) {
+	log.Info().Msgf("Getting the manifest of %s", key)
+
+	resp, err := s3Service.Get(ctx, bucket, helpers.S3ManifestKey(prefix, key))
+
+	if err != nil {
+		if services.IsNotFound(err) {
+			log.Info().Msgf("No manifest found for %s", key)
+			return nil, nil
+		}
+
+		log.Error().Err(err).Msg("Failed to get the backup manifest from S3")
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	var manifest models.BackupManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		log.Error().Err(err).Msg("Failed to decode the backup manifest")
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// getBackupManifests returns the manifests of the backups under a backup prefix by the key of their backup
+func getBackupManifests(ctx context.Context, s3Service *services.S3Service, bucket string, prefix string, backupPrefix string) (map[string]*models.BackupManifest, error) {
+	manifestObjects, err := s3Service.ListAll(ctx, bucket, strings.TrimSuffix(helpers.S3ManifestKey(prefix, backupPrefix), ".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make(map[string]*models.BackupManifest, len(manifestObjects))
+
+	for _, obj := range manifestObjects {
+		backupKey := strings.TrimSuffix(strings.TrimPrefix(*obj.Key, helpers.S3ManifestPrefix(prefix)), ".json")
+		if prefix != "" {
+			backupKey = prefix + "/" + backupKey
+		}
+
+		manifest, err := getBackupManifest(ctx, s3Service, bucket, prefix, backupKey)
+		if err != nil {
+			return nil, err
+		}
+
+		manifests[backupKey] = manifest
+	}
+
+	return manifests, nil
+}
@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errOplogChainBroken = errors.New("the oplog chain is broken")
+
+// getBrokenChainRestart restarts a broken oplog chain from the first full backup taken after it broke
+func getBrokenChainRestart(ctx context.Context, s3Service *services.S3Service, command *DumpCommand, previousOplogRunInfo *models.PreviousOplogRunInfo, backups []types.Object) (primitive.Timestamp, error) {
+	brokenAt, err := time.Parse(helpers.TimeFormat, previousOplogRunInfo.ChainBrokenAt)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to parse the time the oplog chain broke at")
+		return primitive.Timestamp{}, err
+	}
+
+	helpers.SortByKeyTimeStamp(backups, helpers.S3BackupPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database))
+
+	for _, backup := range backups {
+		backupTime, err := helpers.BackupKeyTime(*backup.Key)
+		if err != nil || !backupTime.After(brokenAt) {
+			continue
+		}
+
+		log.Info().Msgf("Restarting the broken oplog chain from the full backup %s", *backup.Key)
+		return getBackupOplogAnchor(ctx, s3Service, command, *backup.Key)
+	}
+
+	return previousOplogRunInfo.OplogTakenToTimestamp, errOplogChainBroken
+}
+
+// handleOplogGap marks the oplog chain as broken, then either fails or starts a new chain with a full backup
+func handleOplogGap(ctx context.Context, s3Service *services.S3Service, mongodbService *services.MongodbService, command *DumpCommand, previousOplogRunInfo *models.PreviousOplogRunInfo, gapFrom primitive.Timestamp, gapTo primitive.Timestamp) error {
+	oplogRunInfo := &models.PreviousOplogRunInfo{}
+	if previousOplogRunInfo != nil {
+		*oplogRunInfo = *previousOplogRunInfo
+	}
+
+	if !oplogRunInfo.ChainBroken {
+		oplogRunInfo.ChainBroken = true
+		oplogRunInfo.ChainBrokenAt = time.Now().UTC().Format(helpers.TimeFormat)
+		oplogRunInfo.GapFrom = gapFrom
+		oplogRunInfo.GapTo = gapTo
+
+		if err := uploadOplogConfig(ctx, s3Service, command, oplogRunInfo); err != nil {
+			return err
+		}
+	}
+
+	gapErr := fmt.Errorf("%w: the oplog no longer holds the entries between %s and %s, the changes in between are lost and restores cannot go past %s",
+		errOplogChainBroken,
+		helpers.OplogTimestampString(oplogRunInfo.GapFrom),
+		helpers.OplogTimestampString(oplogRunInfo.GapTo),
+		helpers.OplogTimestampTime(oplogRunInfo.GapFrom).Format(helpers.TimeFormat),
+	)
+
+	if command.Mongo.OutputOptions.OnOplogGap != "full-backup" {
+		log.Error().Err(gapErr).Msg("Take a new full backup or run the oplog dump with --on-oplog-gap=full-backup to start a new oplog chain")
+		return gapErr
+	}
+
+	log.Warn().Err(gapErr).Msg("Taking a new full backup to start a new oplog chain")
+
+	// ######################
+	// The oplog entries from before the full backup starts are also safe to replay on top of it
+	// ######################
+	anchor, err := mongodbService.LatestOplogTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	fullBackupCommand := *command
+	fullBackupCommand.Mongo.OutputOptions.OpLog = false
+
+	if err := startBackup(&fullBackupCommand); err != nil {
+		return err
+	}
+
+	anchorTime := helpers.OplogTimestampTime(anchor).Format(helpers.TimeFormat)
+
+	return uploadOplogConfig(ctx, s3Service, command, &models.PreviousOplogRunInfo{
+		OplogTakenFrom:          anchorTime,
+		OplogTakenTo:            anchorTime,
+		OplogTakenFromTimestamp: anchor,
+		OplogTakenToTimestamp:   anchor,
+	})
+}
+
+// reportOplogWindow records how far back the oplog reaches compared to how often oplog backups run
+func reportOplogWindow(oplogRunInfo *models.PreviousOplogRunInfo, oplogOldest primitive.Timestamp) {
+	oplogRunInfo.OplogWindowSeconds = int64(oplogRunInfo.OplogTakenToTimestamp.T) - int64(oplogOldest.T)
+	oplogRunInfo.BackupIntervalSeconds = int64(oplogRunInfo.OplogTakenToTimestamp.T) - int64(oplogRunInfo.OplogTakenFromTimestamp.T)
+
+	window := time.Duration(oplogRunInfo.OplogWindowSeconds) * time.Second
+	interval := time.Duration(oplogRunInfo.BackupIntervalSeconds) * time.Second
+
+	if interval > window/2 {
+		log.Warn().Msgf("The oplog window is %s while this oplog backup covers %s, run oplog backups more often or grow the oplog", window, interval)
+		return
+	}
+
+	log.Info().Msgf("The oplog window is %s, this oplog backup covers %s", window, interval)
+}
@@ -0,0 +1,239 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/lipgloss/table"
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// the most characters of an oplog entry printed in the table
+const maxPrintedOplogEntryLength = 120
+
+type OplogCommand struct {
+	Search OplogSearchCommand `cmd:"" name:"search" help:"Search the oplog backups for the entries of a namespace, an operation or a document"`
+}
+
+type OplogSearchCommand struct {
+	S3        flags.S3Flags        `embed:"" group:"Common S3 Flags:"`
+	Verbosity flags.VerbosityFlags `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
+	Database  string               `help:"Search the oplog backups of the backups of this database rather than those of the full backups"`
+	Since     string               `optional:"" help:"Only search the entries after this, an age (7d), a day (2026-12-31) or a time (2026-12-31T18:00:00Z)"`
+	Until     string               `optional:"" help:"Only search the entries before this, an age (7d), a day (2026-12-31) or a time (2026-12-31T18:00:00Z)"`
+	Namespace []string             `help:"Only match the entries of the namespaces matching these glob or /regex/ patterns, commands are matched by the namespace they act on"`
+	Op        []string             `help:"Only match the entries of these operations, insert, update, delete, command or noop"`
+	ID        string               `name:"id" help:"Only match the inserts, updates and deletes of the document with this _id, written in extended JSON"`
+	Match     string               `help:"Only match the entries whose o or o2 holds these values, an extended JSON document of field paths and values"`
+	Limit     int                  `default:"100" help:"The most matching entries printed, 0 prints all of them (Default: 100)"`
+	Output    string               `enum:"table,json" default:"table" help:"How the entries are printed, table or json (Default: table)"`
+}
+
+func (command *OplogSearchCommand) Run() error {
+	command.Verbosity.SetGlobalLogLevel()
+
+	ctx := context.Background()
+	s3Service := services.NewS3Service(command.S3)
+	now := time.Now()
+
+	since, err := helpers.ParseTimeBound(command.Since, now, false)
+	if err != nil {
+		return err
+	}
+
+	until, err := helpers.ParseTimeBound(command.Until, now, true)
+	if err != nil {
+		return err
+	}
+
+	filter, err := helpers.NewOplogSearchFilter(command.Namespace, command.Op, command.ID, command.Match)
+	if err != nil {
+		return err
+	}
+
+	// ######################
+	// Find the oplog backups that overlap the time range
+	// ######################
+	result := &models.OplogSearchResult{
+		OplogPrefix: helpers.S3OplogPrefix(command.S3.Prefix, command.Database),
+		Searched:    make([]string, 0),
+		Entries:     make([]models.OplogSearchMatch, 0),
+	}
+
+	segments, err := listOplogSearchSegments(ctx, s3Service, command.S3.Bucket, result.OplogPrefix, since, until)
+	if err != nil {
+		return err
+	}
+
+	if len(segments) == 0 {
+		log.Info().Msgf("No oplog backups found under %s in the time range", result.OplogPrefix)
+	}
+
+	// ######################
+	// Stream every oplog backup from S3 and match its entries, a new oplog chain starts at the start of
+	// its backup and overlaps the previous one, the entries found in both are only counted once
+	// ######################
+	matchedEntries := make(map[primitive.Timestamp]bool)
+
+	for _, segment := range segments {
+		log.Info().Msgf("Searching %s", segment.Key)
+
+		if err := searchOplogSegment(ctx, s3Service, command.S3.Bucket, segment.Key, filter, since, until, command.Limit, matchedEntries, result); err != nil {
+			return err
+		}
+
+		result.Searched = append(result.Searched, segment.Key)
+	}
+
+	// ######################
+	// Suggest restoring up to just before the first destructive entry
+	// ######################
+	if result.FirstDestructive != nil {
+		result.RestoreTarget = &models.OplogRestoreTarget{OplogLimit: helpers.OplogTimestampString(result.FirstDestructive.Timestamp)}
+	}
+
+	if command.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	printOplogSearchResult(result, command.Limit)
+	return nil
+}
+
+func listOplogSearchSegments(ctx context.Context, s3Service *services.S3Service, bucket string, oplogPrefix string, since time.Time, until time.Time) ([]models.OplogBackup, error) {
+	objects, err := s3Service.ListAll(ctx, bucket, oplogPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]models.OplogBackup, 0, len(objects))
+
+	for _, obj := range objects {
+		if !helpers.IsOplogBackupKey(*obj.Key) {
+			continue
+		}
+
+		segment := helpers.PrepareOplogBackup(*obj.Key)
+
+		if !since.IsZero() && !segment.ToTime.After(since) || !until.IsZero() && !segment.FromTime.Before(until) {
+			continue
+		}
+
+		segments = append(segments, segment)
+	}
+
+	slices.SortFunc(segments, func(a, b models.OplogBackup) int {
+		return a.FromTime.Compare(b.FromTime)
+	})
+
+	return segments, nil
+}
+
+func searchOplogSegment(ctx context.Context, s3Service *services.S3Service, bucket string, key string, filter *helpers.OplogSearchFilter, since time.Time, until time.Time, limit int, matchedEntries map[primitive.Timestamp]bool, result *models.OplogSearchResult) error {
+	obj, err := s3Service.Get(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+
+	defer obj.Body.Close()
+
+	err = helpers.ForEachOplogEntryIn(obj.Body, key, func(entry bson.Raw) error {
+		t, i := entry.Lookup("ts").Timestamp()
+		ts := primitive.Timestamp{T: t, I: i}
+		entryTime := helpers.OplogTimestampTime(ts)
+
+		if !since.IsZero() && entryTime.Before(since) || !until.IsZero() && !entryTime.Before(until) || matchedEntries[ts] {
+			return nil
+		}
+
+		matches, err := filter.Search(key, entry)
+		if err != nil {
+			return err
+		}
+
+		if len(matches) > 0 {
+			matchedEntries[ts] = true
+		}
+
+		for _, match := range matches {
+			result.Matched++
+
+			if limit == 0 || len(result.Entries) < limit {
+				result.Entries = append(result.Entries, match)
+			}
+
+			if match.Destructive && (result.FirstDestructive == nil || match.Timestamp.Before(result.FirstDestructive.Timestamp)) {
+				result.FirstDestructive = &match
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to search %s", key)
+		return err
+	}
+
+	return nil
+}
+
+func printOplogSearchResult(result *models.OplogSearchResult, limit int) {
+	entries := table.New().Headers("Timestamp", "Wall Time", "Namespace", "Operation", "_id", "Entry")
+
+	for _, entry := range result.Entries {
+		entries = entries.Row(
+			helpers.OplogTimestampString(entry.Timestamp),
+			entry.WallTime.Format(helpers.HumanReadableTimeFormat),
+			entry.Namespace,
+			describeOplogOperation(entry),
+			string(entry.ID),
+			truncateOplogEntry(string(entry.Object)),
+		)
+	}
+
+	fmt.Println(entries)
+	fmt.Printf("%d entries matched in %d oplog backups\n", result.Matched, len(result.Searched))
+
+	if limit > 0 && result.Matched > int64(limit) {
+		fmt.Printf("Only the first %d entries are printed, use --limit=0 to print all of them\n", limit)
+	}
+
+	if result.FirstDestructive == nil {
+		return
+	}
+
+	first := result.FirstDestructive
+
+	fmt.Println()
+	fmt.Printf("The first destructive entry is the %s of %s at %s (%s)\n", describeOplogOperation(*first), first.Namespace, helpers.OplogTimestampString(first.Timestamp), first.WallTime.Format(helpers.HumanReadableTimeFormat))
+	fmt.Printf("To restore up to just before it: restore --oplog-limit=%s\n", result.RestoreTarget.OplogLimit)
+}
+
+func describeOplogOperation(entry models.OplogSearchMatch) string {
+	if entry.Command != "" {
+		return entry.Command
+	}
+
+	return entry.Operation
+}
+
+func truncateOplogEntry(entry string) string {
+	if len(entry) <= maxPrintedOplogEntryLength {
+		return entry
+	}
+
+	return entry[:maxPrintedOplogEntryLength] + "..."
+}
@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type oplogSegment struct {
+	from     primitive.Timestamp
+	to       primitive.Timestamp
+	openedAt time.Time
+	size     int64
+	dir      string
+	file     *os.File
+}
+
+// createOplogSegment writes oplog entries in the same layout mongodump writes the oplog collection,
+// the entries are not gzipped as the whole segment is compressed when it is uploaded
+func createOplogSegment(dir string, from primitive.Timestamp) (*oplogSegment, error) {
+	segment := &oplogSegment{
+		from:     from,
+		to:       from,
+		openedAt: time.Now(),
+		dir:      dir,
+	}
+
+	if err := os.MkdirAll(segment.dir, 0755); err != nil {
+		log.Error().Err(err).Msgf("Failed to create %s", segment.dir)
+		return nil, err
+	}
+
+	file, err := os.Create(filepath.Join(segment.dir, "oplog.rs.bson"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create oplog.rs.bson")
+		return nil, err
+	}
+
+	segment.file = file
+	return segment, nil
+}
+
+func (segment *oplogSegment) write(entry bson.Raw, ts primitive.Timestamp) error {
+	if _, err := segment.file.Write(entry); err != nil {
+		log.Error().Err(err).Msg("Failed to write the oplog entry to the segment")
+		return err
+	}
+
+	segment.to = ts
+	segment.size += int64(len(entry))
+	return nil
+}
+
+func (segment *oplogSegment) close() error {
+	return segment.file.Close()
+}
+
+// uploadOplogSegment streams the tar of the dumped oplog directory through the compression straight into S3
+func uploadOplogSegment(ctx context.Context, s3Service *services.S3Service, bucket string, key string, dir string, codec string, level int, metadata map[string]string) error {
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		compressionWriter, err := helpers.NewCompressionWriter(pipeWriter, codec, level)
+		if err != nil {
+			pipeWriter.CloseWithError(err)
+			return
+		}
+
+		if err := helpers.TarDirectory(dir, compressionWriter); err != nil {
+			pipeWriter.CloseWithError(err)
+			return
+		}
+
+		pipeWriter.CloseWithError(compressionWriter.Close())
+	}()
+
+	err := s3Service.UploadStream(ctx, bucket, key, pipeReader, metadata)
+
+	// unblock the tar writer if the upload stopped reading
+	pipeReader.CloseWithError(err)
+
+	return err
+}
@@ -0,0 +1,238 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const oplogStreamAwaitTime = time.Second
+
+type OplogStreamCommand struct {
+	SegmentMaxSize int64                `env:"OPLOG_STREAM__SEGMENT_MAX_SIZE" default:"67108864" help:"Cut the current segment once it holds this many bytes of oplog entries (Default: 64MiB)"`
+	SegmentMaxAge  time.Duration        `env:"OPLOG_STREAM__SEGMENT_MAX_AGE" default:"5m" help:"Cut the current segment once it has been open this long (Default: 5m)"`
+	S3             flags.S3Flags        `embed:"" group:"Common S3 Flags:"`
+	Mongo          flags.MongoDumpFlags `embed:"" envprefix:"MONGO_DUMP__" group:"Common Mongo Dump Flags:"`
+	Verbosity      flags.VerbosityFlags `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
+}
+
+func (command OplogStreamCommand) Run() error {
+	command.Verbosity.SetGlobalLogLevel()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the oplog config, gap handling and retention are shared with dump --oplog
+	dumpCommand := &DumpCommand{S3: command.S3, Mongo: command.Mongo, Verbosity: command.Verbosity}
+	dumpCommand.Mongo.OutputOptions.OpLog = true
+
+	s3Service := services.NewS3Service(command.S3)
+
+	mongodbService, err := services.NewMongodbService(command.Mongo.ConnectionString, ctx)
+	if err != nil {
+		return err
+	}
+
+	// ######################
+	// Resume right after the last entry that was uploaded
+	// ######################
+	from, err := getOplogStreamResumeTimestamp(ctx, s3Service, mongodbService, dumpCommand)
+	if err != nil {
+		return err
+	}
+
+	return command.stream(ctx, s3Service, mongodbService, dumpCommand, from)
+}
+
+func getOplogStreamResumeTimestamp(ctx context.Context, s3Service *services.S3Service, mongodbService *services.MongodbService, dumpCommand *DumpCommand) (primitive.Timestamp, error) {
+	for {
+		bucketObjects, err := s3Service.List(ctx, dumpCommand.S3.Bucket, helpers.S3BackupPrefix(dumpCommand.S3.Prefix, dumpCommand.Mongo.NamespaceOptions.Database))
+		if err != nil {
+			return primitive.Timestamp{}, err
+		}
+
+		if len(bucketObjects.Contents) == 0 {
+			err := fmt.Errorf("no backups found in %s/%s, there must be a full backup before streaming the oplog", dumpCommand.S3.Bucket, helpers.S3BackupPrefix(dumpCommand.S3.Prefix, dumpCommand.Mongo.NamespaceOptions.Database))
+			log.Error().Err(err).Send()
+			return primitive.Timestamp{}, err
+		}
+
+		previousOplogRunInfo, err := getPreviousOplogRunData(ctx, s3Service, dumpCommand)
+		if err != nil {
+			return primitive.Timestamp{}, err
+		}
+
+		from, err := getOplogRunStart(ctx, s3Service, dumpCommand, previousOplogRunInfo, bucketObjects.Contents)
+		gapTo := primitive.Timestamp{}
+
+		switch {
+		case errors.Is(err, errOplogChainBroken):
+		case err != nil:
+			return primitive.Timestamp{}, err
+		default:
+			if gapTo, err = mongodbService.OldestOplogTimestamp(ctx); err != nil {
+				return primitive.Timestamp{}, err
+			}
+
+			if !gapTo.After(from) {
+				return from, nil
+			}
+		}
+
+		// a new full backup restarts the chain, so the resume point is read again
+		if err := handleOplogGap(ctx, s3Service, mongodbService, dumpCommand, previousOplogRunInfo, from, gapTo); err != nil {
+			return primitive.Timestamp{}, err
+		}
+	}
+}
+
+func (command *OplogStreamCommand) stream(ctx context.Context, s3Service *services.S3Service, mongodbService *services.MongodbService, dumpCommand *DumpCommand, from primitive.Timestamp) error {
+	cursor, err := mongodbService.TailOplog(ctx, from, dumpCommand.Mongo.NamespaceOptions.Database, oplogStreamAwaitTime)
+	if err != nil {
+		return err
+	}
+
+	defer cursor.Close(context.Background())
+
+	var segment *oplogSegment
+
+	for {
+		if cursor.TryNext(ctx) {
+
+			// ######################
+			// Append the entry to the open segment
+			// ######################
+			if segment == nil {
+				if segment, err = command.openSegment(from); err != nil {
+					return err
+				}
+			}
+
+			t, i := cursor.Current.Lookup("ts").Timestamp()
+			entry := cursor.Current
+
+			// a transaction is returned as a whole when any of its operations touches the database
+			if database := dumpCommand.Mongo.NamespaceOptions.Database; database != "" {
+				var keep bool
+				if entry, keep, err = helpers.FilterTransactionOperations(entry, helpers.IsDatabaseNamespace(database)); err != nil {
+					log.Error().Err(err).Msgf("Failed to filter the transaction at %d:%d", t, i)
+					return err
+				}
+
+				if !keep {
+					continue
+				}
+			}
+
+			if err := segment.write(entry, primitive.Timestamp{T: t, I: i}); err != nil {
+				return err
+			}
+		} else if cursor.ID() == 0 || cursor.Err() != nil {
+
+			// ######################
+			// Upload what was streamed so far before stopping
+			// ######################
+			if segment != nil {
+				if err := cutOplogSegment(context.Background(), s3Service, mongodbService, dumpCommand, segment); err != nil {
+					return err
+				}
+			}
+
+			if ctx.Err() != nil {
+				log.Info().Msg("Oplog stream stopped")
+				return nil
+			}
+
+			err := cursor.Err()
+			if err == nil {
+				err = errors.New("the oplog cursor was closed by the server")
+			}
+
+			log.Error().Err(err).Msg("Oplog stream interrupted, restart it to resume from the last uploaded segment")
+			return err
+		}
+
+		// ######################
+		// Cut the segment once it is big or old enough
+		// ######################
+		if segment != nil && command.shouldCut(segment) {
+			if err := cutOplogSegment(ctx, s3Service, mongodbService, dumpCommand, segment); err != nil {
+				return err
+			}
+
+			from = segment.to
+			segment = nil
+		}
+	}
+}
+
+// segments are named after the second of their boundaries, a segment is only cut once
+// it ends in a later second than it starts so two segments never share a key
+func (command *OplogStreamCommand) shouldCut(segment *oplogSegment) bool {
+	if segment.to.T <= segment.from.T {
+		return false
+	}
+
+	return segment.size >= command.SegmentMaxSize || time.Since(segment.openedAt) >= command.SegmentMaxAge
+}
+
+func (command *OplogStreamCommand) openSegment(from primitive.Timestamp) (*oplogSegment, error) {
+	return createOplogSegment(strings.TrimSuffix(command.Mongo.BackupDir, "/")+"/local/", from)
+}
+
+func cutOplogSegment(ctx context.Context, s3Service *services.S3Service, mongodbService *services.MongodbService, dumpCommand *DumpCommand, segment *oplogSegment) error {
+	if err := segment.close(); err != nil {
+		return err
+	}
+
+	oplogRunInfo := &models.PreviousOplogRunInfo{
+		OplogTakenFrom:          helpers.OplogTimestampTime(segment.from).Format(helpers.TimeFormat),
+		OplogTakenTo:            helpers.OplogTimestampTime(segment.to).Format(helpers.TimeFormat),
+		OplogTakenFromTimestamp: segment.from,
+		OplogTakenToTimestamp:   segment.to,
+	}
+
+	log.Info().Msgf("Cutting oplog segment %s ~ %s with %d bytes", helpers.OplogTimestampString(segment.from), helpers.OplogTimestampString(segment.to), segment.size)
+
+	// ######################
+	// Tar and upload the segment
+	// ######################
+	segmentKey := helpers.S3OplogPrefix(dumpCommand.S3.Prefix, dumpCommand.Mongo.NamespaceOptions.Database) + oplogRunInfo.OplogTakenFrom + "_" + oplogRunInfo.OplogTakenTo + helpers.OplogSegmentExtension(dumpCommand.Mongo.OutputOptions.OplogCompression)
+
+	if err := uploadOplogSegment(ctx, s3Service, dumpCommand.S3.Bucket, segmentKey, segment.dir, dumpCommand.Mongo.OutputOptions.OplogCompression, dumpCommand.Mongo.OutputOptions.OplogCompressionLevel, map[string]string{
+		helpers.OplogFromMetadataKey: helpers.OplogTimestampString(segment.from),
+		helpers.OplogToMetadataKey:   helpers.OplogTimestampString(segment.to),
+	}); err != nil {
+		return err
+	}
+
+	os.RemoveAll(segment.dir)
+
+	// ######################
+	// Persist the resume point
+	// ######################
+	oplogOldest, err := mongodbService.OldestOplogTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	reportOplogWindow(oplogRunInfo, oplogOldest)
+
+	if err := uploadOplogConfig(ctx, s3Service, dumpCommand, oplogRunInfo); err != nil {
+		return err
+	}
+
+	return applyRetention(ctx, s3Service, dumpCommand, false)
+}
@@ -0,0 +1,141 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+type PinCommand struct {
+	Key       string               `arg:"" help:"The key of the backup to pin, or the sharded_backup.json of a sharded backup"`
+	Until     string               `required:"" env:"PIN__UNTIL" help:"Keep the backup until this date, e.g. 2026-12-31 (the end of that day in UTC) or 2026-12-31T18:00:00Z"`
+	Reason    string               `required:"" env:"PIN__REASON" help:"Why the backup is pinned"`
+	S3        flags.S3Flags        `embed:"" group:"S3 Flags:"`
+	Verbosity flags.VerbosityFlags `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
+}
+
+type UnpinCommand struct {
+	Key       string               `arg:"" help:"The key of the pinned backup"`
+	S3        flags.S3Flags        `embed:"" group:"S3 Flags:"`
+	Verbosity flags.VerbosityFlags `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
+}
+
+func (command PinCommand) Run() error {
+	command.Verbosity.SetGlobalLogLevel()
+
+	ctx := context.Background()
+	s3Service := services.NewS3Service(command.S3)
+
+	until, err := helpers.ParseDate(command.Until)
+	if err != nil {
+		return err
+	}
+
+	if !until.After(time.Now()) {
+		err := fmt.Errorf("the pin of %s would expire at %s, which has already passed", command.Key, until.Format(helpers.TimeFormat))
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	manifest, err := getPinnableBackupManifest(ctx, s3Service, command.S3, command.Key)
+	if err != nil {
+		return err
+	}
+
+	manifest.Pin = &models.BackupPin{
+		Until:    until.UTC(),
+		Reason:   command.Reason,
+		PinnedAt: time.Now().UTC(),
+	}
+
+	if err := uploadBackupManifest(ctx, s3Service, command.S3.Bucket, command.S3.Prefix, manifest); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Pinned %s until %s: %s", command.Key, manifest.Pin.Until.Format(helpers.HumanReadableTimeFormat), manifest.Pin.Reason)
+	return nil
+}
+
+func (command UnpinCommand) Run() error {
+	command.Verbosity.SetGlobalLogLevel()
+
+	ctx := context.Background()
+	s3Service := services.NewS3Service(command.S3)
+
+	manifest, err := getBackupManifest(ctx, s3Service, command.S3.Bucket, command.S3.Prefix, command.Key)
+	if err != nil {
+		return err
+	}
+
+	if manifest == nil || manifest.Pin == nil {
+		log.Info().Msgf("%s is not pinned", command.Key)
+		return nil
+	}
+
+	manifest.Pin = nil
+
+	if err := uploadBackupManifest(ctx, s3Service, command.S3.Bucket, command.S3.Prefix, manifest); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Unpinned %s, retention applies to it again", command.Key)
+	return nil
+}
+
+// getPinnableBackupManifest returns the manifest of a backup that can be pinned, backups taken before manifests get an empty one
+func getPinnableBackupManifest(ctx context.Context, s3Service *services.S3Service, s3Flags flags.S3Flags, key string) (*models.BackupManifest, error) {
+	backupTime, err := helpers.BackupKeyTime(key)
+	isShardedBackup := strings.HasPrefix(key, helpers.S3ShardedBackupPrefix(s3Flags.Prefix)) && strings.HasSuffix(key, "/"+helpers.ShardedBackupFileName)
+
+	if err != nil && !isShardedBackup {
+		err := fmt.Errorf("%s is not a backup, only full, database and sharded backups can be pinned", key)
+		log.Error().Err(err).Send()
+		return nil, err
+	}
+
+	if _, err := s3Service.Head(ctx, s3Flags.Bucket, key); err != nil {
+		if services.IsNotFound(err) {
+			err = errors.New("there is no backup " + key)
+			log.Error().Err(err).Send()
+		}
+
+		return nil, err
+	}
+
+	manifest, err := getBackupManifest(ctx, s3Service, s3Flags.Bucket, s3Flags.Prefix, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest == nil {
+		manifest = &models.BackupManifest{Key: key}
+
+		if !isShardedBackup {
+			manifest.CreatedAt = backupTime.Format(helpers.TimeFormat)
+		}
+	}
+
+	return manifest, nil
+}
+
+// getActivePin returns the pin of a backup that has not expired yet, if any
+func getActivePin(ctx context.Context, s3Service *services.S3Service, bucket string, prefix string, key string, now time.Time) (*models.BackupPin, error) {
+	manifest, err := getBackupManifest(ctx, s3Service, bucket, prefix, key)
+	if err != nil || manifest == nil || !manifest.Pin.IsActive(now) {
+		return nil, err
+	}
+
+	return manifest.Pin, nil
+}
+
+func pinReason(pin *models.BackupPin) string {
+	return fmt.Sprintf("pinned until %s: %s", pin.Until.Format(helpers.HumanReadableTimeFormat), pin.Reason)
+}
@@ -0,0 +1,198 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+var snapshotSkippedDatabases = []string{"admin", "config", "local"}
+
+func (command *DatabaseRestoreCommand) takePreRestoreSnapshot(ctx context.Context, s3Service *services.S3Service, mongodbService *services.MongodbService, archivePath string) error {
+	snapshotId := time.Now().UTC().Format(helpers.TimeFormat)
+	snapshotPrefix := helpers.S3PreRestorePrefix(command.S3.Prefix) + snapshotId + "/"
+
+	log.Info().Msgf("Taking pre-restore snapshot %s", snapshotId)
+
+	// ######################
+	// Find the namespaces in the backup that will be restored
+	// ######################
+	prelude, err := helpers.ReadArchivePrelude(archivePath)
+	if err != nil {
+		return err
+	}
+
+	isRestored, err := command.Mongo.NamespaceMatcher()
+	if err != nil {
+		return err
+	}
+
+	namespacesByDatabase := make(map[string][]string)
+
+	for _, metadata := range prelude.NamespaceMetadatas {
+		if metadata.Database == "" || slices.Contains(snapshotSkippedDatabases, metadata.Database) || strings.HasPrefix(metadata.Collection, "system.") {
+			continue
+		}
+
+		if !isRestored(metadata.Database + "." + metadata.Collection) {
+			continue
+		}
+
+		namespacesByDatabase[metadata.Database] = append(namespacesByDatabase[metadata.Database], metadata.Collection)
+	}
+
+	databases := make([]string, 0, len(namespacesByDatabase))
+	for database := range namespacesByDatabase {
+		databases = append(databases, database)
+	}
+	sort.Strings(databases)
+
+	snapshot := models.PreRestoreSnapshot{
+		Id:          snapshotId,
+		RestoredKey: command.Key,
+		CreatedAt:   snapshotId,
+		Namespaces:  make([]string, 0),
+		Archives:    make([]string, 0),
+	}
+
+	if snapshot.ExistingNamespaces, err = listSnapshotNamespaces(ctx, mongodbService); err != nil {
+		return err
+	}
+
+	for _, database := range databases {
+
+		// ######################
+		// Only snapshot the collections that exist on the target
+		// ######################
+		existingCollections, err := mongodbService.ListCollectionNames(ctx, database)
+		if err != nil {
+			return err
+		}
+
+		excludedCollections := make([]string, 0)
+		snapshotCollections := make([]string, 0)
+
+		for _, collection := range existingCollections {
+			if slices.Contains(namespacesByDatabase[database], collection) {
+				snapshotCollections = append(snapshotCollections, collection)
+			} else {
+				excludedCollections = append(excludedCollections, collection)
+			}
+		}
+
+		if len(snapshotCollections) == 0 {
+			log.Info().Msgf("Skipping database %s as none of its restored collections exist on the target", database)
+			continue
+		}
+
+		// ######################
+		// Dump the database
+		// ######################
+		dumpFlags := flags.MongoDumpFlags{
+			ConnectionString: command.Mongo.ConnectionString,
+			BackupDir:        command.Mongo.BackupDir,
+		}
+		dumpFlags.NamespaceOptions.Database = database
+		dumpFlags.OutputOptions.Compression = helpers.CompressionGzip
+		dumpFlags.OutputOptions.SkipUsersAndRoles = true
+		dumpFlags.OutputOptions.ExcludedCollections = excludedCollections
+		dumpFlags.OutputOptions.NumParallelCollections = 1
+
+		mongoDump, err := dumpFlags.PrepareMongoDump()
+		if err != nil {
+			return err
+		}
+
+		if err := mongoDump.Init(); err != nil {
+			log.Error().Err(err).Msgf("Error initializing snapshot dump of %s", database)
+			return err
+		}
+
+		archivePath, err := dumpArchive(mongoDump, dumpFlags.BackupDir, dumpFlags.OutputOptions.Compression, dumpFlags.OutputOptions.CompressionLevel, nil)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error taking snapshot dump of %s", database)
+			return err
+		}
+
+		// ######################
+		// Upload the snapshot to S3
+		// ######################
+		archiveKey := snapshotPrefix + database + helpers.ArchiveExtension(dumpFlags.OutputOptions.Compression)
+
+		if err := s3Service.UploadFile(ctx, command.S3.Bucket, archiveKey, archivePath); err != nil {
+			return err
+		}
+
+		os.Remove(archivePath)
+
+		for _, collection := range snapshotCollections {
+			snapshot.Namespaces = append(snapshot.Namespaces, database+"."+collection)
+		}
+		snapshot.Archives = append(snapshot.Archives, archiveKey)
+	}
+
+	// ######################
+	// Upload the snapshot info
+	// ######################
+	snapshotByteArray, err := json.Marshal(&snapshot)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal the snapshot info")
+		return err
+	}
+
+	if _, err := s3Service.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(command.S3.Bucket),
+		Key:    aws.String(snapshotPrefix + helpers.SnapshotFileName),
+		Body:   bytes.NewReader(snapshotByteArray),
+	}); err != nil {
+		log.Error().Err(err).Msg("Failed to upload the snapshot info")
+		return err
+	}
+
+	log.Info().Msgf("Pre-restore snapshot %s taken with %d namespaces, to roll back run: rollback --snapshot=%s", snapshotId, len(snapshot.Namespaces), snapshotId)
+	return nil
+}
+
+// listSnapshotNamespaces returns the namespaces on the target a snapshot covers, every collection
+// outside of the admin, config and local databases that is not a system collection
+func listSnapshotNamespaces(ctx context.Context, mongodbService *services.MongodbService) ([]string, error) {
+	databases, err := mongodbService.ListDatabaseNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := make([]string, 0)
+
+	for _, database := range databases {
+		if slices.Contains(snapshotSkippedDatabases, database) {
+			continue
+		}
+
+		collections, err := mongodbService.ListCollectionNames(ctx, database)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, collection := range collections {
+			if !strings.HasPrefix(collection, "system.") {
+				namespaces = append(namespaces, database+"."+collection)
+			}
+		}
+	}
+
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
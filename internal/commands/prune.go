@@ -0,0 +1,115 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/lipgloss/table"
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+type PruneCommand struct {
+	Database       string                    `env:"PRUNE__DATABASE" xor:"scope" help:"Only prune the backups of this database and their oplog chain"`
+	FullBackups    bool                      `env:"PRUNE__FULL_BACKUPS" xor:"scope" help:"Only prune the full backups and their oplog chain"`
+	DryRun         bool                      `env:"PRUNE__DRY_RUN" help:"Only print what would be deleted and why"`
+	Retention      flags.RetentionFlags      `embed:"" envprefix:"MONGO_DUMP__" group:"retention options"`
+	ClassRetention flags.ClassRetentionFlags `embed:"" envprefix:"MONGO_DUMP__"`
+	S3             flags.S3Flags             `embed:"" group:"S3 Flags:"`
+	Verbosity      flags.VerbosityFlags      `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
+}
+
+func (command PruneCommand) Run() error {
+	command.Verbosity.SetGlobalLogLevel()
+
+	ctx := context.Background()
+	s3Service := services.NewS3Service(command.S3)
+
+	// ######################
+	// Find the backup prefixes to prune
+	// ######################
+	databases, err := command.databasesToPrune(ctx, s3Service)
+	if err != nil {
+		return err
+	}
+
+	// ######################
+	// Plan the deletions of every prefix with the same clock
+	// ######################
+	now := time.Now()
+	deletions := make([]models.RetentionDecision, 0)
+
+	for _, database := range databases {
+		plan, err := planRetention(ctx, s3Service, command.S3.Bucket, command.S3.Prefix, database, command.Retention, command.ClassRetention, true, now)
+		if err != nil {
+			return err
+		}
+
+		kept := len(slices.DeleteFunc(slices.Clone(plan.Backups), func(decision models.RetentionDecision) bool { return !decision.Keep }))
+		log.Info().Msgf("%s: keeping %d of %d backups", plan.BackupPrefix, kept, len(plan.Backups))
+
+		deletions = append(deletions, plan.deletions(command.S3.Prefix, true)...)
+	}
+
+	printRetentionReport(deletions, command.DryRun)
+
+	if command.DryRun || len(deletions) == 0 {
+		return nil
+	}
+
+	if err := deleteRetentionDecisions(ctx, s3Service, command.S3.Bucket, deletions); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Pruned %d objects, reclaimed %s", len(deletions), helpers.FormatBytes(retentionDecisionsSize(deletions)))
+	return nil
+}
+
+// databasesToPrune returns the databases whose backups are pruned, "" stands for the full backups
+func (command *PruneCommand) databasesToPrune(ctx context.Context, s3Service *services.S3Service) ([]string, error) {
+	switch {
+	case command.Database != "":
+		return []string{command.Database}, nil
+	case command.FullBackups:
+		return []string{""}, nil
+	}
+
+	return listBackupDatabases(ctx, s3Service, command.S3)
+}
+
+func retentionDecisionsSize(decisions []models.RetentionDecision) int64 {
+	var size int64
+	for _, decision := range decisions {
+		size += decision.Size
+	}
+
+	return size
+}
+
+func printRetentionReport(deletions []models.RetentionDecision, dryRun bool) {
+	title := "Retention Report:"
+	if dryRun {
+		title = "Retention Report (dry run, nothing is deleted):"
+	}
+
+	fmt.Println(title)
+
+	if len(deletions) == 0 {
+		fmt.Println("Nothing to delete")
+		return
+	}
+
+	report := table.New().Headers("Key", "Size", "Reason")
+
+	for _, deletion := range deletions {
+		report = report.Row(deletion.Key, helpers.FormatBytes(deletion.Size), deletion.Reason)
+	}
+
+	fmt.Println(report)
+	fmt.Printf("%d objects, %s reclaimed\n", len(deletions), helpers.FormatBytes(retentionDecisionsSize(deletions)))
+}
@@ -0,0 +1,355 @@
+package commands
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type RecoverDocsCommand struct {
+	Key              string               `optional:"" env:"S3__KEY" prefix:"s3-" help:"The key of the backup to recover the documents from."`
+	At               string               `optional:"" env:"RECOVER_DOCS__AT" help:"Recover the documents as they were at this point in time, from the newest backup before it and the oplog up to it, an age (7d), a day (2026-12-31) or a time (2026-12-31T18:00:00Z)."`
+	ApplyOplog       bool                 `env:"RECOVER_DOCS__APPLY_OPLOG" help:"Apply the changes the oplog backups made to the documents after the backup, implied by --at."`
+	Namespace        string               `required:"" env:"RECOVER_DOCS__NAMESPACE" help:"The collection to recover the documents of, as database.collection."`
+	Filter           string               `required:"" env:"RECOVER_DOCS__FILTER" help:"The documents to recover, an extended JSON filter on their fields."`
+	Into             string               `optional:"" env:"RECOVER_DOCS__INTO" help:"Upsert the documents into this collection of the database rather than into their own collection."`
+	DryRun           bool                 `env:"RECOVER_DOCS__DRY_RUN" help:"Print the documents that would be upserted without writing them."`
+	ConnectionString string               `optional:"" env:"RECOVER_DOCS__CONNECTION_STRING" help:"The connection to the MongoDB instance to upsert the documents into, not needed for a dry run."`
+	S3               flags.S3Flags        `embed:"" group:"S3 Flags:"`
+	Verbosity        flags.VerbosityFlags `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
+}
+
+func (command RecoverDocsCommand) Run() error {
+	command.Verbosity.SetGlobalLogLevel()
+
+	ctx := context.Background()
+	s3Service := services.NewS3Service(command.S3)
+
+	// ######################
+	// Validate the flags
+	// ######################
+	database, collection, ok := strings.Cut(command.Namespace, ".")
+	if !ok || database == "" || collection == "" {
+		err := fmt.Errorf("invalid namespace %s, expected database.collection", command.Namespace)
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	if !command.DryRun && command.ConnectionString == "" {
+		err := errors.New("--connection-string is required unless it is a dry run")
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	filter, err := helpers.NewDocumentFilter(command.Filter)
+	if err != nil {
+		return err
+	}
+
+	at, err := helpers.ParseTimeBound(command.At, time.Now(), false)
+	if err != nil {
+		return err
+	}
+
+	// ######################
+	// Pick the backup to recover the documents from
+	// ######################
+	switch {
+	case command.Key != "":
+	case !at.IsZero():
+		if command.Key, err = findBackupBefore(ctx, s3Service, command.S3, database, at); err != nil {
+			return err
+		}
+	default:
+		if command.Key, err = chooseDatabaseToRestore(s3Service, ctx, command.S3.Bucket, command.S3.Prefix, ""); err != nil {
+			return err
+		}
+	}
+
+	backupTime, err := helpers.BackupKeyTime(command.Key)
+	if err != nil {
+		err := fmt.Errorf("%s is not a backup, documents can only be recovered from full and database backups", command.Key)
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	if !at.IsZero() && at.Before(backupTime) {
+		err := fmt.Errorf("%s was taken after %s", command.Key, at.Format(helpers.HumanReadableTimeFormat))
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	// ######################
+	// The documents read from the backup may hold any change made while it was dumped,
+	// they are only consistent from the end of the oplog captured with it
+	// ######################
+	manifest, err := getBackupManifest(ctx, s3Service, command.S3.Bucket, command.S3.Prefix, command.Key)
+	if err != nil {
+		return err
+	}
+
+	dumpEnd := backupTime
+	if manifest != nil && manifest.OplogCaptured {
+		dumpEnd = helpers.OplogTimestampTime(manifest.OplogTo)
+	}
+
+	if !at.IsZero() && at.Before(dumpEnd) {
+		err := fmt.Errorf("%s falls inside the dump of %s, which ran until %s, recover from an older backup with --s3-key", at.Format(helpers.HumanReadableTimeFormat), command.Key, dumpEnd.Format(helpers.HumanReadableTimeFormat))
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	// ######################
+	// Stream the matching documents out of the backup, nothing is written to disk
+	// ######################
+	log.Info().Msgf("Reading the documents of %s from %s", command.Namespace, command.Key)
+
+	documents, capturedOplog, err := readBackupDocuments(ctx, s3Service, command.S3.Bucket, command.Key, database, collection, filter)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("%d documents of %s match the filter", len(documents), command.Namespace)
+
+	recovery, err := helpers.NewDocumentRecovery(command.Namespace, documents)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	// ######################
+	// Bring the documents up to the end of the dump, and up to --at or the newest oplog backup when asked
+	// ######################
+	for _, entry := range capturedOplog {
+		if err := applyRecoveryEntry(recovery, entry, at); err != nil {
+			return err
+		}
+	}
+
+	if command.ApplyOplog || !at.IsZero() {
+		if err := applyOplogBackups(ctx, s3Service, command.S3, command.Key, backupTime, dumpEnd, at, recovery); err != nil {
+			return err
+		}
+	}
+
+	// ######################
+	// Print or upsert the documents
+	// ######################
+	recovered := recovery.Documents()
+	into := cmp.Or(command.Into, collection)
+
+	if command.DryRun {
+		for _, document := range recovered {
+			data, err := bson.MarshalExtJSON(document, false, false)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to convert a document to JSON")
+				return err
+			}
+
+			fmt.Println(string(data))
+		}
+
+		fmt.Printf("%d documents would be upserted into %s.%s\n", len(recovered), database, into)
+		printDeletedDocuments(recovery.Deleted())
+		return nil
+	}
+
+	printDeletedDocuments(recovery.Deleted())
+
+	if len(recovered) == 0 {
+		log.Info().Msg("No documents to recover")
+		return nil
+	}
+
+	mongodbService, err := services.NewMongodbService(command.ConnectionString, ctx)
+	if err != nil {
+		return err
+	}
+
+	replaced, inserted, err := mongodbService.UpsertDocuments(ctx, database, into, recovered)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Recovered %d documents into %s.%s, %d replaced and %d inserted", len(recovered), database, into, replaced, inserted)
+	return nil
+}
+
+// findBackupBefore returns the newest full backup, or backup of the database, taken before a point in time
+func findBackupBefore(ctx context.Context, s3Service *services.S3Service, s3Flags flags.S3Flags, database string, at time.Time) (string, error) {
+	key := ""
+	var keyTime time.Time
+
+	for _, backupPrefix := range []string{helpers.S3BackupPrefix(s3Flags.Prefix, ""), helpers.S3BackupPrefix(s3Flags.Prefix, database)} {
+		objects, err := s3Service.ListAll(ctx, s3Flags.Bucket, backupPrefix)
+		if err != nil {
+			return "", err
+		}
+
+		for _, obj := range objects {
+			backupTime, err := helpers.BackupKeyTime(*obj.Key)
+			if err != nil || backupTime.After(at) || !backupTime.After(keyTime) {
+				continue
+			}
+
+			key, keyTime = *obj.Key, backupTime
+		}
+	}
+
+	if key == "" {
+		err := fmt.Errorf("no backup of %s was taken before %s", database, at.Format(helpers.HumanReadableTimeFormat))
+		log.Error().Err(err).Send()
+		return "", err
+	}
+
+	log.Info().Msgf("Recovering from %s, the newest backup before %s", key, at.Format(helpers.HumanReadableTimeFormat))
+	return key, nil
+}
+
+func readBackupDocuments(ctx context.Context, s3Service *services.S3Service, bucket string, key string, database string, collection string, filter *helpers.DocumentFilter) ([]bson.Raw, []bson.Raw, error) {
+	obj, err := s3Service.Get(ctx, bucket, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer obj.Body.Close()
+
+	reader, err := helpers.NewDecompressionReader(obj.Body)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to open the decompression reader for %s", key)
+		return nil, nil, err
+	}
+
+	defer reader.Close()
+
+	return helpers.ReadArchiveDocuments(reader, database, collection, filter)
+}
+
+// applyOplogBackups replays the oplog backups taken after the backup on the documents, up to at when it is set.
+// The chain is checked before anything is applied, it has to continue from the end of the dump without a gap
+func applyOplogBackups(ctx context.Context, s3Service *services.S3Service, s3Flags flags.S3Flags, key string, backupTime time.Time, dumpEnd time.Time, at time.Time, recovery *helpers.DocumentRecovery) error {
+	oplogPrefix := helpers.S3OplogPrefix(s3Flags.Prefix, helpers.BackupKeyDatabase(s3Flags.Prefix, key))
+
+	objects, err := s3Service.ListAll(ctx, s3Flags.Bucket, oplogPrefix)
+	if err != nil {
+		return err
+	}
+
+	segments := make([]models.OplogBackup, 0, len(objects))
+
+	for _, obj := range objects {
+		if !helpers.IsOplogBackupKey(*obj.Key) {
+			continue
+		}
+
+		segment := helpers.PrepareOplogBackup(*obj.Key)
+
+		if !segment.ToTime.After(backupTime) || !at.IsZero() && !segment.FromTime.Before(at) {
+			continue
+		}
+
+		segments = append(segments, segment)
+	}
+
+	slices.SortFunc(segments, func(a, b models.OplogBackup) int {
+		return a.FromTime.Compare(b.FromTime)
+	})
+
+	// ######################
+	// Refuse a chain that leaves out changes, the documents would silently miss them
+	// ######################
+	if len(segments) == 0 {
+		if !at.IsZero() {
+			err := fmt.Errorf("%w: no oplog backup continues from the end of the dump of %s at %s", errOplogTargetNotReached, key, dumpEnd.Format(helpers.HumanReadableTimeFormat))
+			log.Error().Err(err).Send()
+			return err
+		}
+
+		log.Warn().Msgf("No oplog backup was taken after %s, the documents are recovered as they were at the end of its dump", key)
+		return nil
+	}
+
+	if segments[0].FromTime.After(dumpEnd) {
+		err := fmt.Errorf("%w: the oplog backups start at %s, after the end of the dump of %s at %s", errOplogTargetNotReached, segments[0].FromString, key, dumpEnd.Format(helpers.HumanReadableTimeFormat))
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	for i := 1; i < len(segments); i++ {
+		if segments[i].FromTime.After(segments[i-1].ToTime) {
+			err := fmt.Errorf("%w: the oplog chain is broken between %s and %s", errOplogTargetNotReached, segments[i-1].ToString, segments[i].FromString)
+			log.Error().Err(err).Send()
+			return err
+		}
+	}
+
+	if last := segments[len(segments)-1]; !at.IsZero() && last.ToTime.Before(at) {
+		err := fmt.Errorf("%w: the newest oplog backup ends at %s, before %s", errOplogTargetNotReached, last.ToString, at.Format(helpers.HumanReadableTimeFormat))
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	// ######################
+	// Apply the oplog backups
+	// ######################
+	for _, segment := range segments {
+		log.Info().Msgf("Applying %s", segment.Key)
+
+		obj, err := s3Service.Get(ctx, s3Flags.Bucket, segment.Key)
+		if err != nil {
+			return err
+		}
+
+		err = helpers.ForEachOplogEntryIn(obj.Body, segment.Key, func(entry bson.Raw) error {
+			return applyRecoveryEntry(recovery, entry, at)
+		})
+
+		obj.Body.Close()
+
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to apply %s", segment.Key)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyRecoveryEntry applies an oplog entry to the documents unless it is at or after at
+func applyRecoveryEntry(recovery *helpers.DocumentRecovery, entry bson.Raw, at time.Time) error {
+	t, i := entry.Lookup("ts").Timestamp()
+
+	if !at.IsZero() && !helpers.OplogTimestampTime(primitive.Timestamp{T: t, I: i}).Before(at) {
+		return nil
+	}
+
+	if err := recovery.Apply(entry); err != nil {
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	return nil
+}
+
+func printDeletedDocuments(deleted []models.DeletedDocument) {
+	if len(deleted) == 0 {
+		return
+	}
+
+	first := deleted[0].Timestamp
+
+	fmt.Printf("%d matching documents were deleted by the oplog and are not recovered, the first at %s (%s)\n", len(deleted), helpers.OplogTimestampString(first), helpers.OplogTimestampTime(first).Format(helpers.HumanReadableTimeFormat))
+	fmt.Printf("To recover them as they were before: --at=%s\n", helpers.OplogTimestampTime(first).Format(helpers.TimeFormat))
+}
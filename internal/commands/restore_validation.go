@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/charmbracelet/lipgloss/table"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/mongodb/mongo-tools/common/archive"
+	"github.com/rs/zerolog/log"
+)
+
+func validateRestore(ctx context.Context, mongodbService *services.MongodbService, manifest *models.BackupManifest, isRestored func(namespace string) bool, oplogReplayed bool, archiveOplogReplayed bool, withDbHash bool) ([]models.ValidationResult, error) {
+	log.Info().Msg("Validating the restore against the backup manifest")
+
+	results := make([]models.ValidationResult, 0)
+
+	for _, expected := range manifest.Namespaces {
+		if !isRestored(expected.Namespace()) {
+			continue
+		}
+
+		actual, err := mongodbService.NamespaceManifest(ctx, expected.Database, expected.Collection, withDbHash && expected.DbHash != "" && !oplogReplayed)
+		if err != nil {
+			return nil, err
+		}
+
+		// ######################
+		// Documents and hashes only match when no oplog backup was replayed on top, the count is the one
+		// of the archive and only approximate once the oplog captured with the dump changed the collection
+		// ######################
+		if !oplogReplayed {
+			results = append(results, models.ValidationResult{
+				Namespace:   expected.Namespace(),
+				Check:       "count",
+				Expected:    strconv.FormatInt(expected.Count, 10),
+				Actual:      strconv.FormatInt(actual.Count, 10),
+				Passed:      expected.Count == actual.Count,
+				Approximate: archiveOplogReplayed && expected.ChangedDuringDump,
+			})
+
+			if actual.DbHash != "" {
+				results = append(results, models.ValidationResult{
+					Namespace:   expected.Namespace(),
+					Check:       "dbHash",
+					Expected:    expected.DbHash,
+					Actual:      actual.DbHash,
+					Passed:      expected.DbHash == actual.DbHash,
+					Approximate: expected.DbHashApproximate,
+				})
+			}
+		}
+
+		results = append(results, models.ValidationResult{
+			Namespace: expected.Namespace(),
+			Check:     "options",
+			Expected:  expected.Options,
+			Actual:    actual.Options,
+			Passed:    expected.Options == actual.Options,
+		})
+
+		actualIndexes := make(map[string]models.IndexManifest, len(actual.Indexes))
+		for _, index := range actual.Indexes {
+			actualIndexes[index.Name] = index
+		}
+
+		for _, expectedIndex := range expected.Indexes {
+			actualIndex, exists := actualIndexes[expectedIndex.Name]
+			delete(actualIndexes, expectedIndex.Name)
+
+			results = append(results, models.ValidationResult{
+				Namespace: expected.Namespace(),
+				Check:     "index " + expectedIndex.Name,
+				Expected:  expectedIndex.Key + " " + expectedIndex.Options,
+				Actual:    actualIndex.Key + " " + actualIndex.Options,
+				Passed:    exists && expectedIndex == actualIndex,
+			})
+		}
+
+		for name, actualIndex := range actualIndexes {
+			results = append(results, models.ValidationResult{
+				Namespace: expected.Namespace(),
+				Check:     "index " + name,
+				Expected:  "",
+				Actual:    actualIndex.Key + " " + actualIndex.Options,
+				Passed:    false,
+			})
+		}
+	}
+
+	printValidationReport(results)
+
+	failures := 0
+	for _, result := range results {
+		switch {
+		case result.Passed:
+		case result.Approximate:
+			log.Warn().Msgf("Validation of %s %s diverged, expected about %s, got %s, the collection changed while it was dumped", result.Namespace, result.Check, result.Expected, result.Actual)
+		default:
+			failures++
+			log.Error().Msgf("Validation of %s %s diverged, expected %s, got %s", result.Namespace, result.Check, result.Expected, result.Actual)
+		}
+	}
+
+	if failures > 0 {
+		err := fmt.Errorf("restore validation failed, %d of %d checks diverged", failures, len(results))
+		log.Error().Err(err).Send()
+		return results, err
+	}
+
+	log.Info().Msgf("Restore validation passed, %d checks", len(results))
+	return results, nil
+}
+
+// checkArchiveNamespaces warns about the namespaces the manifest expects that are missing from the archive
+func checkArchiveNamespaces(prelude *archive.Prelude, manifest *models.BackupManifest) {
+	if manifest.Filter != nil {
+		log.Info().Msgf("Backup %s only contains the namespaces matching: %s", manifest.Key, manifest.Filter)
+	}
+
+	archived := make(map[string]bool, len(prelude.NamespaceMetadatas))
+	for _, metadata := range prelude.NamespaceMetadatas {
+		archived[metadata.Database+"."+metadata.Collection] = true
+	}
+
+	missing := 0
+	for _, expected := range manifest.Namespaces {
+		if !archived[expected.Namespace()] {
+			missing++
+			log.Warn().Msgf("The manifest of %s lists %s but the archive does not contain it", manifest.Key, expected.Namespace())
+		}
+	}
+
+	if missing == 0 {
+		log.Info().Msgf("The archive contains all %d namespaces of the manifest", len(manifest.Namespaces))
+	}
+}
+
+func printValidationReport(results []models.ValidationResult) {
+	report := table.New().Headers("Namespace", "Check", "Result")
+
+	for _, result := range results {
+		status := "PASS"
+		switch {
+		case result.Passed:
+		case result.Approximate:
+			status = "DIFFERS (approximate)"
+		default:
+			status = "FAIL"
+		}
+
+		report = report.Row(result.Namespace, result.Check, status)
+	}
+
+	fmt.Println("Restore Validation Report:")
+	fmt.Println(report)
+}
@@ -0,0 +1,351 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+// retentionPlan holds what the retention policy keeps and deletes of the backups of one prefix and of their oplog chain
+type retentionPlan struct {
+	BackupPrefix string
+	OplogPrefix  string
+	Backups      []models.RetentionDecision
+	Oplog        []models.RetentionDecision
+
+	// the sizes of the manifests of the backups, by the key of their backup
+	Manifests map[string]int64
+}
+
+func planRetention(ctx context.Context, s3Service *services.S3Service, bucket string, prefix string, database string, retention flags.RetentionFlags, classRetention flags.ClassRetentionFlags, withBackups bool, now time.Time) (*retentionPlan, error) {
+	policies := make(map[string]models.RetentionPolicy, len(models.BackupClasses))
+
+	for _, class := range models.BackupClasses {
+		classFlags := classRetention.For(class, retention)
+
+		policy, err := classFlags.Policy()
+		if err != nil {
+			return nil, err
+		}
+
+		policies[class] = policy
+	}
+
+	plan := &retentionPlan{
+		BackupPrefix: helpers.S3BackupPrefix(prefix, database),
+		OplogPrefix:  helpers.S3OplogPrefix(prefix, database),
+		Manifests:    make(map[string]int64),
+	}
+
+	// ######################
+	// List the backups
+	// ######################
+	backupObjects, err := s3Service.ListAll(ctx, bucket, plan.BackupPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, obj := range backupObjects {
+		backupTime, err := helpers.BackupKeyTime(*obj.Key)
+		if err != nil {
+			log.Warn().Msgf("Skipping %s as it is not named after the time of a backup", *obj.Key)
+			continue
+		}
+
+		plan.Backups = append(plan.Backups, models.RetentionDecision{Key: *obj.Key, Time: backupTime, Size: aws.ToInt64(obj.Size)})
+	}
+
+	// ######################
+	// The manifests go with their backups, they hold the class and the pin of the backup
+	// ######################
+	manifestObjects, err := s3Service.ListAll(ctx, bucket, strings.TrimSuffix(helpers.S3ManifestKey(prefix, plan.BackupPrefix), ".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifestSizes := make(map[string]int64, len(manifestObjects))
+	for _, obj := range manifestObjects {
+		manifestSizes[*obj.Key] = aws.ToInt64(obj.Size)
+	}
+
+	manifests := make(map[string]*models.BackupManifest)
+
+	for _, decision := range plan.Backups {
+		size, exists := manifestSizes[helpers.S3ManifestKey(prefix, decision.Key)]
+		if !exists {
+			continue
+		}
+
+		plan.Manifests[decision.Key] = size
+
+		if manifests[decision.Key], err = getBackupManifest(ctx, s3Service, bucket, prefix, decision.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	// ######################
+	// Decide which backups to keep, every class of backups by its own policy
+	// ######################
+	for _, class := range models.BackupClasses {
+		classBackups := make([]models.RetentionDecision, 0)
+
+		for _, decision := range plan.Backups {
+			if manifests[decision.Key].BackupClass() == class {
+				classBackups = append(classBackups, decision)
+			}
+		}
+
+		helpers.ApplyRetentionPolicy(policies[class], classBackups, now)
+
+		decisions := make(map[string]models.RetentionDecision, len(classBackups))
+		for _, decision := range classBackups {
+			if class != models.BackupClassScheduled {
+				decision.Reason = fmt.Sprintf("%s backup %s", class, decision.Reason)
+			}
+
+			decisions[decision.Key] = decision
+		}
+
+		for i := range plan.Backups {
+			if decision, exists := decisions[plan.Backups[i].Key]; exists {
+				plan.Backups[i] = decision
+			}
+		}
+	}
+
+	slices.SortFunc(plan.Backups, func(a, b models.RetentionDecision) int { return a.Time.Compare(b.Time) })
+
+	// ######################
+	// Pinned backups are kept until their pin expires
+	// ######################
+	pinned := make(map[string]bool)
+
+	for i := range plan.Backups {
+		if manifest := manifests[plan.Backups[i].Key]; manifest != nil && manifest.Pin.IsActive(now) {
+			pinned[plan.Backups[i].Key] = true
+			plan.Backups[i].Keep = true
+			plan.Backups[i].Reason = pinReason(manifest.Pin)
+		}
+	}
+
+	keepLastRestorePoint(plan.Backups)
+
+	// ######################
+	// The oplog chain has to reach back to the backup point-in-time restores start from
+	// ######################
+	oplogObjects, err := s3Service.ListAll(ctx, bucket, plan.OplogPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	remainingBackups := plan.Backups
+
+	// the backups the policy deletes stay until the backups are cleaned up, so the oplog they need stays as well
+	if !withBackups {
+		remainingBackups = slices.Clone(plan.Backups)
+
+		for i := range remainingBackups {
+			remainingBackups[i].Keep = true
+		}
+	}
+
+	oplogStart, oplogStartReason := oplogRetentionStart(policies[models.BackupClassScheduled], remainingBackups, now)
+	pinnedOplog := pinnedOplogRanges(remainingBackups, pinned)
+
+	for _, obj := range oplogObjects {
+		if *obj.Key == plan.OplogPrefix+helpers.ConfigFileName {
+			continue
+		}
+
+		timeStrings := strings.Split(helpers.TrimOplogSegmentExtension(path.Base(*obj.Key)), "_")
+		if len(timeStrings) != 2 {
+			log.Warn().Msgf("Skipping %s as it is not named after the times of an oplog backup", *obj.Key)
+			continue
+		}
+
+		fromTime, fromErr := time.Parse(helpers.TimeFormat, timeStrings[0])
+		toTime, toErr := time.Parse(helpers.TimeFormat, timeStrings[1])
+		if fromErr != nil || toErr != nil {
+			log.Warn().Msgf("Skipping %s as it is not named after the times of an oplog backup", *obj.Key)
+			continue
+		}
+
+		decision := models.RetentionDecision{Key: *obj.Key, Time: toTime, Size: aws.ToInt64(obj.Size), Keep: true, Reason: "needed for point-in-time restores"}
+
+		if oplogStart != nil && !toTime.After(*oplogStart) {
+			decision.Keep = false
+			decision.Reason = oplogStartReason
+		}
+
+		for _, pinnedRange := range pinnedOplog {
+			if !decision.Keep && toTime.After(pinnedRange.from) && (pinnedRange.to.IsZero() || fromTime.Before(pinnedRange.to)) {
+				decision.Keep = true
+				decision.Reason = "needed for point-in-time restores from the pinned backup " + pinnedRange.key
+			}
+		}
+
+		plan.Oplog = append(plan.Oplog, decision)
+	}
+
+	return plan, nil
+}
+
+// oplogRetentionStart returns the time oplog backups have to reach back to, nil keeps every oplog backup.
+// By default it is the oldest of the most recent backups kept, the older backups the daily, weekly, monthly and
+// yearly rules keep are restored without their oplog, --oplog-max-age sets how far back it reaches instead
+func oplogRetentionStart(policy models.RetentionPolicy, backups []models.RetentionDecision, now time.Time) (*time.Time, string) {
+	kept := make([]models.RetentionDecision, 0, len(backups))
+
+	for _, backup := range backups {
+		if backup.Keep {
+			kept = append(kept, backup)
+		}
+	}
+
+	if len(kept) == 0 {
+		return nil, ""
+	}
+
+	start := kept[0]
+
+	switch {
+	case policy.OplogMaxAge > 0:
+		// the newest backup taken before the point-in-time window starts covers all of it
+		for _, backup := range kept {
+			if !backup.Time.After(now.Add(-policy.OplogMaxAge)) {
+				start = backup
+			}
+		}
+	case policy.HasCalendarRules():
+		recent := max(policy.KeepLast, policy.MinCount, 1)
+
+		if recent < len(kept) {
+			start = kept[len(kept)-recent]
+
+			// with no recent backups kept, only the --min-count newest backups are restored with their oplog
+			if policy.KeepLast == 0 {
+				log.Warn().Msgf("--keep-recent-n is 0, point-in-time restores only reach back to %s (%s), the oldest of the %d most recent backups --min-count keeps, the %d older backups are kept without their oplog, set --keep-recent-n or --oplog-max-age to reach further", start.Key, start.Time.Format(helpers.HumanReadableTimeFormat), recent, len(kept)-recent)
+			} else {
+				log.Info().Msgf("Point-in-time restores reach back to %s, the oldest of the %d most recent backups, the %d older backups are kept without their oplog, set --oplog-max-age to reach further", start.Key, recent, len(kept)-recent)
+			}
+		}
+	}
+
+	return &start.Time, fmt.Sprintf("ends before %s, the oldest backup point-in-time restores start from", start.Key)
+}
+
+type pinnedOplogRange struct {
+	key  string
+	from time.Time
+	to   time.Time
+}
+
+// pinnedOplogRanges returns the time from every pinned backup up to the next backup kept,
+// the oplog backups in between are needed to restore to any point in time after the pinned backup
+func pinnedOplogRanges(backups []models.RetentionDecision, pinned map[string]bool) []pinnedOplogRange {
+	ranges := make([]pinnedOplogRange, 0, len(pinned))
+
+	for i, backup := range backups {
+		if !pinned[backup.Key] {
+			continue
+		}
+
+		pinnedRange := pinnedOplogRange{key: backup.Key, from: backup.Time}
+
+		for _, next := range backups[i+1:] {
+			if next.Keep {
+				pinnedRange.to = next.Time
+				break
+			}
+		}
+
+		ranges = append(ranges, pinnedRange)
+	}
+
+	return ranges
+}
+
+// keepLastRestorePoint makes sure the policy never deletes the last backup that can be restored
+func keepLastRestorePoint(backups []models.RetentionDecision) {
+	for i := len(backups) - 1; i >= 0; i-- {
+		// an empty object is what is left of a failed upload
+		if backups[i].Size == 0 {
+			continue
+		}
+
+		if !backups[i].Keep {
+			backups[i].Keep = true
+			backups[i].Reason = "the last valid restore point is never deleted"
+			log.Warn().Msgf("The retention policy deletes every backup of %s, keeping %s as it is the last valid restore point", path.Dir(backups[i].Key), backups[i].Key)
+		}
+
+		return
+	}
+}
+
+// deletions returns the objects the plan deletes and why, the backups along with their manifests
+func (plan *retentionPlan) deletions(prefix string, withBackups bool) []models.RetentionDecision {
+	deletions := make([]models.RetentionDecision, 0)
+
+	if withBackups {
+		for _, decision := range plan.Backups {
+			if decision.Keep {
+				continue
+			}
+
+			deletions = append(deletions, decision)
+
+			if size, exists := plan.Manifests[decision.Key]; exists {
+				deletions = append(deletions, models.RetentionDecision{
+					Key:    helpers.S3ManifestKey(prefix, decision.Key),
+					Time:   decision.Time,
+					Size:   size,
+					Reason: "the manifest of " + decision.Key,
+				})
+			}
+		}
+	}
+
+	for _, decision := range plan.Oplog {
+		if !decision.Keep {
+			deletions = append(deletions, decision)
+		}
+	}
+
+	return deletions
+}
+
+func deleteRetentionDecisions(ctx context.Context, s3Service *services.S3Service, bucket string, deletions []models.RetentionDecision) error {
+	objectsToDelete := make([]types.ObjectIdentifier, 0, len(deletions))
+
+	for _, decision := range deletions {
+		log.Info().Msgf("Deleting %s, %s", decision.Key, decision.Reason)
+		objectsToDelete = append(objectsToDelete, types.ObjectIdentifier{Key: aws.String(decision.Key)})
+	}
+
+	return s3Service.Delete(ctx, bucket, objectsToDelete)
+}
+
+// applyRetention deletes what the retention policy does not keep of the backups the command takes and of their oplog chain,
+// oplog dumps only clean up the oplog chain
+func applyRetention(ctx context.Context, s3Service *services.S3Service, command *DumpCommand, withBackups bool) error {
+	log.Info().Msgf("Applying the retention policy to %s", helpers.S3BackupPrefix(command.S3.Prefix, command.Mongo.NamespaceOptions.Database))
+
+	plan, err := planRetention(ctx, s3Service, command.S3.Bucket, command.S3.Prefix, command.Mongo.NamespaceOptions.Database, command.Mongo.Retention, command.Mongo.ClassRetention, withBackups, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return deleteRetentionDecisions(ctx, s3Service, command.S3.Bucket, plan.deletions(command.S3.Prefix, withBackups))
+}
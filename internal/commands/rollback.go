@@ -0,0 +1,199 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/charmbracelet/huh"
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+type RollbackCommand struct {
+	Snapshot  string                  `optional:"" env:"SNAPSHOT" help:"The id of the pre-restore snapshot to roll back to."`
+	S3        flags.S3Flags           `embed:"" group:"S3 Flags:"`
+	Mongo     flags.MongoRestoreFlags `embed:"" envprefix:"MONGO_RESTORE__"`
+	Verbosity flags.VerbosityFlags    `embed:"" prefix:"verbosity-" envprefix:"VERBOSITY__" group:"verbosity options"`
+}
+
+func (command RollbackCommand) Run() error {
+	command.Verbosity.SetGlobalLogLevel()
+	command.Mongo.WarnDeprecatedFlags()
+
+	ctx := context.Background()
+	s3Service := services.NewS3Service(command.S3)
+
+	var err error
+
+	backupDir := strings.TrimSuffix(command.Mongo.BackupDir, "/")
+
+	// ########################
+	// If snapshot is not provided, let user choose the snapshot to roll back to
+	// ########################
+	if command.Snapshot == "" {
+		if command.Snapshot, err = chooseSnapshotToRollback(s3Service, ctx, command.S3.Bucket, command.S3.Prefix); err != nil {
+			return err
+		}
+	}
+
+	// ########################
+	// Get the snapshot info
+	// ########################
+	snapshotPrefix := helpers.S3PreRestorePrefix(command.S3.Prefix) + command.Snapshot + "/"
+
+	resp, err := s3Service.Get(ctx, command.S3.Bucket, snapshotPrefix+helpers.SnapshotFileName)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	var snapshot models.PreRestoreSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		log.Error().Err(err).Msg("Failed to decode the snapshot info")
+		return err
+	}
+
+	log.Info().Msgf("Rolling back the restore of %s using snapshot %s", snapshot.RestoredKey, snapshot.Id)
+
+	// ########################
+	// Make sure the target is the intended one
+	// ########################
+	mongodbService, err := services.NewMongodbService(command.Mongo.ConnectionString, ctx)
+	if err != nil {
+		return err
+	}
+
+	command.Mongo.TargetOptions.AllowSameCluster = true
+	if err := guardRestoreTarget(ctx, mongodbService, &command.Mongo, nil); err != nil {
+		return err
+	}
+
+	// ########################
+	// Drop the namespaces the restore created, snapshots taken before the namespaces were recorded cannot tell them apart
+	// ########################
+	if snapshot.ExistingNamespaces == nil {
+		log.Warn().Msgf("Snapshot %s does not record the namespaces that existed before the restore, the namespaces the restore created are left in place", snapshot.Id)
+	} else {
+		namespaces, err := listSnapshotNamespaces(ctx, mongodbService)
+		if err != nil {
+			return err
+		}
+
+		for _, namespace := range namespaces {
+			if slices.Contains(snapshot.ExistingNamespaces, namespace) {
+				continue
+			}
+
+			database, collection, _ := strings.Cut(namespace, ".")
+
+			if err := mongodbService.DropCollection(ctx, database, collection); err != nil {
+				return err
+			}
+		}
+	}
+
+	// ########################
+	// The snapshot replaces exactly what it captured
+	// ########################
+	command.Mongo.RestoreOptions.Drop = true
+	command.Mongo.InputOptions.SkipUsersAndRoles = true
+	command.Mongo.NamespaceOptions.Database = ""
+	command.Mongo.NamespaceOptions.Collection = ""
+	command.Mongo.NamespaceOptions.NSInclude = nil
+	command.Mongo.NamespaceOptions.NSExclude = nil
+
+	for _, archiveKey := range snapshot.Archives {
+
+		// ########################
+		// Get archive from S3
+		// ########################
+		archive, err := s3Service.Get(ctx, command.S3.Bucket, archiveKey)
+		if err != nil {
+			return err
+		}
+
+		// ########################
+		// Write archive to file
+		// ########################
+		fileName := strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := helpers.WriteToFile(archive.Body, archive.ContentLength, backupDir, fileName); err != nil {
+			return err
+		}
+
+		// ########################
+		// Restore archive
+		// ########################
+		archiveReader, err := helpers.OpenArchive(filepath.Join(backupDir, fileName))
+		if err != nil {
+			return err
+		}
+
+		mongoRestore, err := command.Mongo.PrepareBackupMongoRestoreOptions(archiveReader, false, "")
+		if err != nil {
+			archiveReader.Close()
+			log.Err(err).Msg("Failed to prepare restore options")
+			return err
+		}
+
+		result := mongoRestore.Restore()
+		archiveReader.Close()
+
+		if result.Err != nil {
+			log.Err(result.Err).Msgf("Failed to restore %s", archiveKey)
+			return result.Err
+		}
+
+		os.Remove(filepath.Join(backupDir, fileName))
+
+		log.Info().Msgf("Restored %s, Successfully restored %d, Failed to restore %d", archiveKey, result.Successes, result.Failures)
+	}
+
+	log.Info().Msgf("Rolled back %d namespaces from snapshot %s", len(snapshot.Namespaces), snapshot.Id)
+	return nil
+}
+
+func chooseSnapshotToRollback(s3Service *services.S3Service, ctx context.Context, bucket string, prefix string) (string, error) {
+	var response *s3.ListObjectsV2Output
+	var snapshotToRollback string
+	var err error
+
+	snapshotsPrefix := helpers.S3PreRestorePrefix(prefix)
+
+	if response, err = s3Service.List(ctx, bucket, snapshotsPrefix); err != nil {
+		return "", err
+	}
+
+	list := make([]huh.Option[string], 0)
+
+	for _, object := range response.Contents {
+		key := *object.Key
+		if strings.HasSuffix(key, "/"+helpers.SnapshotFileName) {
+			snapshotId := strings.TrimSuffix(strings.TrimPrefix(key, snapshotsPrefix), "/"+helpers.SnapshotFileName)
+			list = append(list, huh.NewOption(snapshotId, snapshotId))
+		}
+	}
+
+	err = huh.NewSelect[string]().
+		Title("Choose a snapshot to roll back to").
+		Options(list...).
+		Value(&snapshotToRollback).
+		Run()
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to choose snapshot to roll back to")
+		return "", err
+	}
+
+	return snapshotToRollback, nil
+}
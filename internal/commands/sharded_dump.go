@@ -0,0 +1,348 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const shardCatchUpTimeout = 2 * time.Minute
+
+func startShardedBackup(command *DumpCommand) (err error) {
+	ctx := context.Background()
+	backupId := time.Now().UTC().Format(helpers.TimeFormat)
+	backupPrefix := helpers.S3ShardedBackupPrefix(command.S3.Prefix) + backupId + "/"
+
+	// ######################
+	// Discover the shards and the config server
+	// ######################
+	mongosService, err := services.NewMongodbService(command.Mongo.ConnectionString, ctx)
+	if err != nil {
+		return err
+	}
+
+	isMongos, err := mongosService.IsMongos(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !isMongos {
+		err := errors.New("a sharded backup must be taken through a mongos")
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	shards, err := mongosService.ListShards(ctx)
+	if err != nil {
+		return err
+	}
+
+	shardServices := make([]*services.MongodbService, len(shards))
+	shardConnectionStrings := make([]string, len(shards))
+
+	for i, shard := range shards {
+		if shardConnectionStrings[i], err = helpers.ReplicaSetConnectionString(command.Mongo.ConnectionString, shard.ReplicaSetName, shard.Hosts); err != nil {
+			return err
+		}
+
+		if shardServices[i], err = services.NewMongodbService(shardConnectionStrings[i], ctx); err != nil {
+			return err
+		}
+	}
+
+	// ######################
+	// Keep chunks in place while dumping
+	// ######################
+	if err := mongosService.StopBalancer(ctx); err != nil {
+		return err
+	}
+
+	defer func() {
+		if startErr := mongosService.StartBalancer(ctx); startErr != nil {
+			err = errors.Join(err, startErr)
+		}
+	}()
+
+	shardedBackup := models.ShardedBackup{
+		Id:     backupId,
+		Shards: make([]models.ShardBackup, len(shards)),
+	}
+
+	for i, shard := range shards {
+		shardedBackup.Shards[i].Shard = shard
+
+		if shardedBackup.Shards[i].OplogFrom, err = shardServices[i].LatestOplogTimestamp(ctx); err != nil {
+			return err
+		}
+	}
+
+	// ######################
+	// Dump every shard in parallel
+	// ######################
+	s3Service := services.NewS3Service(command.S3)
+
+	var waitGroup sync.WaitGroup
+	dumpErrors := make([]error, len(shards))
+
+	for i := range shards {
+		waitGroup.Add(1)
+
+		go func(i int) {
+			defer waitGroup.Done()
+			shardedBackup.Shards[i].ArchiveKey, dumpErrors[i] = dumpShard(ctx, command, s3Service, shardConnectionStrings[i], backupPrefix, shards[i])
+		}(i)
+	}
+
+	waitGroup.Wait()
+
+	if err := errors.Join(dumpErrors...); err != nil {
+		log.Error().Err(err).Msg("Failed to dump the shards")
+		return err
+	}
+
+	// ######################
+	// Align every shard to a common cluster time
+	// ######################
+	for _, shardService := range shardServices {
+		latest, err := shardService.LatestOplogTimestamp(ctx)
+		if err != nil {
+			return err
+		}
+
+		if latest.After(shardedBackup.ClusterTime) {
+			shardedBackup.ClusterTime = latest
+		}
+	}
+
+	log.Info().Msgf("Aligning the shards to cluster time %d:%d", shardedBackup.ClusterTime.T, shardedBackup.ClusterTime.I)
+
+	for i, shard := range shards {
+		if err := waitForOplogToReach(ctx, shardServices[i], shard.Name, shardedBackup.ClusterTime); err != nil {
+			return err
+		}
+
+		if shardedBackup.Shards[i].OplogKey, err = dumpShardOplog(ctx, command, s3Service, shardConnectionStrings[i], backupPrefix, shard, shardedBackup.Shards[i].OplogFrom, shardedBackup.ClusterTime); err != nil {
+			return err
+		}
+	}
+
+	// ######################
+	// Upload the sharded backup info
+	// ######################
+	shardedBackupByteArray, err := json.Marshal(&shardedBackup)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal the sharded backup info")
+		return err
+	}
+
+	if _, err := s3Service.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(command.S3.Bucket),
+		Key:    aws.String(backupPrefix + helpers.ShardedBackupFileName),
+		Body:   bytes.NewReader(shardedBackupByteArray),
+	}); err != nil {
+		log.Error().Err(err).Msg("Failed to upload the sharded backup info")
+		return err
+	}
+
+	// ######################
+	// Apply the retention policy
+	// ######################
+	if err := applyShardedRetention(ctx, s3Service, command); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Sharded backup %s completed successfully", backupId)
+	return nil
+}
+
+func dumpShard(ctx context.Context, command *DumpCommand, s3Service *services.S3Service, connectionString string, backupPrefix string, shard models.Shard) (string, error) {
+	log.Info().Msgf("Starting the dump of shard %s", shard.Name)
+
+	dumpFlags := command.Mongo
+	dumpFlags.ConnectionString = connectionString
+	dumpFlags.NamespaceOptions.Database = ""
+	dumpFlags.NamespaceOptions.Collection = ""
+	dumpFlags.OutputOptions.OpLog = false
+	dumpFlags.OutputOptions.PointInTime = false
+
+	mongoDump, err := dumpFlags.PrepareMongoDump()
+	if err != nil {
+		return "", err
+	}
+
+	if err := mongoDump.Init(); err != nil {
+		log.Error().Err(err).Msgf("Error initializing the dump of shard %s", shard.Name)
+		return "", err
+	}
+
+	archivePath, err := dumpArchive(mongoDump, dumpFlags.BackupDir, dumpFlags.OutputOptions.Compression, dumpFlags.OutputOptions.CompressionLevel, nil)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error dumping shard %s", shard.Name)
+		return "", err
+	}
+
+	archiveKey := backupPrefix + shard.Name + helpers.ArchiveExtension(dumpFlags.OutputOptions.Compression)
+
+	if err := s3Service.UploadFile(ctx, command.S3.Bucket, archiveKey, archivePath); err != nil {
+		return "", err
+	}
+
+	os.Remove(archivePath)
+
+	log.Info().Msgf("Shard %s dumped to %s", shard.Name, archiveKey)
+	return archiveKey, nil
+}
+
+func dumpShardOplog(ctx context.Context, command *DumpCommand, s3Service *services.S3Service, connectionString string, backupPrefix string, shard models.Shard, from primitive.Timestamp, to primitive.Timestamp) (string, error) {
+	log.Info().Msgf("Starting the oplog dump of shard %s", shard.Name)
+
+	dumpFlags := command.Mongo
+	dumpFlags.ConnectionString = connectionString
+	dumpFlags.BackupDir = filepath.Join(command.Mongo.BackupDir, shard.Name)
+	dumpFlags.OutputOptions.OpLog = true
+
+	mongoDump, err := dumpFlags.PrepareMongoDump()
+	if err != nil {
+		return "", err
+	}
+
+	mongoDump.InputOptions.Query = helpers.OplogTimestampRangeQuery(from, to)
+
+	if err := mongoDump.Init(); err != nil {
+		log.Error().Err(err).Msgf("Error initializing the oplog dump of shard %s", shard.Name)
+		return "", err
+	}
+
+	if err := mongoDump.Dump(); err != nil {
+		log.Error().Err(err).Msgf("Error dumping the oplog of shard %s", shard.Name)
+		return "", err
+	}
+
+	tarFileDir := strings.TrimSuffix(dumpFlags.BackupDir, "/") + "/local/"
+	fileName := helpers.OplogTimestampTime(from).Format(helpers.TimeFormat) + "_" + helpers.OplogTimestampTime(to).Format(helpers.TimeFormat) + helpers.OplogSegmentExtension(command.Mongo.OutputOptions.OplogCompression)
+	oplogKey := fmt.Sprintf("%soplog/%s/%s", backupPrefix, shard.Name, fileName)
+
+	if err := uploadOplogSegment(ctx, s3Service, command.S3.Bucket, oplogKey, tarFileDir, command.Mongo.OutputOptions.OplogCompression, command.Mongo.OutputOptions.OplogCompressionLevel, map[string]string{
+		helpers.OplogFromMetadataKey: helpers.OplogTimestampString(from),
+		helpers.OplogToMetadataKey:   helpers.OplogTimestampString(to),
+	}); err != nil {
+		return "", err
+	}
+
+	os.RemoveAll(dumpFlags.BackupDir)
+
+	log.Info().Msgf("Oplog of shard %s dumped to %s", shard.Name, oplogKey)
+	return oplogKey, nil
+}
+
+func waitForOplogToReach(ctx context.Context, mongodbService *services.MongodbService, shardName string, clusterTime primitive.Timestamp) error {
+	deadline := time.Now().Add(shardCatchUpTimeout)
+
+	for {
+		latest, err := mongodbService.LatestOplogTimestamp(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !latest.Before(clusterTime) {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			err := fmt.Errorf("the oplog of shard %s did not reach the cluster time within %s", shardName, shardCatchUpTimeout)
+			log.Error().Err(err).Send()
+			return err
+		}
+
+		log.Info().Msgf("Waiting for the oplog of shard %s to reach the cluster time", shardName)
+		time.Sleep(time.Second)
+	}
+}
+
+// applyShardedRetention deletes the sharded backups the retention policy does not keep, along with every object under them
+func applyShardedRetention(ctx context.Context, s3Service *services.S3Service, command *DumpCommand) error {
+	policy, err := command.Mongo.Retention.Policy()
+	if err != nil {
+		return err
+	}
+
+	if policy.IsEmpty() {
+		return nil
+	}
+
+	log.Info().Msgf("Applying the retention policy to %s", helpers.S3ShardedBackupPrefix(command.S3.Prefix))
+
+	objects, err := s3Service.ListAll(ctx, command.S3.Bucket, helpers.S3ShardedBackupPrefix(command.S3.Prefix))
+	if err != nil {
+		return err
+	}
+
+	// ######################
+	// Group the objects by the backup they belong to
+	// ######################
+	backups := make([]models.RetentionDecision, 0)
+	objectsByBackup := make(map[string][]types.ObjectIdentifier)
+
+	for _, obj := range objects {
+		backupId, _, _ := strings.Cut(strings.TrimPrefix(*obj.Key, helpers.S3ShardedBackupPrefix(command.S3.Prefix)), "/")
+
+		if _, exists := objectsByBackup[backupId]; !exists {
+			// the backup ids are the times the backups were taken
+			backupTime, err := time.Parse(helpers.TimeFormat, backupId)
+			if err != nil {
+				log.Warn().Msgf("Skipping %s as it is not named after the time of a sharded backup", backupId)
+				continue
+			}
+
+			backups = append(backups, models.RetentionDecision{Key: backupId, Time: backupTime})
+		}
+
+		objectsByBackup[backupId] = append(objectsByBackup[backupId], types.ObjectIdentifier{Key: obj.Key})
+	}
+
+	// ######################
+	// The same policy as the other backups, pinned backups are kept until their pin expires
+	// ######################
+	helpers.ApplyRetentionPolicy(policy, backups, time.Now())
+
+	objectsToDelete := make([]types.ObjectIdentifier, 0)
+
+	for _, backup := range backups {
+		if backup.Keep {
+			continue
+		}
+
+		backupKey := helpers.S3ShardedBackupPrefix(command.S3.Prefix) + backup.Key + "/" + helpers.ShardedBackupFileName
+
+		pin, err := getActivePin(ctx, s3Service, command.S3.Bucket, command.S3.Prefix, backupKey, time.Now())
+		if err != nil {
+			return err
+		}
+
+		if pin != nil {
+			log.Info().Msgf("Keeping the sharded backup %s, %s", backup.Key, pinReason(pin))
+			continue
+		}
+
+		log.Info().Msgf("Deleting the sharded backup %s, %s", backup.Key, backup.Reason)
+		objectsToDelete = append(objectsToDelete, objectsByBackup[backup.Key]...)
+	}
+
+	return s3Service.Delete(ctx, command.S3.Bucket, objectsToDelete)
+}
@@ -0,0 +1,176 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+func (command *DatabaseRestoreCommand) RestoreShardedBackup(ctx context.Context) error {
+	s3Service := services.NewS3Service(command.S3)
+	backupPrefix := helpers.S3ShardedBackupPrefix(command.S3.Prefix) + command.ShardedBackup + "/"
+
+	// ########################
+	// Get the sharded backup info
+	// ########################
+	resp, err := s3Service.Get(ctx, command.S3.Bucket, backupPrefix+helpers.ShardedBackupFileName)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	var shardedBackup models.ShardedBackup
+	if err := json.NewDecoder(resp.Body).Decode(&shardedBackup); err != nil {
+		log.Error().Err(err).Msg("Failed to decode the sharded backup info")
+		return err
+	}
+
+	// ########################
+	// Every shard needs a target, and every target must be allowed
+	// ########################
+	targetServices := make(map[string]*services.MongodbService, len(shardedBackup.Shards))
+	targetFingerprints := make(map[string]*models.ClusterFingerprint, len(shardedBackup.Shards))
+
+	for _, shard := range shardedBackup.Shards {
+		connectionString, exists := command.ShardTargets[shard.Name]
+		if !exists {
+			err := fmt.Errorf("no target provided for shard %s, add it to --shard-targets", shard.Name)
+			log.Error().Err(err).Send()
+			return err
+		}
+
+		if targetServices[shard.Name], err = services.NewMongodbService(connectionString, ctx); err != nil {
+			return err
+		}
+
+		source := &models.ClusterFingerprint{ReplicaSetName: shard.ReplicaSetName, Hosts: shard.Hosts}
+		if err := guardRestoreTarget(ctx, targetServices[shard.Name], &command.Mongo, source); err != nil {
+			return err
+		}
+
+		if targetFingerprints[shard.Name], err = targetServices[shard.Name].Fingerprint(ctx); err != nil {
+			return err
+		}
+	}
+
+	// ########################
+	// Restore every shard to the common cluster time
+	// ########################
+	for _, shard := range shardedBackup.Shards {
+		if err := command.restoreShard(ctx, s3Service, shard, shardedBackup); err != nil {
+			return err
+		}
+	}
+
+	// ########################
+	// Point the config server at the restored shards
+	// ########################
+	configService := targetServices["config"]
+
+	for _, shard := range shardedBackup.Shards {
+		if shard.IsConfigServer {
+			continue
+		}
+
+		target := targetFingerprints[shard.Name]
+		host := fmt.Sprintf("%s/%s", target.ReplicaSetName, strings.Join(target.Hosts, ","))
+
+		if err := configService.UpdateShardHost(ctx, shard.Name, host); err != nil {
+			return err
+		}
+	}
+
+	log.Info().Msgf("Sharded backup %s restored to cluster time %d:%d", shardedBackup.Id, shardedBackup.ClusterTime.T, shardedBackup.ClusterTime.I)
+	return nil
+}
+
+func (command *DatabaseRestoreCommand) restoreShard(ctx context.Context, s3Service *services.S3Service, shard models.ShardBackup, shardedBackup models.ShardedBackup) error {
+	log.Info().Msgf("Restoring shard %s", shard.Name)
+
+	shardFlags := command.Mongo
+	shardFlags.ConnectionString = command.ShardTargets[shard.Name]
+	shardFlags.BackupDir = filepath.Join(command.Mongo.BackupDir, shard.Name)
+	shardFlags.NamespaceOptions.Database = ""
+	shardFlags.NamespaceOptions.Collection = ""
+	shardFlags.NamespaceOptions.NSInclude = nil
+	shardFlags.NamespaceOptions.NSExclude = nil
+
+	// ########################
+	// Restore the shard archive
+	// ########################
+	archive, err := s3Service.Get(ctx, command.S3.Bucket, shard.ArchiveKey)
+	if err != nil {
+		return err
+	}
+
+	if err := helpers.WriteToFile(archive.Body, archive.ContentLength, shardFlags.BackupDir, "archive"); err != nil {
+		return err
+	}
+
+	archiveReader, err := helpers.OpenArchive(filepath.Join(shardFlags.BackupDir, "archive"))
+	if err != nil {
+		return err
+	}
+
+	defer archiveReader.Close()
+
+	mongoRestore, err := shardFlags.PrepareBackupMongoRestoreOptions(archiveReader, false, "")
+	if err != nil {
+		log.Err(err).Msgf("Failed to prepare the restore options of shard %s", shard.Name)
+		return err
+	}
+
+	result := mongoRestore.Restore()
+
+	if result.Err != nil {
+		log.Err(result.Err).Msgf("Failed to restore shard %s", shard.Name)
+		return result.Err
+	}
+
+	log.Info().Msgf("Shard %s: successfully restored %d, failed to restore %d", shard.Name, result.Successes, result.Failures)
+
+	// ########################
+	// Replay the shard oplog up to the cluster time
+	// ########################
+	oplog, err := s3Service.Get(ctx, command.S3.Bucket, shard.OplogKey)
+	if err != nil {
+		return err
+	}
+
+	downloadsDir := filepath.Join(shardFlags.BackupDir, "downloads")
+	restoreDir := filepath.Join(shardFlags.BackupDir, "toBeRestored")
+
+	if err := helpers.WriteToFile(oplog.Body, oplog.ContentLength, downloadsDir, "oplog.tar.gz"); err != nil {
+		return err
+	}
+
+	if err := helpers.ExtractOplogSegment(filepath.Join(downloadsDir, "oplog.tar.gz"), filepath.Join(restoreDir, "local")); err != nil {
+		return err
+	}
+
+	oplogOptions, err := shardFlags.PrepareOplogMongoRestoreOptions(restoreDir, helpers.OplogLimitAfter(shardedBackup.ClusterTime))
+	if err != nil {
+		return err
+	}
+
+	if result := oplogOptions.Restore(); result.Err != nil {
+		log.Err(result.Err).Msgf("Failed to replay the oplog of shard %s", shard.Name)
+		return result.Err
+	}
+
+	if err := os.RemoveAll(shardFlags.BackupDir); err != nil {
+		log.Error().Err(err).Msgf("failed to remove %s", shardFlags.BackupDir)
+	}
+
+	log.Info().Msgf("Shard %s restored", shard.Name)
+	return nil
+}
@@ -0,0 +1,44 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/ditkrg/mongodb-backup/internal/flags"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/ditkrg/mongodb-backup/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+func guardRestoreTarget(ctx context.Context, mongodbService *services.MongodbService, mongoFlags *flags.MongoRestoreFlags, source *models.ClusterFingerprint) error {
+	target, err := mongodbService.Fingerprint(ctx)
+	if err != nil {
+		return err
+	}
+
+	// ######################
+	// The target must be allowed or confirmed
+	// ######################
+	isAllowed := slices.Contains(mongoFlags.TargetOptions.AllowedTargets, target.Id())
+	confirmTarget := mongoFlags.TargetOptions.ConfirmTarget
+	isConfirmed := confirmTarget != "" && (confirmTarget == target.ReplicaSetName || confirmTarget == target.Id())
+
+	if !isAllowed && !isConfirmed {
+		err := fmt.Errorf("refusing to restore into cluster %s (replica set %q), add it to --allowed-targets or pass --confirm-target with the replica set name or the fingerprint", target.Id(), target.ReplicaSetName)
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	// ######################
+	// The target must not be the source unless allowed
+	// ######################
+	if source != nil && source.IsSameCluster(target) && !mongoFlags.TargetOptions.AllowSameCluster {
+		err := fmt.Errorf("refusing to restore into cluster %s as the backup was taken from it, pass --allow-same-cluster to allow it", target.Id())
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	log.Info().Msgf("Restore target %s is allowed", target.Id())
+	return nil
+}
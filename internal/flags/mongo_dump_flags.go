@@ -1,23 +1,31 @@
 package flags
 
 import (
-	"fmt"
+	"slices"
 	"strings"
-	"time"
 
 	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
 	"github.com/mongodb/mongo-tools/common/options"
 	"github.com/mongodb/mongo-tools/mongodump"
 	"github.com/rs/zerolog/log"
 )
 
+// the collections mongodump keeps the users and roles in
+var usersAndRolesCollections = []string{"system.users", "system.roles", "system.version"}
+
 type MongoDumpFlags struct {
 	ConnectionString string `env:"CONNECTION_STRING" required:"" help:"The connection to the MongoDB instance to dump from"`
 	BackupDir        string `env:"BACKUP_DIR" default:"/backup" help:"The directory to store the backup"`
 
 	NamespaceOptions struct {
-		Database   string `env:"DATABASE" help:"The database to dump"`
-		Collection string `env:"COLLECTION" help:"The collection to dump"`
+		Database          string   `env:"DATABASE" help:"The database to dump"`
+		Collection        string   `env:"COLLECTION" help:"The collection to dump"`
+		AllDatabases      bool     `env:"ALL_DATABASES" help:"Dump every database into its own database backup"`
+		IncludeDatabases  []string `env:"INCLUDE_DATABASES" help:"Glob or /regex/ patterns of the databases to dump, all of them by default"`
+		ExcludeDatabases  []string `env:"EXCLUDE_DATABASES" help:"Glob or /regex/ patterns of the databases to leave out of the dump"`
+		IncludeNamespaces []string `env:"INCLUDE_NAMESPACES" help:"Glob or /regex/ patterns of the namespaces (database.collection) to dump, all of them by default"`
+		ExcludeNamespaces []string `env:"EXCLUDE_NAMESPACES" help:"Glob or /regex/ patterns of the namespaces (database.collection) to leave out of the dump"`
 	} `embed:"" group:"namespace options"`
 
 	QueryOptions struct {
@@ -27,16 +35,45 @@ type MongoDumpFlags struct {
 	} `embed:"" group:"query options"`
 
 	OutputOptions struct {
-		Gzip                       bool     `env:"GZIP" negatable:"" default:"true" help:"Compress the backup using gzip"`
+		Compression                string   `env:"COMPRESSION" enum:"gzip,zstd,none" default:"gzip" help:"How the backup archive is compressed, gzip, zstd or none (Default: gzip)"`
+		CompressionLevel           int      `env:"COMPRESSION_LEVEL" default:"0" help:"The compression level of the backup archive, 0 uses the default of the compression"`
+		Gzip                       *bool    `env:"GZIP" negatable:"" hidden:"" help:"Deprecated, use --compression. --no-gzip is --compression=none"`
 		OpLog                      bool     `env:"OPLOG" name:"oplog" help:"take an oplog dump"`
+		PointInTime                bool     `env:"POINT_IN_TIME" negatable:"" default:"true" help:"Capture the oplog written during a full dump of a replica set so the backup is consistent as of the end of the dump, standalone servers are dumped without it (Default: true)"`
+		OnOplogGap                 string   `env:"ON_OPLOG_GAP" enum:"fail,full-backup" default:"fail" help:"What an oplog dump does when the oplog no longer reaches back to the previous one, fail or take a new full backup (Default: fail)"`
+		OplogCompression           string   `env:"OPLOG_COMPRESSION" enum:"gzip,zstd,none" default:"gzip" help:"How oplog backups are compressed, gzip, zstd or none (Default: gzip)"`
+		OplogCompressionLevel      int      `env:"OPLOG_COMPRESSION_LEVEL" default:"0" help:"The compression level of oplog backups, 0 uses the default of the compression"`
 		DumpDBUsersAndRoles        bool     `env:"DUMP_DB_USERS_AND_ROLES" help:"Dump the users and roles in the database"`
 		SkipUsersAndRoles          bool     `env:"SKIP_USERS_AND_ROLES" help:"Skip dumping the users and roles in the database"`
 		ExcludedCollections        []string `env:"EXCLUDED_COLLECTIONS" help:"The collections to exclude from the dump"`
 		ExcludedCollectionPrefixes []string `env:"EXCLUDED_COLLECTION_PREFIXES" help:"The collection prefixes to exclude from the dump"`
 		NumParallelCollections     int      `env:"NUM_PARALLEL_COLLECTIONS" default:"1" help:"The number of collections to dump in parallel"`
+		NumParallelDatabases       int      `env:"NUM_PARALLEL_DATABASES" default:"2" help:"The number of databases to dump in parallel with --all-databases"`
+		RecordDbHash               bool     `env:"RECORD_DB_HASH" help:"Record the dbHash of every collection in the backup manifest"`
 	} `embed:"" group:"output options"`
 
-	KeepRecentN int `env:"KEEP_RECENT_N" default:"10" help:"The number of collections to dump in parallel"`
+	Sharded bool `env:"SHARDED" help:"Take a consistent backup of every shard and the config server of a sharded cluster, the connection string must point at a mongos"`
+
+	Class string `env:"CLASS" enum:"scheduled,manual,pre-deploy" default:"scheduled" help:"The class of the backup, every class has its own retention policy, scheduled, manual or pre-deploy (Default: scheduled)"`
+	Note  string `env:"NOTE" help:"A note stored with the backup, e.g. why it was taken"`
+
+	Retention      RetentionFlags      `embed:"" group:"retention options"`
+	ClassRetention ClassRetentionFlags `embed:""`
+}
+
+// ApplyDeprecatedFlags maps the flags that were replaced onto the ones that replaced them
+func (o *MongoDumpFlags) ApplyDeprecatedFlags() {
+	if o.OutputOptions.Gzip == nil {
+		return
+	}
+
+	if *o.OutputOptions.Gzip {
+		log.Warn().Msgf("--gzip and MONGO_DUMP__GZIP are deprecated, use --compression, the archive is compressed with %s", o.OutputOptions.Compression)
+		return
+	}
+
+	log.Warn().Msg("--no-gzip and MONGO_DUMP__GZIP=false are deprecated, use --compression=none, the archive is not compressed")
+	o.OutputOptions.Compression = helpers.CompressionNone
 }
 
 func (o *MongoDumpFlags) PrepareMongoDump() (*mongodump.MongoDump, error) {
@@ -44,6 +81,10 @@ func (o *MongoDumpFlags) PrepareMongoDump() (*mongodump.MongoDump, error) {
 
 	o.BackupDir = strings.TrimSuffix(o.BackupDir, "/")
 
+	if err := o.ValidateNamespacePatterns(); err != nil {
+		return nil, err
+	}
+
 	inputOptions := &mongodump.InputOptions{
 		Query:          o.QueryOptions.Query,
 		QueryFile:      o.QueryOptions.QueryFile,
@@ -51,9 +92,10 @@ func (o *MongoDumpFlags) PrepareMongoDump() (*mongodump.MongoDump, error) {
 	}
 
 	outputOptions := &mongodump.OutputOptions{
-		Archive:                    fmt.Sprintf("%s/dump_%d", o.BackupDir, time.Now().Unix()),
+		// the archive is written to the OutputWriter of the dump, which compresses it as it is written
+		Archive:                    "-",
 		NumParallelCollections:     o.OutputOptions.NumParallelCollections,
-		Gzip:                       o.OutputOptions.Gzip,
+		Oplog:                      o.OutputOptions.PointInTime && o.NamespaceOptions.Database == "",
 		DumpDBUsersAndRoles:        o.OutputOptions.DumpDBUsersAndRoles,
 		ExcludedCollections:        o.OutputOptions.ExcludedCollections,
 		ExcludedCollectionPrefixes: o.OutputOptions.ExcludedCollectionPrefixes,
@@ -66,6 +108,7 @@ func (o *MongoDumpFlags) PrepareMongoDump() (*mongodump.MongoDump, error) {
 	if o.OutputOptions.OpLog {
 		outputOptions.Archive = ""
 		outputOptions.Out = o.BackupDir
+		outputOptions.Oplog = false
 		outputOptions.DumpDBUsersAndRoles = false
 		toolOptions.Namespace = &options.Namespace{DB: "local", Collection: "oplog.rs"}
 	}
@@ -91,3 +134,90 @@ func (o *MongoDumpFlags) PrepareMongoDump() (*mongodump.MongoDump, error) {
 	log.Info().Msg("Prepared mongodump")
 	return mongodump, nil
 }
+
+func (o *MongoDumpFlags) IsNamespaceIncluded(database string, collection string) bool {
+	if o.NamespaceOptions.Database != "" && o.NamespaceOptions.Database != database {
+		return false
+	}
+
+	if o.NamespaceOptions.Collection != "" && o.NamespaceOptions.Collection != collection {
+		return false
+	}
+
+	if slices.Contains(o.OutputOptions.ExcludedCollections, collection) {
+		return false
+	}
+
+	for _, prefix := range o.OutputOptions.ExcludedCollectionPrefixes {
+		if strings.HasPrefix(collection, prefix) {
+			return false
+		}
+	}
+
+	if !o.IsDatabaseIncluded(database) {
+		return false
+	}
+
+	namespace := database + "." + collection
+
+	if len(o.NamespaceOptions.IncludeNamespaces) > 0 && !helpers.MatchAnyPattern(o.NamespaceOptions.IncludeNamespaces, namespace) {
+		return false
+	}
+
+	return !helpers.MatchAnyPattern(o.NamespaceOptions.ExcludeNamespaces, namespace)
+}
+
+// IsDumpedNamespaceIncluded is IsNamespaceIncluded for what mongodump writes, users and roles are only left out with their database
+func (o *MongoDumpFlags) IsDumpedNamespaceIncluded(database string, collection string) bool {
+	if slices.Contains(usersAndRolesCollections, strings.TrimPrefix(collection, "$admin.")) {
+		return (o.NamespaceOptions.Database == "" || o.NamespaceOptions.Database == database) && o.IsDatabaseIncluded(database)
+	}
+
+	return o.IsNamespaceIncluded(database, collection)
+}
+
+// IsDatabaseIncluded reports whether the database matches the include and exclude database patterns
+func (o *MongoDumpFlags) IsDatabaseIncluded(database string) bool {
+	if len(o.NamespaceOptions.IncludeDatabases) > 0 && !helpers.MatchAnyPattern(o.NamespaceOptions.IncludeDatabases, database) {
+		return false
+	}
+
+	return !helpers.MatchAnyPattern(o.NamespaceOptions.ExcludeDatabases, database)
+}
+
+// HasNamespacePatterns reports whether the dump is narrowed down by database or namespace patterns
+func (o *MongoDumpFlags) HasNamespacePatterns() bool {
+	return len(o.NamespaceOptions.IncludeDatabases) > 0 || len(o.NamespaceOptions.ExcludeDatabases) > 0 ||
+		len(o.NamespaceOptions.IncludeNamespaces) > 0 || len(o.NamespaceOptions.ExcludeNamespaces) > 0
+}
+
+func (o *MongoDumpFlags) ValidateNamespacePatterns() error {
+	patterns := slices.Concat(
+		o.NamespaceOptions.IncludeDatabases,
+		o.NamespaceOptions.ExcludeDatabases,
+		o.NamespaceOptions.IncludeNamespaces,
+		o.NamespaceOptions.ExcludeNamespaces,
+	)
+
+	for _, pattern := range patterns {
+		if err := helpers.ValidatePattern(pattern); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NamespaceFilter is the record of the patterns kept in the backup manifest, nil without patterns
+func (o *MongoDumpFlags) NamespaceFilter() *models.NamespaceFilter {
+	if !o.HasNamespacePatterns() {
+		return nil
+	}
+
+	return &models.NamespaceFilter{
+		IncludeDatabases:  o.NamespaceOptions.IncludeDatabases,
+		ExcludeDatabases:  o.NamespaceOptions.ExcludeDatabases,
+		IncludeNamespaces: o.NamespaceOptions.IncludeNamespaces,
+		ExcludeNamespaces: o.NamespaceOptions.ExcludeNamespaces,
+	}
+}
@@ -1,11 +1,14 @@
 package flags
 
 import (
-	"strconv"
-	"time"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 
 	"github.com/mongodb/mongo-tools/common/options"
 	"github.com/mongodb/mongo-tools/mongorestore"
+	"github.com/mongodb/mongo-tools/mongorestore/ns"
 	"github.com/rs/zerolog/log"
 )
 
@@ -35,26 +38,50 @@ type MongoRestoreFlags struct {
 		BypassDocumentValidation bool   `env:"BYPASS_DOCUMENT_VALIDATION" help:"Bypass document validation"`
 		PreserveUUID             bool   `env:"PRESERVE_UUID" help:"preserve original collection UUIDs (requires drop)"`
 		FixDottedHashedIndexes   bool   `env:"FIX_DOTTED_HASHED_INDEXES" help:"when enabled, all the hashed indexes on dotted fields will be created as single field ascending indexes on the destination"`
+		PreRestoreSnapshot       bool   `env:"PRE_RESTORE_SNAPSHOT" help:"Dump the namespaces that are about to be dropped to S3 before restoring (requires --drop)"`
 	} `embed:"" group:"restore options"`
 
 	InputOptions struct {
 		ObjectCheck            bool   `env:"OBJECT_CHECK" negatable:"" default:"true" help:"validate all objects before inserting (Default: true)"`
 		OplogReplay            bool   `env:"OPLOG_REPLAY" negatable:"" default:"true" help:"replay the oplog backups (Default: true)"`
-		OplogLimit             string `env:"OPLOG_LIMIT_TO" help:"The End time of the OpLog restore."`
-		Gzip                   bool   `env:"GZIP" negatable:"" default:"true" help:"Whether the backup is gzipped (Default: true)"`
+		OplogLimit             string `env:"OPLOG_LIMIT_TO" help:"The End time of the OpLog restore, a time or the timestamp of an oplog entry (seconds:increment) to replay every entry before it."`
+		Gzip                   *bool  `env:"GZIP" negatable:"" hidden:"" help:"Deprecated, the compression of the backup is detected from its content"`
 		RestoreDBUsersAndRoles bool   `env:"RESTORE_DB_USERS_AND_ROLES" help:"restore user and role definitions for the given database"`
 		SkipUsersAndRoles      bool   `env:"SKIP_USERS_AND_ROLES" help:"Skip restoring users and roles, regardless of namespace, when true"`
 	} `embed:"" group:"restore options"`
+
+	ValidationOptions struct {
+		Validate       bool `env:"VALIDATE" negatable:"" default:"true" help:"Validate the restored namespaces against the backup manifest (Default: true)"`
+		ValidateDbHash bool `env:"VALIDATE_DB_HASH" help:"Also compare the dbHash of every restored collection when no oplog is replayed"`
+	} `embed:"" group:"validation options"`
+
+	TargetOptions struct {
+		AllowedTargets   []string `env:"ALLOWED_TARGETS" help:"Fingerprints of the clusters that are allowed to be restored to"`
+		ConfirmTarget    string   `env:"CONFIRM_TARGET" help:"The replica set name or the fingerprint of the target, confirms restoring to a cluster that is not in the allowed targets"`
+		AllowSameCluster bool     `env:"ALLOW_SAME_CLUSTER" help:"Allow restoring a backup into the cluster it was taken from"`
+	} `embed:"" group:"target options"`
 }
 
-func (o *MongoRestoreFlags) PrepareBackupMongoRestoreOptions(filePath string) (*mongorestore.MongoRestore, error) {
+// WarnDeprecatedFlags warns about the flags that no longer do anything
+func (o *MongoRestoreFlags) WarnDeprecatedFlags() {
+	if o.InputOptions.Gzip != nil {
+		log.Warn().Msg("--gzip and MONGO_RESTORE__GZIP are deprecated and ignored, the compression of the backup is detected from its content")
+	}
+}
+
+// PrepareBackupMongoRestoreOptions restores the archive read from archiveReader, which must already be decompressed
+func (o *MongoRestoreFlags) PrepareBackupMongoRestoreOptions(archiveReader io.Reader, oplogReplay bool, oplogLimit string) (*mongorestore.MongoRestore, error) {
 	log.Info().Msg("preparing mongodb restore options")
 
 	inputOptions := &mongorestore.InputOptions{
-		Archive:                filePath,
+		Archive:                "-",
 		Objcheck:               o.InputOptions.ObjectCheck,
-		Gzip:                   o.InputOptions.Gzip,
 		RestoreDBUsersAndRoles: o.InputOptions.RestoreDBUsersAndRoles,
+		OplogReplay:            oplogReplay,
+	}
+
+	if oplogReplay {
+		inputOptions.OplogLimit = oplogLimit
 	}
 
 	outputOptions := &mongorestore.OutputOptions{
@@ -103,6 +130,7 @@ func (o *MongoRestoreFlags) PrepareBackupMongoRestoreOptions(filePath string) (*
 		return nil, err
 	}
 	mongorestore.SkipUsersAndRoles = o.InputOptions.SkipUsersAndRoles
+	mongorestore.InputReader = archiveReader
 
 	if err := mongorestore.ParseAndValidateOptions(); err != nil {
 		log.Err(err).Msg("Failed to parse and validate options")
@@ -112,19 +140,20 @@ func (o *MongoRestoreFlags) PrepareBackupMongoRestoreOptions(filePath string) (*
 	return mongorestore, nil
 }
 
-func (o *MongoRestoreFlags) PrepareOplogMongoRestoreOptions(backupDir string, to *time.Time) (*mongorestore.MongoRestore, error) {
+func (o *MongoRestoreFlags) PrepareOplogMongoRestoreOptions(backupDir string, oplogLimit string) (*mongorestore.MongoRestore, error) {
 	log.Info().Msg("preparing mongodb oplog restore options")
 
+	// oplog backups taken before they were compressed as a whole hold gzipped entries
+	_, err := os.Stat(filepath.Join(backupDir, "local", "oplog.rs.bson.gz"))
+	isGzip := err == nil
+
 	inputOptions := &mongorestore.InputOptions{
 		Directory: backupDir,
 		// RestoreDBUsersAndRoles: o.RestoreDBUsersAndRoles,
 		Objcheck:    o.InputOptions.ObjectCheck,
-		Gzip:        o.InputOptions.Gzip,
+		Gzip:        isGzip,
 		OplogReplay: true,
-	}
-
-	if to != nil {
-		inputOptions.OplogLimit = strconv.FormatInt(to.Unix(), 10)
+		OplogLimit:  oplogLimit,
 	}
 
 	outputOptions := &mongorestore.OutputOptions{
@@ -180,3 +209,35 @@ func (o *MongoRestoreFlags) PrepareOplogMongoRestoreOptions(backupDir string, to
 	log.Info().Msg("finished preparing oplog mongodb restore options")
 	return mongorestore, nil
 }
+
+func (o *MongoRestoreFlags) NamespaceMatcher() (func(namespace string) bool, error) {
+	includes := o.NamespaceOptions.NSInclude
+
+	if o.NamespaceOptions.Database != "" {
+		collection := "*"
+		if o.NamespaceOptions.Collection != "" {
+			collection = ns.Escape(o.NamespaceOptions.Collection)
+		}
+		includes = []string{fmt.Sprintf("%s.%s", ns.Escape(o.NamespaceOptions.Database), collection)}
+	}
+
+	if len(includes) == 0 {
+		includes = []string{"*"}
+	}
+
+	includer, err := ns.NewMatcher(includes)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to parse the include namespaces")
+		return nil, err
+	}
+
+	excluder, err := ns.NewMatcher(o.NamespaceOptions.NSExclude)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to parse the exclude namespaces")
+		return nil, err
+	}
+
+	return func(namespace string) bool {
+		return includer.Has(namespace) && !excluder.Has(namespace)
+	}, nil
+}
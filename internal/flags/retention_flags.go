@@ -0,0 +1,59 @@
+package flags
+
+import (
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
+	"github.com/ditkrg/mongodb-backup/internal/models"
+)
+
+type RetentionFlags struct {
+	KeepRecentN int    `env:"KEEP_RECENT_N" default:"10" help:"The number of most recent backups to keep, 0 with no other rule keeps every backup"`
+	KeepDaily   int    `env:"KEEP_DAILY" help:"The number of days to keep the newest backup of"`
+	KeepWeekly  int    `env:"KEEP_WEEKLY" help:"The number of weeks to keep the newest backup of"`
+	KeepMonthly int    `env:"KEEP_MONTHLY" help:"The number of months to keep the newest backup of"`
+	KeepYearly  int    `env:"KEEP_YEARLY" help:"The number of years to keep the newest backup of"`
+	MaxAge      string `env:"MAX_AGE" help:"Delete the backups older than this even when a rule keeps them, e.g. 90d, 12w or 36h"`
+	MinCount    int    `env:"MIN_COUNT" default:"1" help:"The number of most recent backups that are always kept (Default: 1)"`
+	OplogMaxAge string `env:"OPLOG_MAX_AGE" help:"How far back point-in-time restores reach, e.g. 14d, by default oplog backups are kept back to the oldest backup kept"`
+}
+
+// ClassRetentionFlags holds the retention policies of the backups taken on demand,
+// they are kept apart from the scheduled backups so they never push them out
+type ClassRetentionFlags struct {
+	Manual    RetentionFlags `embed:"" prefix:"manual-" envprefix:"MANUAL_" group:"manual backup retention options"`
+	PreDeploy RetentionFlags `embed:"" prefix:"pre-deploy-" envprefix:"PRE_DEPLOY_" group:"pre-deploy backup retention options"`
+}
+
+// For returns the retention flags of a class of backups, scheduled backups use the common retention flags
+func (o *ClassRetentionFlags) For(class string, scheduled RetentionFlags) RetentionFlags {
+	switch class {
+	case models.BackupClassManual:
+		return o.Manual
+	case models.BackupClassPreDeploy:
+		return o.PreDeploy
+	default:
+		return scheduled
+	}
+}
+
+func (o *RetentionFlags) Policy() (models.RetentionPolicy, error) {
+	policy := models.RetentionPolicy{
+		KeepLast:    o.KeepRecentN,
+		KeepDaily:   o.KeepDaily,
+		KeepWeekly:  o.KeepWeekly,
+		KeepMonthly: o.KeepMonthly,
+		KeepYearly:  o.KeepYearly,
+		MinCount:    o.MinCount,
+	}
+
+	var err error
+
+	if policy.MaxAge, err = helpers.ParseAge(o.MaxAge); err != nil {
+		return policy, err
+	}
+
+	if policy.OplogMaxAge, err = helpers.ParseAge(o.OplogMaxAge); err != nil {
+		return policy, err
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,80 @@
+package helpers
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/mongodb/mongo-tools/common/archive"
+	"github.com/rs/zerolog/log"
+)
+
+type archiveReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (reader *archiveReader) Close() error {
+	return errors.Join(reader.ReadCloser.Close(), reader.file.Close())
+}
+
+// OpenArchive opens a local archive and decompresses it with the compression detected from its content
+func OpenArchive(filePath string) (io.ReadCloser, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to open %s", filePath)
+		return nil, err
+	}
+
+	reader, err := NewDecompressionReader(file)
+	if err != nil {
+		file.Close()
+		log.Error().Err(err).Msgf("Failed to open the decompression reader for %s", filePath)
+		return nil, err
+	}
+
+	return &archiveReader{ReadCloser: reader, file: file}, nil
+}
+
+func ReadArchivePrelude(filePath string) (*archive.Prelude, error) {
+	log.Info().Msgf("Reading archive prelude of %s", filePath)
+
+	reader, err := OpenArchive(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	prelude := &archive.Prelude{}
+	if err := prelude.Read(reader); err != nil {
+		log.Error().Err(err).Msgf("Failed to read archive prelude of %s", filePath)
+		return nil, err
+	}
+
+	log.Info().Msgf("Archive %s contains %d namespaces", filePath, len(prelude.NamespaceMetadatas))
+	return prelude, nil
+}
+
+// mongodump stores the oplog captured during the dump as a namespace without a database
+func PreludeHasOplog(prelude *archive.Prelude) bool {
+	for _, metadata := range prelude.NamespaceMetadatas {
+		if metadata.Database == "" && metadata.Collection == "oplog" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func PreludeDatabases(prelude *archive.Prelude) []string {
+	databases := make([]string, 0, len(prelude.DBS))
+
+	for _, database := range prelude.DBS {
+		if database != "" {
+			databases = append(databases, database)
+		}
+	}
+
+	return databases
+}
@@ -0,0 +1,116 @@
+package helpers
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mongodb/mongo-tools/common/archive"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ReadArchiveDocuments reads a mongodump archive as it streams in and returns the documents of a collection
+// the filter matches, along with the entries of the oplog captured during the dump that change the collection and every command
+func ReadArchiveDocuments(in io.Reader, database string, collection string, filter *DocumentFilter) ([]bson.Raw, []bson.Raw, error) {
+	prelude := &archive.Prelude{}
+	if err := prelude.Read(in); err != nil {
+		log.Error().Err(err).Msg("Failed to read the archive prelude")
+		return nil, nil, err
+	}
+
+	found := false
+
+	for _, metadata := range prelude.NamespaceMetadatas {
+		if metadata.Database != database || metadata.Collection != collection {
+			continue
+		}
+
+		if metadata.Type != "" && metadata.Type != "collection" {
+			err := fmt.Errorf("%s.%s is a %s, only the documents of collections can be recovered", database, collection, metadata.Type)
+			log.Error().Err(err).Send()
+			return nil, nil, err
+		}
+
+		found = true
+	}
+
+	if !found {
+		err := fmt.Errorf("the backup does not hold %s.%s", database, collection)
+		log.Error().Err(err).Send()
+		return nil, nil, err
+	}
+
+	// ######################
+	// Keep the matching documents, every other namespace is skipped as it streams by
+	// ######################
+	parser := &archive.Parser{In: in}
+	reader := &archiveDocumentReader{
+		database:   database,
+		collection: collection,
+		namespace:  database + "." + collection,
+		filter:     filter,
+	}
+
+	for {
+		err := parser.ReadBlock(reader)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read the archive")
+			return nil, nil, err
+		}
+	}
+
+	return reader.documents, reader.oplog, nil
+}
+
+// archiveDocumentReader consumes the blocks of an archive and keeps the documents of a collection a filter matches
+type archiveDocumentReader struct {
+	database   string
+	collection string
+	namespace  string
+	filter     *DocumentFilter
+
+	isCollection bool
+	isOplog      bool
+
+	documents []bson.Raw
+	oplog     []bson.Raw
+}
+
+func (reader *archiveDocumentReader) HeaderBSON(data []byte) error {
+	header := archive.NamespaceHeader{}
+	if err := bson.Unmarshal(data, &header); err != nil {
+		return err
+	}
+
+	reader.isCollection = header.Database == reader.database && header.Collection == reader.collection
+	reader.isOplog = header.Database == "" && header.Collection == "oplog"
+	return nil
+}
+
+func (reader *archiveDocumentReader) BodyBSON(data []byte) error {
+	switch {
+	case reader.isCollection:
+		if reader.filter.Match(data) {
+			// the parser reuses its buffer for the next document
+			reader.documents = append(reader.documents, bson.Raw(append([]byte(nil), data...)))
+		}
+	case reader.isOplog:
+		// every command is kept, DocumentRecovery decides which ones drop or rename the collection away
+		namespace, _ := bson.Raw(data).Lookup("ns").StringValueOK()
+		op, _ := bson.Raw(data).Lookup("op").StringValueOK()
+
+		if op == "c" || namespace == reader.namespace {
+			reader.oplog = append(reader.oplog, bson.Raw(append([]byte(nil), data...)))
+		}
+	}
+
+	return nil
+}
+
+func (reader *archiveDocumentReader) End() error {
+	return nil
+}
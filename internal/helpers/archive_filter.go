@@ -0,0 +1,182 @@
+package helpers
+
+import (
+	"hash"
+	"hash/crc64"
+	"io"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/archive"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// every block of an archive ends with a four byte terminator
+var archiveTerminator = []byte{0xFF, 0xFF, 0xFF, 0xFF}
+
+// FilterArchive copies a mongodump archive, leaving out the namespaces that are not included
+// along with the entries of the oplog captured during the dump that change them
+func FilterArchive(in io.Reader, out io.Writer, isIncluded func(database string, collection string) bool) error {
+	// ######################
+	// The prelude only lists the included namespaces
+	// ######################
+	prelude := &archive.Prelude{}
+	if err := prelude.Read(in); err != nil {
+		log.Error().Err(err).Msg("Failed to read the archive prelude")
+		return err
+	}
+
+	filteredPrelude := &archive.Prelude{Header: prelude.Header}
+
+	for _, metadata := range prelude.NamespaceMetadatas {
+		if metadata.Database == "" || isIncluded(metadata.Database, metadata.Collection) {
+			filteredPrelude.AddMetadata(metadata)
+		}
+	}
+
+	if err := filteredPrelude.Write(out); err != nil {
+		log.Error().Err(err).Msg("Failed to write the archive prelude")
+		return err
+	}
+
+	log.Info().Msgf("Keeping %d of the %d namespaces of the archive", len(filteredPrelude.NamespaceMetadatas), len(prelude.NamespaceMetadatas))
+
+	// ######################
+	// Copy the blocks of the included namespaces
+	// ######################
+	parser := &archive.Parser{In: in}
+	filter := &archiveFilter{
+		out:        out,
+		isIncluded: isIncluded,
+		oplogHash:  crc64.New(crc64.MakeTable(crc64.ECMA)),
+	}
+
+	for {
+		err := parser.ReadBlock(filter)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to filter the archive")
+			return err
+		}
+
+		if filter.keep {
+			if _, err := out.Write(archiveTerminator); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// archiveFilter consumes the blocks of an archive and writes the ones of the included namespaces
+type archiveFilter struct {
+	out        io.Writer
+	isIncluded func(database string, collection string) bool
+	keep       bool
+	isOplog    bool
+
+	// the oplog loses the entries of the namespaces left out, so its checksum is computed again
+	oplogHash hash.Hash64
+}
+
+func (filter *archiveFilter) HeaderBSON(data []byte) error {
+	header := archive.NamespaceHeader{}
+	if err := bson.Unmarshal(data, &header); err != nil {
+		return err
+	}
+
+	filter.isOplog = header.Database == "" && header.Collection == "oplog"
+	filter.keep = header.Database == "" || filter.isIncluded(header.Database, header.Collection)
+
+	if !filter.keep {
+		return nil
+	}
+
+	if filter.isOplog && header.EOF {
+		header.CRC = int64(filter.oplogHash.Sum64())
+
+		var err error
+		if data, err = bson.Marshal(&header); err != nil {
+			return err
+		}
+	}
+
+	_, err := filter.out.Write(data)
+	return err
+}
+
+func (filter *archiveFilter) BodyBSON(data []byte) error {
+	if !filter.keep {
+		return nil
+	}
+
+	if filter.isOplog {
+		entry, keep, err := filterOplogEntry(data, filter.isIncluded)
+		if err != nil || !keep {
+			return err
+		}
+
+		data = entry
+		filter.oplogHash.Write(data)
+	}
+
+	_, err := filter.out.Write(data)
+	return err
+}
+
+func (filter *archiveFilter) End() error {
+	return nil
+}
+
+// filterOplogEntry returns the oplog entry when it changes an included namespace,
+// a transaction only keeps its operations on the included namespaces
+func filterOplogEntry(data []byte, isIncluded func(database string, collection string) bool) (bson.Raw, bool, error) {
+	entry := bson.Raw(data)
+
+	if _, ok := entry.Lookup("o", "applyOps").ArrayOK(); !ok {
+		return entry, isOplogEntryIncluded(data, isIncluded), nil
+	}
+
+	return FilterTransactionOperations(entry, func(namespace string) bool {
+		database, collection, _ := strings.Cut(namespace, ".")
+
+		// the commands that do not name a collection are kept, as they are outside of a transaction
+		return collection == "$cmd" || isIncluded(database, collection)
+	})
+}
+
+// isOplogEntryIncluded reports whether an oplog entry changes an included namespace, commands are matched
+// by the namespace they act on, a rename by both of its namespaces and the others by their database
+func isOplogEntryIncluded(data []byte, isIncluded func(database string, collection string) bool) bool {
+	entry := bson.Raw(data)
+
+	namespace, _ := entry.Lookup("ns").StringValueOK()
+	if namespace == "" {
+		return true
+	}
+
+	database, collection, _ := strings.Cut(namespace, ".")
+	if collection != "$cmd" {
+		return isIncluded(database, collection)
+	}
+
+	o, _ := entry.Lookup("o").DocumentOK()
+	command, target := OplogCommandNamespace(namespace, o)
+
+	switch {
+	case command == "renameCollection":
+		to, _ := o.Lookup("to").StringValueOK()
+		return isNamespaceIncluded(target, isIncluded) || isNamespaceIncluded(to, isIncluded)
+	case target == namespace:
+		return isIncluded(database, "")
+	}
+
+	return isNamespaceIncluded(target, isIncluded)
+}
+
+func isNamespaceIncluded(namespace string, isIncluded func(database string, collection string) bool) bool {
+	database, collection, _ := strings.Cut(namespace, ".")
+	return isIncluded(database, collection)
+}
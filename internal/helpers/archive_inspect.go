@@ -0,0 +1,265 @@
+package helpers
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/mongodb/mongo-tools/common/archive"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// the namespaces mongodump keeps the users and roles in, full dumps dump them from admin
+// and database dumps along with the database they belong to
+var usersCollections = []string{"system.users", "$admin.system.users"}
+var rolesCollections = []string{"system.roles", "$admin.system.roles"}
+
+// collectionMetadata is the part of the metadata mongodump keeps for every collection that is inspected
+type collectionMetadata struct {
+	Options bson.D   `bson:"options,omitempty"`
+	Indexes []bson.D `bson:"indexes"`
+}
+
+// InspectArchive reads a mongodump archive as it streams in, the metadata of its collections from the prelude
+// and the number and size of the documents of every namespace from its blocks
+func InspectArchive(in io.Reader) (*models.ArchiveInspection, error) {
+	prelude := &archive.Prelude{}
+	if err := prelude.Read(in); err != nil {
+		log.Error().Err(err).Msg("Failed to read the archive prelude")
+		return nil, err
+	}
+
+	inspection := &models.ArchiveInspection{Databases: make([]models.DatabaseInspection, 0)}
+
+	if prelude.Header != nil {
+		inspection.ServerVersion = prelude.Header.ServerVersion
+		inspection.ToolVersion = prelude.Header.ToolVersion
+	}
+
+	// ######################
+	// The collections, views and indexes from the prelude
+	// ######################
+	for _, metadata := range prelude.NamespaceMetadatas {
+		if metadata.Database == "" {
+			inspection.OplogCaptured = inspection.OplogCaptured || metadata.Collection == "oplog"
+			continue
+		}
+
+		if isUsersOrRolesCollection(metadata.Collection) {
+			inspection.UsersAndRoles.Included = true
+			continue
+		}
+
+		collection, err := inspectCollectionMetadata(metadata)
+		if err != nil {
+			return nil, err
+		}
+
+		i := slices.IndexFunc(inspection.Databases, func(database models.DatabaseInspection) bool { return database.Name == metadata.Database })
+		if i < 0 {
+			inspection.Databases = append(inspection.Databases, models.DatabaseInspection{Name: metadata.Database})
+			i = len(inspection.Databases) - 1
+		}
+
+		inspection.Databases[i].Collections = append(inspection.Databases[i].Collections, collection)
+	}
+
+	// ######################
+	// Count the documents of every namespace
+	// ######################
+	parser := &archive.Parser{In: in}
+	counter := &archiveCounter{inspection: inspection}
+
+	for {
+		err := parser.ReadBlock(counter)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read the archive")
+			return nil, err
+		}
+	}
+
+	return inspection, nil
+}
+
+func isUsersOrRolesCollection(collection string) bool {
+	return slices.Contains(usersCollections, collection) || slices.Contains(rolesCollections, collection) || strings.HasSuffix(collection, "system.version")
+}
+
+func inspectCollectionMetadata(metadata *archive.CollectionMetadata) (models.CollectionInspection, error) {
+	collection := models.CollectionInspection{Name: metadata.Collection, Type: metadata.Type}
+
+	if collection.Type == "" {
+		collection.Type = "collection"
+	}
+
+	if metadata.Metadata == "" {
+		return collection, nil
+	}
+
+	var parsed collectionMetadata
+	if err := bson.UnmarshalExtJSON([]byte(metadata.Metadata), true, &parsed); err != nil {
+		log.Error().Err(err).Msgf("Failed to parse the metadata of %s.%s", metadata.Database, metadata.Collection)
+		return collection, err
+	}
+
+	var err error
+
+	if len(parsed.Options) > 0 {
+		if collection.Options, err = relaxedJSON(parsed.Options); err != nil {
+			return collection, err
+		}
+	}
+
+	for _, index := range parsed.Indexes {
+		inspected := models.IndexInspection{}
+		options := bson.D{}
+
+		for _, field := range index {
+			switch field.Key {
+			case "name":
+				inspected.Name, _ = field.Value.(string)
+			case "key":
+				if inspected.Key, err = relaxedJSON(field.Value); err != nil {
+					return collection, err
+				}
+			case "v", "ns":
+			default:
+				options = append(options, field)
+			}
+		}
+
+		if len(options) > 0 {
+			if inspected.Options, err = relaxedJSON(options); err != nil {
+				return collection, err
+			}
+		}
+
+		collection.Indexes = append(collection.Indexes, inspected)
+	}
+
+	return collection, nil
+}
+
+func relaxedJSON(value interface{}) (json.RawMessage, error) {
+	data, err := bson.MarshalExtJSON(value, false, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to convert the collection metadata to JSON")
+		return nil, err
+	}
+
+	return json.RawMessage(data), nil
+}
+
+// archiveCounter consumes the blocks of an archive and counts the documents of every namespace
+type archiveCounter struct {
+	inspection *models.ArchiveInspection
+	database   string
+	collection string
+
+	// the collection the block that is read belongs to, nil when it is not in the prelude
+	current *models.CollectionInspection
+}
+
+func (counter *archiveCounter) HeaderBSON(data []byte) error {
+	header := archive.NamespaceHeader{}
+	if err := bson.Unmarshal(data, &header); err != nil {
+		return err
+	}
+
+	counter.database = header.Database
+	counter.collection = header.Collection
+	counter.current = counter.findCollection(header.Database, header.Collection)
+
+	// the documents of a time series collection are dumped from its buckets collection
+	if counter.current == nil && strings.HasPrefix(header.Collection, "system.buckets.") {
+		counter.current = counter.findCollection(header.Database, strings.TrimPrefix(header.Collection, "system.buckets."))
+	}
+
+	return nil
+}
+
+func (counter *archiveCounter) findCollection(database string, name string) *models.CollectionInspection {
+	for i := range counter.inspection.Databases {
+		if counter.inspection.Databases[i].Name != database {
+			continue
+		}
+
+		for j := range counter.inspection.Databases[i].Collections {
+			if collection := &counter.inspection.Databases[i].Collections[j]; collection.Name == name {
+				return collection
+			}
+		}
+	}
+
+	return nil
+}
+
+func (counter *archiveCounter) BodyBSON(data []byte) error {
+	switch {
+	case counter.database == "" && counter.collection == "oplog":
+		return counter.countOplogEntry(data)
+	case slices.Contains(usersCollections, counter.collection):
+		counter.inspection.UsersAndRoles.Users++
+	case slices.Contains(rolesCollections, counter.collection):
+		counter.inspection.UsersAndRoles.Roles++
+	case counter.current != nil:
+		counter.current.Documents++
+		counter.current.Size += int64(len(data))
+	}
+
+	return nil
+}
+
+// countOplogEntry counts an entry of the captured oplog, the namespaces its operations write to
+// and records the first and the last timestamp, mongodump writes the oplog in the order of its timestamps
+func (counter *archiveCounter) countOplogEntry(data []byte) error {
+	counter.inspection.OplogEntries++
+
+	entry := bson.Raw(data)
+
+	if t, i, ok := entry.Lookup("ts").TimestampOK(); ok {
+		if counter.inspection.OplogFirst.IsZero() {
+			counter.inspection.OplogFirst = primitive.Timestamp{T: t, I: i}
+		}
+
+		counter.inspection.OplogLast = primitive.Timestamp{T: t, I: i}
+	}
+
+	operations, err := OplogOperations(entry)
+	if err != nil {
+		return err
+	}
+
+	for _, operation := range operations {
+		op, _ := operation.Lookup("op").StringValueOK()
+		namespace, _ := operation.Lookup("ns").StringValueOK()
+
+		switch op {
+		case "n":
+			continue
+		case "c":
+			o, _ := operation.Lookup("o").DocumentOK()
+			_, namespace = OplogCommandNamespace(namespace, o)
+		}
+
+		if counter.inspection.OplogNamespaces == nil {
+			counter.inspection.OplogNamespaces = make(map[string]int64)
+		}
+
+		counter.inspection.OplogNamespaces[namespace]++
+	}
+
+	return nil
+}
+
+func (counter *archiveCounter) End() error {
+	return nil
+}
@@ -0,0 +1,18 @@
+package helpers
+
+import (
+	"strings"
+	"time"
+)
+
+func BackupKeyTime(key string) (time.Time, error) {
+	timeString := key[strings.LastIndex(key, "/")+1:]
+	timeString = TrimArchiveExtension(timeString)
+
+	// keys without a prefix have the backup kind glued to the time
+	if len(timeString) > len(TimeFormat) {
+		timeString = timeString[len(timeString)-len(TimeFormat):]
+	}
+
+	return time.Parse(TimeFormat, timeString)
+}
@@ -0,0 +1,118 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// NewCompressionWriter compresses everything written to it into w, a level of 0 uses the default of the codec
+func NewCompressionWriter(w io.Writer, codec string, level int) (io.WriteCloser, error) {
+	switch codec {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		encoderLevel := zstd.SpeedDefault
+		if level != 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel))
+	case CompressionNone, "":
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", codec)
+	}
+}
+
+// NewDecompressionReader detects the compression of r from its magic bytes, uncompressed data is returned as is
+func NewDecompressionReader(r io.Reader) (io.ReadCloser, error) {
+	bufferedReader := bufio.NewReader(r)
+
+	magic, err := bufferedReader.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, fmt.Errorf("failed to detect the compression: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(bufferedReader)
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(bufferedReader)
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.IOReadCloser(), nil
+	default:
+		return io.NopCloser(bufferedReader), nil
+	}
+}
+
+func ArchiveExtension(codec string) string {
+	switch codec {
+	case CompressionZstd:
+		return ".archive.zst"
+	case CompressionNone:
+		return ".archive"
+	default:
+		return ".archive.gzip"
+	}
+}
+
+func TrimArchiveExtension(fileName string) string {
+	for _, extension := range []string{".archive.gzip", ".archive.zst", ".archive"} {
+		if strings.HasSuffix(fileName, extension) {
+			return strings.TrimSuffix(fileName, extension)
+		}
+	}
+
+	return fileName
+}
+
+func OplogSegmentExtension(codec string) string {
+	switch codec {
+	case CompressionZstd:
+		return ".tar.zst"
+	case CompressionNone:
+		return ".tar"
+	default:
+		return ".tar.gz"
+	}
+}
+
+func TrimOplogSegmentExtension(fileName string) string {
+	for _, extension := range []string{".tar.gz", ".tar.zst", ".tar"} {
+		if strings.HasSuffix(fileName, extension) {
+			return strings.TrimSuffix(fileName, extension)
+		}
+	}
+
+	return fileName
+}
@@ -0,0 +1,45 @@
+package helpers
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+func ParseShardHost(shardHost string) (string, []string) {
+	replicaSet, hosts, found := strings.Cut(shardHost, "/")
+	if !found {
+		return "", strings.Split(shardHost, ",")
+	}
+
+	return replicaSet, strings.Split(hosts, ",")
+}
+
+func ReplicaSetConnectionString(connectionString string, replicaSet string, hosts []string) (string, error) {
+	uri, err := url.Parse(connectionString)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the connection string: %w", err)
+	}
+
+	query := uri.Query()
+
+	// srv records resolve to the mongos hosts, the members are reached directly
+	if uri.Scheme == "mongodb+srv" {
+		uri.Scheme = "mongodb"
+		if !query.Has("tls") && !query.Has("ssl") {
+			query.Set("tls", "true")
+		}
+	}
+
+	query.Del("loadBalanced")
+	query.Del("directConnection")
+
+	if replicaSet != "" {
+		query.Set("replicaSet", replicaSet)
+	}
+
+	uri.Host = strings.Join(hosts, ",")
+	uri.RawQuery = query.Encode()
+
+	return uri.String(), nil
+}
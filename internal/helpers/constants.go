@@ -1,8 +1,12 @@
 package helpers
 
 const (
-	OplogQuery              = "{ \"wall\": { \"$gt\": {\"$date\": \"%s\"}, \"$lte\": {\"$date\": \"%s\"} } }"
+	OplogTimestampQuery     = "{ \"ts\": { \"$gt\": {\"$timestamp\": {\"t\": %d, \"i\": %d}}, \"$lte\": {\"$timestamp\": {\"t\": %d, \"i\": %d}} } }"
 	TimeFormat              = "2006-01-02T15:04:05.000-07:00"
 	HumanReadableTimeFormat = "2006-01-02 15:04:05 MST"
 	ConfigFileName          = "oplog_config.json"
+	SnapshotFileName        = "snapshot.json"
+	ShardedBackupFileName   = "sharded_backup.json"
+	OplogFromMetadataKey    = "oplog-from-ts"
+	OplogToMetadataKey      = "oplog-to-ts"
 )
@@ -0,0 +1,181 @@
+package helpers
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// the query operators a document filter supports
+var documentFilterOperators = []string{"$eq", "$ne", "$in", "$nin", "$exists"}
+
+// DocumentFilter matches documents against a query written in extended JSON, fields are compared for equality
+// or with $eq, $ne, $in, $nin and $exists, and a field holding an array matches when any of its values does
+type DocumentFilter struct {
+	query bson.Raw
+}
+
+func NewDocumentFilter(query string) (*DocumentFilter, error) {
+	var expression bson.D
+	if err := bson.UnmarshalExtJSON([]byte(query), false, &expression); err != nil {
+		err = fmt.Errorf("invalid filter %s: %w", query, err)
+		log.Error().Err(err).Send()
+		return nil, err
+	}
+
+	raw, err := bson.Marshal(expression)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to prepare the filter")
+		return nil, err
+	}
+
+	filter := &DocumentFilter{query: raw}
+
+	// ######################
+	// Refuse the operators that would otherwise be compared for equality
+	// ######################
+	elements, err := filter.query.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, element := range elements {
+		if strings.HasPrefix(element.Key(), "$") {
+			err := fmt.Errorf("unsupported filter operator %s, only fields can be filtered", element.Key())
+			log.Error().Err(err).Send()
+			return nil, err
+		}
+
+		operators, ok := filterOperators(element.Value())
+		if !ok {
+			continue
+		}
+
+		for _, operator := range operators {
+			if !slices.Contains(documentFilterOperators, operator.Key()) {
+				err := fmt.Errorf("unsupported filter operator %s, expected one of %s", operator.Key(), strings.Join(documentFilterOperators, ", "))
+				log.Error().Err(err).Send()
+				return nil, err
+			}
+
+			if _, isArray := operator.Value().ArrayOK(); !isArray && (operator.Key() == "$in" || operator.Key() == "$nin") {
+				err := fmt.Errorf("the %s of %s expects an array", operator.Key(), element.Key())
+				log.Error().Err(err).Send()
+				return nil, err
+			}
+		}
+	}
+
+	return filter, nil
+}
+
+// filterOperators returns the operators of a filter value written as {"$in": [...]}
+func filterOperators(value bson.RawValue) ([]bson.RawElement, bool) {
+	document, ok := value.DocumentOK()
+	if !ok {
+		return nil, false
+	}
+
+	elements, err := document.Elements()
+	if err != nil || len(elements) == 0 || !strings.HasPrefix(elements[0].Key(), "$") {
+		return nil, false
+	}
+
+	return elements, true
+}
+
+// Match reports whether the document matches every field of the filter
+func (filter *DocumentFilter) Match(document bson.Raw) bool {
+	elements, err := filter.query.Elements()
+	if err != nil {
+		return false
+	}
+
+	for _, element := range elements {
+		value, found := lookupValue(document, strings.Split(element.Key(), ".")...)
+
+		operators, ok := filterOperators(element.Value())
+		if !ok {
+			operators = []bson.RawElement{equalityOperator(element.Value())}
+		}
+
+		for _, operator := range operators {
+			if !matchFilterOperator(operator.Key(), operator.Value(), value, found) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func equalityOperator(value bson.RawValue) bson.RawElement {
+	raw, _ := bson.Marshal(bson.D{{Key: "$eq", Value: value}})
+	element, _ := bson.Raw(raw).IndexErr(0)
+	return element
+}
+
+func matchFilterOperator(operator string, expected bson.RawValue, value bson.RawValue, found bool) bool {
+	switch operator {
+	case "$eq":
+		return found && matchFilterValue(value, expected)
+	case "$ne":
+		return !found || !matchFilterValue(value, expected)
+	case "$in", "$nin":
+		array, ok := expected.ArrayOK()
+		if !ok {
+			return false
+		}
+
+		values, err := array.Values()
+		if err != nil {
+			return false
+		}
+
+		in := false
+		for _, candidate := range values {
+			in = in || found && matchFilterValue(value, candidate)
+		}
+
+		return in == (operator == "$in")
+	case "$exists":
+		exists, ok := expected.BooleanOK()
+		if !ok {
+			number, _ := numericValue(expected)
+			exists = number != 0
+		}
+
+		return found == exists
+	}
+
+	return false
+}
+
+// matchFilterValue compares a value of a document to a value of the filter, an array matches
+// when it is equal to the value of the filter or when any of its values is
+func matchFilterValue(value bson.RawValue, expected bson.RawValue) bool {
+	if bsonValuesEqual(value, expected) {
+		return true
+	}
+
+	array, ok := value.ArrayOK()
+	if !ok {
+		return false
+	}
+
+	values, err := array.Values()
+	if err != nil {
+		return false
+	}
+
+	for _, element := range values {
+		if bsonValuesEqual(element, expected) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,439 @@
+package helpers
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DocumentRecovery holds the documents recovered from a backup by their _id and replays
+// the inserts, updates and deletes of the oplog that change them afterwards
+type DocumentRecovery struct {
+	Namespace string
+
+	// the _id of every document recovered from the backup, in the order they were read
+	ids       []string
+	idValues  map[string]bson.RawValue
+	documents map[string]bson.D
+	deleted   []models.DeletedDocument
+}
+
+func NewDocumentRecovery(namespace string, documents []bson.Raw) (*DocumentRecovery, error) {
+	recovery := &DocumentRecovery{
+		Namespace: namespace,
+		idValues:  make(map[string]bson.RawValue, len(documents)),
+		documents: make(map[string]bson.D, len(documents)),
+	}
+
+	for _, raw := range documents {
+		id, ok := lookupValue(raw, "_id")
+		if !ok {
+			return nil, fmt.Errorf("a document of %s has no _id", namespace)
+		}
+
+		var document bson.D
+		if err := bson.Unmarshal(raw, &document); err != nil {
+			return nil, fmt.Errorf("failed to read a document of %s: %w", namespace, err)
+		}
+
+		key := documentKey(id)
+		if _, ok := recovery.idValues[key]; !ok {
+			recovery.ids = append(recovery.ids, key)
+			recovery.idValues[key] = id
+		}
+
+		recovery.documents[key] = document
+	}
+
+	return recovery, nil
+}
+
+// documentKey identifies a document by the type and the bytes of its _id
+func documentKey(id bson.RawValue) string {
+	return string(rune(id.Type)) + string(id.Value)
+}
+
+// Documents returns the documents that are left, in the order they were read from the backup
+func (recovery *DocumentRecovery) Documents() []bson.D {
+	documents := make([]bson.D, 0, len(recovery.documents))
+
+	for _, key := range recovery.ids {
+		if document, ok := recovery.documents[key]; ok {
+			documents = append(documents, document)
+		}
+	}
+
+	return documents
+}
+
+// Deleted returns the documents the oplog deleted and did not insert again, in the order they were deleted
+func (recovery *DocumentRecovery) Deleted() []models.DeletedDocument {
+	return recovery.deleted
+}
+
+// Apply replays the operations of an oplog entry that change the documents, a drop of the collection
+// or of its database, or a rename of the collection, deletes every document that is left
+func (recovery *DocumentRecovery) Apply(entry bson.Raw) error {
+	t, i := entry.Lookup("ts").Timestamp()
+	ts := primitive.Timestamp{T: t, I: i}
+
+	operations, err := OplogOperations(entry)
+	if err != nil {
+		return fmt.Errorf("failed to read the transaction at %s: %w", OplogTimestampString(ts), err)
+	}
+
+	for _, operation := range operations {
+		op, _ := operation.Lookup("op").StringValueOK()
+		namespace, _ := operation.Lookup("ns").StringValueOK()
+		o, _ := operation.Lookup("o").DocumentOK()
+
+		if op == "c" {
+			if recovery.isDroppedBy(namespace, o) {
+				for _, key := range recovery.ids {
+					recovery.delete(key, ts)
+				}
+			}
+
+			continue
+		}
+
+		if namespace != recovery.Namespace {
+			continue
+		}
+
+		var id bson.RawValue
+		var hasID bool
+
+		switch op {
+		case "i", "d":
+			id, hasID = lookupValue(o, "_id")
+		case "u":
+			o2, _ := operation.Lookup("o2").DocumentOK()
+			id, hasID = lookupValue(o2, "_id")
+		}
+
+		if !hasID {
+			continue
+		}
+
+		key := documentKey(id)
+
+		// only the documents recovered from the backup are followed, an insert brings back a document deleted before it
+		if _, ok := recovery.idValues[key]; !ok {
+			continue
+		}
+
+		switch op {
+		case "i":
+			var document bson.D
+			if err := bson.Unmarshal(o, &document); err != nil {
+				return fmt.Errorf("failed to read the insert at %s: %w", OplogTimestampString(ts), err)
+			}
+
+			recovery.documents[key] = document
+			recovery.deleted = slices.DeleteFunc(recovery.deleted, func(deleted models.DeletedDocument) bool {
+				return documentKey(deleted.ID) == key
+			})
+		case "d":
+			recovery.delete(key, ts)
+		case "u":
+			document, ok := recovery.documents[key]
+			if !ok {
+				continue
+			}
+
+			if recovery.documents[key], err = applyOplogUpdate(document, o); err != nil {
+				return fmt.Errorf("failed to apply the update at %s: %w", OplogTimestampString(ts), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (recovery *DocumentRecovery) delete(key string, ts primitive.Timestamp) {
+	if _, ok := recovery.documents[key]; !ok {
+		return
+	}
+
+	delete(recovery.documents, key)
+	recovery.deleted = append(recovery.deleted, models.DeletedDocument{ID: recovery.idValues[key], Timestamp: ts})
+}
+
+// isDroppedBy reports whether a command drops the collection, its database, or moves the collection away
+func (recovery *DocumentRecovery) isDroppedBy(namespace string, o bson.Raw) bool {
+	database, _, _ := strings.Cut(recovery.Namespace, ".")
+	command, target := OplogCommandNamespace(namespace, o)
+
+	switch command {
+	case "drop":
+		return target == recovery.Namespace
+	case "dropDatabase":
+		return strings.SplitN(namespace, ".", 2)[0] == database
+	case "renameCollection":
+		to, _ := o.Lookup("to").StringValueOK()
+		dropTarget, hasDropTarget := lookupValue(o, "dropTarget")
+		dropsTarget := hasDropTarget && !(dropTarget.Type == bson.TypeBoolean && !dropTarget.Boolean())
+
+		return target == recovery.Namespace || to == recovery.Namespace && dropsTarget
+	}
+
+	return false
+}
+
+// ######################
+// Updates
+// ######################
+
+// applyOplogUpdate applies the o of an update oplog entry to a document, it is either a replacement,
+// the $set and $unset of MongoDB before 5.0 or the diff of MongoDB 5.0 and later
+func applyOplogUpdate(document bson.D, update bson.Raw) (bson.D, error) {
+	var o bson.D
+	if err := bson.Unmarshal(update, &o); err != nil {
+		return nil, err
+	}
+
+	if diff, ok := fieldValue(o, "diff").(bson.D); ok && fieldValue(o, "$v") != nil {
+		return applyObjectDiff(document, diff)
+	}
+
+	isModifier := false
+	for _, element := range o {
+		isModifier = isModifier || strings.HasPrefix(element.Key, "$")
+	}
+
+	if !isModifier {
+		return o, nil
+	}
+
+	for _, element := range o {
+		fields, ok := element.Value.(bson.D)
+		if !ok {
+			continue
+		}
+
+		for _, field := range fields {
+			path := strings.Split(field.Key, ".")
+
+			switch element.Key {
+			case "$set":
+				document = setPath(document, path, field.Value).(bson.D)
+			case "$unset":
+				document = unsetPath(document, path).(bson.D)
+			}
+		}
+	}
+
+	return document, nil
+}
+
+func fieldValue(document bson.D, key string) interface{} {
+	for _, element := range document {
+		if element.Key == key {
+			return element.Value
+		}
+	}
+
+	return nil
+}
+
+func setField(document bson.D, key string, value interface{}) bson.D {
+	for i := range document {
+		if document[i].Key == key {
+			document[i].Value = value
+			return document
+		}
+	}
+
+	return append(document, bson.E{Key: key, Value: value})
+}
+
+func removeField(document bson.D, key string) bson.D {
+	for i := range document {
+		if document[i].Key == key {
+			return append(document[:i:i], document[i+1:]...)
+		}
+	}
+
+	return document
+}
+
+// setPath sets the value at a dotted path of a document or an array, creating the documents it goes through
+func setPath(container interface{}, path []string, value interface{}) interface{} {
+	switch container := container.(type) {
+	case bson.A:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 {
+			return container
+		}
+
+		for len(container) <= index {
+			container = append(container, nil)
+		}
+
+		if len(path) == 1 {
+			container[index] = value
+		} else {
+			container[index] = setPath(container[index], path[1:], value)
+		}
+
+		return container
+	case bson.D:
+		if len(path) == 1 {
+			return setField(container, path[0], value)
+		}
+
+		return setField(container, path[0], setPath(fieldValue(container, path[0]), path[1:], value))
+	default:
+		return setPath(bson.D{}, path, value)
+	}
+}
+
+// unsetPath removes the value at a dotted path, the values of arrays are set to null as $unset does
+func unsetPath(container interface{}, path []string) interface{} {
+	switch container := container.(type) {
+	case bson.A:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 || index >= len(container) {
+			return container
+		}
+
+		if len(path) == 1 {
+			container[index] = nil
+		} else {
+			container[index] = unsetPath(container[index], path[1:])
+		}
+
+		return container
+	case bson.D:
+		if len(path) == 1 {
+			return removeField(container, path[0])
+		}
+
+		child := fieldValue(container, path[0])
+		if child == nil {
+			return container
+		}
+
+		return setField(container, path[0], unsetPath(child, path[1:]))
+	default:
+		return container
+	}
+}
+
+// applyObjectDiff applies a diff of MongoDB 5.0 and later to a document: d deletes fields, u updates them,
+// i inserts them at the end, and s followed by a field name holds the diff of a sub document or an array
+func applyObjectDiff(document bson.D, diff bson.D) (bson.D, error) {
+	for _, section := range diff {
+		switch {
+		case section.Key == "d":
+			for _, field := range asDocument(section.Value) {
+				document = removeField(document, field.Key)
+			}
+		case section.Key == "u":
+			for _, field := range asDocument(section.Value) {
+				document = setField(document, field.Key, field.Value)
+			}
+		case section.Key == "i":
+			for _, field := range asDocument(section.Value) {
+				document = append(removeField(document, field.Key), field)
+			}
+		case strings.HasPrefix(section.Key, "s"):
+			field := strings.TrimPrefix(section.Key, "s")
+
+			value, err := applySubDiff(fieldValue(document, field), asDocument(section.Value))
+			if err != nil {
+				return nil, err
+			}
+
+			document = setField(document, field, value)
+		default:
+			return nil, fmt.Errorf("unknown update diff section %s", section.Key)
+		}
+	}
+
+	return document, nil
+}
+
+// applySubDiff applies the diff of a sub document, or of an array when the diff holds a: true
+func applySubDiff(value interface{}, diff bson.D) (interface{}, error) {
+	if isArray, _ := fieldValue(diff, "a").(bool); isArray {
+		array, _ := value.(bson.A)
+		return applyArrayDiff(array, diff)
+	}
+
+	document, _ := value.(bson.D)
+	return applyObjectDiff(document, diff)
+}
+
+// applyArrayDiff applies the diff of an array: u followed by an index sets a value, s followed by an index
+// holds the diff of a value and l is the length the array ends up with
+func applyArrayDiff(array bson.A, diff bson.D) (bson.A, error) {
+	length := -1
+
+	for _, section := range diff {
+		switch {
+		case section.Key == "a":
+		case section.Key == "l":
+			number, ok := numericInterface(section.Value)
+			if !ok {
+				return nil, fmt.Errorf("invalid array length %v in an update diff", section.Value)
+			}
+
+			length = int(number)
+		case strings.HasPrefix(section.Key, "u"), strings.HasPrefix(section.Key, "s"):
+			index, err := strconv.Atoi(section.Key[1:])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("unknown update diff section %s", section.Key)
+			}
+
+			for len(array) <= index {
+				array = append(array, nil)
+			}
+
+			if section.Key[0] == 'u' {
+				array[index] = section.Value
+				continue
+			}
+
+			if array[index], err = applySubDiff(array[index], asDocument(section.Value)); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown update diff section %s", section.Key)
+		}
+	}
+
+	if length >= 0 {
+		for len(array) < length {
+			array = append(array, nil)
+		}
+
+		array = array[:length]
+	}
+
+	return array, nil
+}
+
+func asDocument(value interface{}) bson.D {
+	document, _ := value.(bson.D)
+	return document
+}
+
+func numericInterface(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case float64:
+		return int64(value), true
+	}
+
+	return 0, false
+}
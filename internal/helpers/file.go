@@ -2,13 +2,21 @@ package helpers
 
 import (
 	"fmt"
+	"strings"
 )
 
-func S3OplogPrefix(prefix string) string {
+// S3OplogPrefix returns the prefix of the oplog chain of the full backups, or of the backups of a single database
+func S3OplogPrefix(prefix string, databaseName string) string {
+	oplogKind := "oplog"
+
+	if databaseName != "" {
+		oplogKind = fmt.Sprintf("%s_database_oplog", databaseName)
+	}
+
 	if prefix == "" {
-		return "oplog/"
+		return oplogKind + "/"
 	} else {
-		return fmt.Sprintf("%s/oplog/", prefix)
+		return fmt.Sprintf("%s/%s/", prefix, oplogKind)
 	}
 }
 
@@ -27,3 +35,56 @@ func S3BackupPrefix(prefix string, databaseName string) string {
 		return fmt.Sprintf("%s/%s/", prefix, backupKind)
 	}
 }
+
+// BackupKeyDatabase returns the database of a database backup key, or "" for a full backup, only the directories
+// right under the prefix hold database backups, so the manifests of database backups are not taken for them
+func BackupKeyDatabase(prefix string, backupKey string) string {
+	name := strings.TrimPrefix(backupKey, prefix+"/")
+
+	directory, _, found := strings.Cut(name, "/")
+	if !found {
+		return ""
+	}
+
+	if database, ok := strings.CutSuffix(directory, "_database_backups"); ok {
+		return database
+	}
+
+	return ""
+}
+
+func S3PreRestorePrefix(prefix string) string {
+	if prefix == "" {
+		return "pre_restore/"
+	} else {
+		return fmt.Sprintf("%s/pre_restore/", prefix)
+	}
+}
+
+func S3ManifestPrefix(prefix string) string {
+	if prefix == "" {
+		return "manifests/"
+	} else {
+		return fmt.Sprintf("%s/manifests/", prefix)
+	}
+}
+
+func S3ManifestKey(prefix string, backupKey string) string {
+	return S3ManifestPrefix(prefix) + strings.TrimPrefix(backupKey, prefix+"/") + ".json"
+}
+
+func S3DrillPrefix(prefix string) string {
+	if prefix == "" {
+		return "drills/"
+	} else {
+		return fmt.Sprintf("%s/drills/", prefix)
+	}
+}
+
+func S3ShardedBackupPrefix(prefix string) string {
+	if prefix == "" {
+		return "sharded_backups/"
+	} else {
+		return fmt.Sprintf("%s/sharded_backups/", prefix)
+	}
+}
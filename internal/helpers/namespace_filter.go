@@ -0,0 +1,70 @@
+package helpers
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// the regular expressions are matched against every namespace and oplog entry of a dump, so they are compiled once
+var compiledPatterns sync.Map
+
+// IsRegexPattern reports whether the pattern is a regular expression written as /expression/
+func IsRegexPattern(pattern string) bool {
+	return len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+// ValidatePattern makes sure a glob or /regular expression/ pattern can be matched
+func ValidatePattern(pattern string) error {
+	var err error
+
+	if IsRegexPattern(pattern) {
+		_, err = regexp.Compile(pattern[1 : len(pattern)-1])
+	} else {
+		_, err = path.Match(pattern, "")
+	}
+
+	if err != nil {
+		err = fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		log.Error().Err(err).Send()
+		return err
+	}
+
+	return nil
+}
+
+// MatchPattern matches the name against a glob, or a regular expression written as /expression/,
+// patterns are expected to be validated with ValidatePattern, an invalid pattern never matches
+func MatchPattern(pattern string, name string) bool {
+	if IsRegexPattern(pattern) {
+		if expression, ok := compiledPatterns.Load(pattern); ok {
+			return expression.(*regexp.Regexp).MatchString(name)
+		}
+
+		expression, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false
+		}
+
+		compiledPatterns.Store(pattern, expression)
+		return expression.MatchString(name)
+	}
+
+	matched, err := path.Match(pattern, name)
+	return err == nil && matched
+}
+
+// MatchAnyPattern reports whether the name matches at least one of the patterns
+func MatchAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if MatchPattern(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
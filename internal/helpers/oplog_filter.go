@@ -0,0 +1,163 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// IsDatabaseNamespace returns a matcher of the namespaces of a database
+func IsDatabaseNamespace(database string) func(namespace string) bool {
+	return func(namespace string) bool {
+		return strings.HasPrefix(namespace, database+".")
+	}
+}
+
+// OplogCommandNamespace returns the name of a command run on database.$cmd and the namespace it acts on,
+// which is the namespace it was run on when it does not act on a collection such as a dropDatabase
+func OplogCommandNamespace(namespace string, o bson.Raw) (string, string) {
+	element, err := o.IndexErr(0)
+	if err != nil {
+		return "", namespace
+	}
+
+	command := element.Key()
+
+	target, ok := element.Value().StringValueOK()
+	if !ok {
+		return command, namespace
+	}
+
+	if command == "renameCollection" {
+		return command, target
+	}
+
+	return command, strings.SplitN(namespace, ".", 2)[0] + "." + target
+}
+
+// FilterTransactionOperations keeps only the operations of a transaction that are included, commands are matched
+// by the namespace they act on. Any other entry is returned as it is, and false is returned when no operation is left
+func FilterTransactionOperations(entry bson.Raw, isIncluded func(namespace string) bool) (bson.Raw, bool, error) {
+	applyOps, ok := entry.Lookup("o", "applyOps").ArrayOK()
+	if op, _ := entry.Lookup("op").StringValueOK(); op != "c" || !ok {
+		return entry, true, nil
+	}
+
+	values, err := applyOps.Values()
+	if err != nil {
+		return nil, false, err
+	}
+
+	included := make(bson.A, 0, len(values))
+
+	for _, value := range values {
+		operation, ok := value.DocumentOK()
+		if !ok {
+			continue
+		}
+
+		op, _ := operation.Lookup("op").StringValueOK()
+		namespace, _ := operation.Lookup("ns").StringValueOK()
+
+		if op == "c" {
+			o, _ := operation.Lookup("o").DocumentOK()
+			_, namespace = OplogCommandNamespace(namespace, o)
+		}
+
+		if isIncluded(namespace) {
+			included = append(included, operation)
+		}
+	}
+
+	switch len(included) {
+	case 0:
+		return nil, false, nil
+	case len(values):
+		return entry, true, nil
+	}
+
+	// ######################
+	// Write the entry again with only the included operations
+	// ######################
+	var filtered, o bson.D
+	if err := bson.Unmarshal(entry, &filtered); err != nil {
+		return nil, false, err
+	}
+
+	o, _ = fieldValue(filtered, "o").(bson.D)
+	filtered = setField(filtered, "o", setField(o, "applyOps", included))
+
+	data, err := bson.Marshal(filtered)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return data, true, nil
+}
+
+// FilterOplogFile rewrites the oplog entries mongodump wrote to a file, keeping only the included
+// operations of its transactions
+func FilterOplogFile(path string, isIncluded func(namespace string) bool) error {
+	in, err := os.Open(path)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to open %s", path)
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to create the filtered copy of %s", path)
+		return err
+	}
+
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	source := db.NewBufferlessBSONSource(in)
+	defer source.Close()
+
+	kept, dropped := 0, 0
+
+	for data := source.LoadNext(); data != nil; data = source.LoadNext() {
+		entry, keep, err := FilterTransactionOperations(bson.Raw(data), isIncluded)
+		if err != nil {
+			return fmt.Errorf("failed to filter the oplog entries of %s: %w", path, err)
+		}
+
+		if !keep {
+			dropped++
+			continue
+		}
+
+		if _, err := out.Write(entry); err != nil {
+			log.Error().Err(err).Msgf("Failed to write the filtered copy of %s", path)
+			return err
+		}
+
+		kept++
+	}
+
+	if err := source.Err(); err != nil {
+		return fmt.Errorf("failed to read the oplog entries of %s: %w", path, err)
+	}
+
+	if err := out.Close(); err != nil {
+		log.Error().Err(err).Msgf("Failed to write the filtered copy of %s", path)
+		return err
+	}
+
+	if err := os.Rename(out.Name(), path); err != nil {
+		log.Error().Err(err).Msgf("Failed to replace %s with its filtered copy", path)
+		return err
+	}
+
+	log.Debug().Msgf("Kept %d oplog entries of %s, %d transactions only touched other namespaces", kept, path, dropped)
+	return nil
+}
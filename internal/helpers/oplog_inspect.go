@@ -0,0 +1,71 @@
+package helpers
+
+import (
+	"cmp"
+	"io"
+	"slices"
+
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// the names of the operations of oplog entries
+var oplogOperationNames = map[string]string{
+	"i": "insert",
+	"u": "update",
+	"d": "delete",
+	"c": "command",
+	"n": "noop",
+}
+
+// OplogOperationName returns the name of the operation of an oplog entry, e.g. insert for i
+func OplogOperationName(op string) string {
+	if name, ok := oplogOperationNames[op]; ok {
+		return name
+	}
+
+	return op
+}
+
+// InspectOplogSegment reads a tarred oplog segment as it streams in and counts its entries by namespace and operation
+func InspectOplogSegment(in io.Reader, key string) (*models.OplogInspection, error) {
+	inspection := &models.OplogInspection{Key: key, Counts: make([]models.OplogOperationCount, 0)}
+	counts := make(map[models.OplogOperationCount]int64)
+
+	err := ForEachOplogEntryIn(in, key, func(entry bson.Raw) error {
+		t, i := entry.Lookup("ts").Timestamp()
+		ts := primitive.Timestamp{T: t, I: i}
+
+		if inspection.Entries == 0 {
+			inspection.First = ts
+		}
+
+		inspection.Last = ts
+		inspection.Entries++
+
+		namespace, _ := entry.Lookup("ns").StringValueOK()
+		op, _ := entry.Lookup("op").StringValueOK()
+
+		counts[models.OplogOperationCount{Namespace: namespace, Operation: OplogOperationName(op)}]++
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	inspection.FirstTime = OplogTimestampTime(inspection.First)
+	inspection.LastTime = OplogTimestampTime(inspection.Last)
+
+	for count, total := range counts {
+		count.Count = total
+		inspection.Counts = append(inspection.Counts, count)
+	}
+
+	slices.SortFunc(inspection.Counts, func(a, b models.OplogOperationCount) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Operation, b.Operation))
+	})
+
+	return inspection, nil
+}
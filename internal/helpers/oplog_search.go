@@ -0,0 +1,343 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// the commands that drop the data of a namespace, a renameCollection only does when it drops its target
+var destructiveCommands = []string{"drop", "dropDatabase"}
+
+// OplogSearchFilter selects oplog entries by their namespace, operation, _id and the fields of o and o2,
+// an empty filter matches every entry
+type OplogSearchFilter struct {
+	Namespaces []string
+	Operations []string
+	ID         *bson.RawValue
+	Match      bson.Raw
+}
+
+// NewOplogSearchFilter prepares a filter from the names of the operations (insert, update, delete, command, noop),
+// an _id and a match expression written in extended JSON
+func NewOplogSearchFilter(namespaces []string, operations []string, id string, match string) (*OplogSearchFilter, error) {
+	filter := &OplogSearchFilter{Namespaces: namespaces}
+
+	for _, pattern := range namespaces {
+		if err := ValidatePattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, operation := range operations {
+		op, ok := oplogOperation(operation)
+		if !ok {
+			err := fmt.Errorf("invalid operation %s, expected insert, update, delete, command or noop", operation)
+			log.Error().Err(err).Send()
+			return nil, err
+		}
+
+		filter.Operations = append(filter.Operations, op)
+	}
+
+	if id != "" {
+		value := parseExtJSONValue(id)
+		filter.ID = &value
+	}
+
+	if match != "" {
+		var expression bson.D
+		if err := bson.UnmarshalExtJSON([]byte(match), false, &expression); err != nil {
+			err = fmt.Errorf("invalid match expression %s: %w", match, err)
+			log.Error().Err(err).Send()
+			return nil, err
+		}
+
+		var err error
+		if filter.Match, err = bson.Marshal(expression); err != nil {
+			log.Error().Err(err).Msg("Failed to prepare the match expression")
+			return nil, err
+		}
+	}
+
+	return filter, nil
+}
+
+// oplogOperation returns the op of an oplog entry from the name of its operation, e.g. i for insert
+func oplogOperation(name string) (string, bool) {
+	for op, operationName := range oplogOperationNames {
+		if name == operationName || name == op {
+			return op, true
+		}
+	}
+
+	return "", false
+}
+
+// parseExtJSONValue reads a value written in extended JSON such as {"$oid": "..."} or 42,
+// anything that is not extended JSON is taken as a string
+func parseExtJSONValue(value string) bson.RawValue {
+	var document bson.D
+	if err := bson.UnmarshalExtJSON([]byte(`{"v":`+value+`}`), false, &document); err != nil {
+		document = bson.D{{Key: "v", Value: value}}
+	}
+
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		raw, _ = bson.Marshal(bson.D{{Key: "v", Value: value}})
+	}
+
+	return bson.Raw(raw).Lookup("v")
+}
+
+// Search returns the operations of an oplog entry the filter matches, the operations of
+// a transaction are searched one by one and carry the timestamp of the transaction
+func (filter *OplogSearchFilter) Search(key string, entry bson.Raw) ([]models.OplogSearchMatch, error) {
+	t, i := entry.Lookup("ts").Timestamp()
+	ts := primitive.Timestamp{T: t, I: i}
+
+	wallTime := OplogTimestampTime(ts)
+	if wall, ok := entry.Lookup("wall").DateTimeOK(); ok {
+		wallTime = time.UnixMilli(wall).UTC()
+	}
+
+	operations, err := OplogOperations(entry)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to read the transaction at %s", OplogTimestampString(ts))
+		return nil, err
+	}
+
+	matches := make([]models.OplogSearchMatch, 0)
+
+	for _, operation := range operations {
+		match, ok, err := filter.matchOperation(operation)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		match.Key = key
+		match.Timestamp = ts
+		match.WallTime = wallTime
+		matches = append(matches, *match)
+	}
+
+	return matches, nil
+}
+
+// OplogOperations returns the operations of an oplog entry, the operations of a transaction one by one
+// or the entry itself
+func OplogOperations(entry bson.Raw) ([]bson.Raw, error) {
+	if op, _ := entry.Lookup("op").StringValueOK(); op != "c" {
+		return []bson.Raw{entry}, nil
+	}
+
+	applyOps, ok := entry.Lookup("o", "applyOps").ArrayOK()
+	if !ok {
+		return []bson.Raw{entry}, nil
+	}
+
+	values, err := applyOps.Values()
+	if err != nil {
+		return nil, err
+	}
+
+	operations := make([]bson.Raw, 0, len(values))
+
+	for _, value := range values {
+		if operation, ok := value.DocumentOK(); ok {
+			operations = append(operations, operation)
+		}
+	}
+
+	return operations, nil
+}
+
+func (filter *OplogSearchFilter) matchOperation(operation bson.Raw) (*models.OplogSearchMatch, bool, error) {
+	op, _ := operation.Lookup("op").StringValueOK()
+	namespace, _ := operation.Lookup("ns").StringValueOK()
+	o, _ := operation.Lookup("o").DocumentOK()
+	o2, _ := operation.Lookup("o2").DocumentOK()
+
+	if len(filter.Operations) > 0 && !slices.Contains(filter.Operations, op) {
+		return nil, false, nil
+	}
+
+	// ######################
+	// Commands run on database.$cmd, they are matched by the namespace they act on
+	// ######################
+	command := ""
+
+	if op == "c" {
+		command, namespace = OplogCommandNamespace(namespace, o)
+	}
+
+	if len(filter.Namespaces) > 0 && !MatchAnyPattern(filter.Namespaces, namespace) {
+		return nil, false, nil
+	}
+
+	// ######################
+	// Inserts and deletes hold the _id in o, updates in o2
+	// ######################
+	var id bson.RawValue
+	var hasID bool
+
+	switch op {
+	case "i", "d":
+		id, hasID = lookupValue(o, "_id")
+	case "u":
+		id, hasID = lookupValue(o2, "_id")
+	}
+
+	if filter.ID != nil && (!hasID || !bsonValuesEqual(id, *filter.ID)) {
+		return nil, false, nil
+	}
+
+	if filter.Match != nil {
+		elements, err := filter.Match.Elements()
+		if err != nil {
+			return nil, false, err
+		}
+
+		for _, element := range elements {
+			if !matchOplogField(op, o, o2, element.Key(), element.Value()) {
+				return nil, false, nil
+			}
+		}
+	}
+
+	// ######################
+	// Describe the operation
+	// ######################
+	match := &models.OplogSearchMatch{
+		Namespace:   namespace,
+		Operation:   OplogOperationName(op),
+		Command:     command,
+		Destructive: op == "d" || slices.Contains(destructiveCommands, command),
+	}
+
+	if command == "renameCollection" {
+		dropTarget, ok := lookupValue(o, "dropTarget")
+		match.Destructive = ok && !(dropTarget.Type == bsontype.Boolean && !dropTarget.Boolean())
+	}
+
+	var err error
+
+	if hasID {
+		if match.ID, err = oplogValueJSON(id); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if o != nil {
+		if match.Object, err = oplogDocumentJSON(o); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if o2 != nil {
+		if match.Object2, err = oplogDocumentJSON(o2); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return match, true, nil
+}
+
+// matchOplogField matches a field of the match expression against o and o2, or only one of them when the field
+// starts with o. or o2., the fields an update sets are looked up in its $set or in its diff for MongoDB 5.0 and later
+func matchOplogField(op string, o bson.Raw, o2 bson.Raw, field string, expected bson.RawValue) bool {
+	documents := []bson.Raw{o, o2}
+
+	switch {
+	case strings.HasPrefix(field, "o."):
+		documents, field = []bson.Raw{o}, strings.TrimPrefix(field, "o.")
+	case strings.HasPrefix(field, "o2."):
+		documents, field = []bson.Raw{o2}, strings.TrimPrefix(field, "o2.")
+	case op == "u":
+		for _, path := range [][]string{{"$set"}, {"diff", "u"}, {"diff", "i"}} {
+			if changes, ok := lookupValue(o, path...); ok {
+				if document, ok := changes.DocumentOK(); ok {
+					documents = append(documents, document)
+				}
+			}
+		}
+	}
+
+	for _, document := range documents {
+		if value, ok := lookupValue(document, strings.Split(field, ".")...); ok && bsonValuesEqual(value, expected) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func lookupValue(document bson.Raw, path ...string) (bson.RawValue, bool) {
+	if document == nil {
+		return bson.RawValue{}, false
+	}
+
+	value, err := document.LookupErr(path...)
+	return value, err == nil
+}
+
+// bsonValuesEqual compares two values the way a query would, numbers are equal whatever their type
+func bsonValuesEqual(a bson.RawValue, b bson.RawValue) bool {
+	if x, ok := numericValue(a); ok {
+		if y, ok := numericValue(b); ok {
+			return x == y
+		}
+	}
+
+	return a.Equal(b)
+}
+
+func numericValue(value bson.RawValue) (float64, bool) {
+	switch value.Type {
+	case bsontype.Int32:
+		return float64(value.Int32()), true
+	case bsontype.Int64:
+		return float64(value.Int64()), true
+	case bsontype.Double:
+		return value.Double(), true
+	}
+
+	return 0, false
+}
+
+func oplogDocumentJSON(document bson.Raw) (json.RawMessage, error) {
+	data, err := bson.MarshalExtJSON(document, false, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to convert the oplog entry to JSON")
+		return nil, err
+	}
+
+	return json.RawMessage(data), nil
+}
+
+func oplogValueJSON(value bson.RawValue) (json.RawMessage, error) {
+	data, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, false, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to convert the _id of the oplog entry to JSON")
+		return nil, err
+	}
+
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	return document["v"], nil
+}
@@ -0,0 +1,108 @@
+package helpers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mongodb/mongo-tools/common/db"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	oplogSegmentFileName = "oplog.rs.bson"
+
+	// the most the files of a single oplog backup may take up once extracted
+	maxOplogSegmentSize  = 64 << 30
+	maxOplogMetadataSize = 1 << 20
+)
+
+// oplogSegmentLayout holds the files of a mongodump oplog directory and the most each of them may take up,
+// the entries and the metadata are gzipped in oplog backups taken before they were compressed as a whole
+var oplogSegmentLayout = map[string]int64{
+	oplogSegmentFileName:         maxOplogSegmentSize,
+	oplogSegmentFileName + ".gz": maxOplogSegmentSize,
+	"oplog.rs.metadata.json":     maxOplogMetadataSize,
+	"oplog.rs.metadata.json.gz":  maxOplogMetadataSize,
+}
+
+// IsOplogSegmentFile reports whether a file of a tarred oplog segment holds the oplog entries
+func IsOplogSegmentFile(name string) bool {
+	base := path.Base(name)
+	return base == oplogSegmentFileName || base == oplogSegmentFileName+".gz"
+}
+
+// ForEachOplogEntry calls fn with every entry of a tarred oplog segment, in the order they were dumped
+func ForEachOplogEntry(tarPath string, fn func(entry bson.Raw) error) error {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to open %s", tarPath)
+		return err
+	}
+
+	defer file.Close()
+
+	return ForEachOplogEntryIn(file, tarPath, fn)
+}
+
+// ForEachOplogEntryIn calls fn with every entry of a tarred oplog segment streamed from in, such as the body of an S3 object
+func ForEachOplogEntryIn(in io.Reader, tarPath string, fn func(entry bson.Raw) error) error {
+	return forEachOplogSegmentFile(in, tarPath, func(name string, reader io.Reader) error {
+		var entriesReader io.ReadCloser = io.NopCloser(reader)
+
+		if strings.HasSuffix(name, ".gz") {
+			gzipReader, err := gzip.NewReader(reader)
+			if err != nil {
+				return fmt.Errorf("failed to open gzip reader for %s: %w", name, err)
+			}
+
+			entriesReader = gzipReader
+		}
+
+		source := db.NewBufferlessBSONSource(entriesReader)
+		defer source.Close()
+
+		for entry := source.LoadNext(); entry != nil; entry = source.LoadNext() {
+			if err := fn(bson.Raw(entry)); err != nil {
+				return err
+			}
+		}
+
+		if err := source.Err(); err != nil {
+			return fmt.Errorf("failed to read the oplog entries of %s: %w", tarPath, err)
+		}
+
+		return nil
+	})
+}
+
+func forEachOplogSegmentFile(in io.Reader, tarPath string, fn func(name string, reader io.Reader) error) error {
+	reader, err := NewDecompressionReader(in)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	tarReader := tar.NewReader(reader)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return fmt.Errorf("no oplog entries found in %s", tarPath)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read tar file: %w", err)
+		}
+
+		if header.Typeflag == tar.TypeReg && IsOplogSegmentFile(header.Name) {
+			return fn(header.Name, tarReader)
+		}
+	}
+}
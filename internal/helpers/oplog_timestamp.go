@@ -0,0 +1,68 @@
+package helpers
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OplogLimitAfter returns the mongorestore --oplogLimit that still applies the entry at ts.
+func OplogLimitAfter(ts primitive.Timestamp) string {
+	return fmt.Sprintf("%d:%d", ts.T, ts.I+1)
+}
+
+func OplogTimestampRangeQuery(from primitive.Timestamp, to primitive.Timestamp) string {
+	return fmt.Sprintf(OplogTimestampQuery, from.T, from.I, to.T, to.I)
+}
+
+// OplogDatabaseFilter matches the oplog entries of a database, transactions are matched as a whole
+// when any of their operations touches the database, FilterTransactionOperations then leaves out the others
+func OplogDatabaseFilter(database string) bson.D {
+	pattern := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(database) + `\.`}
+
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "ns", Value: pattern}},
+		bson.D{{Key: "o.applyOps.ns", Value: pattern}},
+	}}}
+}
+
+// OplogRangeQuery returns the mongodump query of the oplog entries after from up to to,
+// only the entries of database are kept unless it is empty
+func OplogRangeQuery(from primitive.Timestamp, to primitive.Timestamp, database string) (string, error) {
+	if database == "" {
+		return OplogTimestampRangeQuery(from, to), nil
+	}
+
+	query := bson.D{{Key: "ts", Value: bson.D{{Key: "$gt", Value: from}, {Key: "$lte", Value: to}}}}
+	query = append(query, OplogDatabaseFilter(database)...)
+
+	queryJson, err := bson.MarshalExtJSON(query, true, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to build the oplog query of %s: %w", database, err)
+	}
+
+	return string(queryJson), nil
+}
+
+// OplogTimestampString formats ts the way mongorestore expects it in --oplogLimit.
+func OplogTimestampString(ts primitive.Timestamp) string {
+	return fmt.Sprintf("%d:%d", ts.T, ts.I)
+}
+
+func ParseOplogTimestamp(value string) (primitive.Timestamp, error) {
+	var ts primitive.Timestamp
+
+	if _, err := fmt.Sscanf(value, "%d:%d", &ts.T, &ts.I); err != nil {
+		return primitive.Timestamp{}, fmt.Errorf("invalid oplog timestamp %q, expected seconds:increment: %w", value, err)
+	}
+
+	return ts, nil
+}
+
+// OplogTimestampTime returns the wall clock second ts belongs to, used to name oplog segments.
+func OplogTimestampTime(ts primitive.Timestamp) time.Time {
+	return time.Unix(int64(ts.T), 0).UTC()
+}
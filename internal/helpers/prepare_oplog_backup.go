@@ -1,6 +1,7 @@
 package helpers
 
 import (
+	"path"
 	"strings"
 	"time"
 
@@ -8,10 +9,10 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func PrepareOplogBackup(oplogKey string, prefix string) models.OplogBackup {
+func PrepareOplogBackup(oplogKey string) models.OplogBackup {
 
-	fileName := strings.TrimPrefix(oplogKey, S3OplogPrefix(prefix))
-	FileNameWithoutExtension := strings.TrimSuffix(fileName, ".tar.gz")
+	fileName := path.Base(oplogKey)
+	FileNameWithoutExtension := TrimOplogSegmentExtension(fileName)
 	timeStringArray := strings.Split(FileNameWithoutExtension, "_")
 	var err error
 
@@ -36,3 +37,19 @@ func PrepareOplogBackup(oplogKey string, prefix string) models.OplogBackup {
 
 	return oplogBackup
 }
+
+// IsOplogBackupKey reports whether the key is named after the times of an oplog backup, as PrepareOplogBackup expects
+func IsOplogBackupKey(oplogKey string) bool {
+	timeStringArray := strings.Split(TrimOplogSegmentExtension(path.Base(oplogKey)), "_")
+	if len(timeStringArray) != 2 {
+		return false
+	}
+
+	for _, timeString := range timeStringArray {
+		if _, err := time.Parse(TimeFormat, timeString); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
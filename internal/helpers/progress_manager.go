@@ -2,30 +2,51 @@ package helpers
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/mongodb/mongo-tools/common/progress"
 	"github.com/rs/zerolog/log"
 )
 
-type ProgressManager struct{}
-
-var stopProgress = make(chan bool)
+// ProgressManager logs the progress of every namespace of a dump, each namespace is
+// stopped on its own so dumps running in parallel do not stop each other's progress
+type ProgressManager struct {
+	mutex        sync.Mutex
+	stopProgress map[string]chan bool
+}
 
 func (p *ProgressManager) Attach(name string, progressor progress.Progressor) {
 	_, max := progressor.Progress()
 	log.Info().Msgf("dumping %s, total records %d", name, max)
-	go process(name, progressor)
+
+	stop := make(chan bool)
+
+	p.mutex.Lock()
+	if p.stopProgress == nil {
+		p.stopProgress = make(map[string]chan bool)
+	}
+	p.stopProgress[name] = stop
+	p.mutex.Unlock()
+
+	go process(name, progressor, stop)
 }
 
 func (p *ProgressManager) Detach(name string) {
-	stopProgress <- true
+	p.mutex.Lock()
+	stop, ok := p.stopProgress[name]
+	delete(p.stopProgress, name)
+	p.mutex.Unlock()
+
+	if ok {
+		close(stop)
+	}
 }
 
-func process(name string, progressor progress.Progressor) {
+func process(name string, progressor progress.Progressor, stop chan bool) {
 	for {
 		select {
-		case <-stopProgress:
+		case <-stop:
 			return
 		default:
 			current, max := progressor.Progress()
@@ -0,0 +1,171 @@
+package helpers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ditkrg/mongodb-backup/internal/models"
+	"github.com/rs/zerolog/log"
+)
+
+// ParseAge parses an age such as 90d, 12w or 36h
+func ParseAge(age string) (time.Duration, error) {
+	if age == "" {
+		return 0, nil
+	}
+
+	duration, err := parseAge(age)
+	if err != nil {
+		log.Error().Err(err).Send()
+		return 0, err
+	}
+
+	return duration, nil
+}
+
+func parseAge(age string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+
+	if unit, ok := units[age[len(age)-1:]]; ok {
+		count, err := strconv.Atoi(age[:len(age)-1])
+		if err == nil && count >= 0 {
+			return time.Duration(count) * unit, nil
+		}
+	}
+
+	duration, err := time.ParseDuration(age)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid age %s, expected a number of days (90d), weeks (12w) or a duration (36h)", age)
+	}
+
+	return duration, nil
+}
+
+// ParseDate parses a date such as 2026-12-31, which stands for the end of that day in UTC, or a time in TimeFormat or RFC 3339
+func ParseDate(date string) (time.Time, error) {
+	if day, err := time.Parse(time.DateOnly, date); err == nil {
+		return day.Add(24 * time.Hour), nil
+	}
+
+	for _, layout := range []string{TimeFormat, time.RFC3339} {
+		if parsed, err := time.Parse(layout, date); err == nil {
+			return parsed, nil
+		}
+	}
+
+	err := fmt.Errorf("invalid date %s, expected a day (2026-12-31) or a time (2026-12-31T18:00:00Z)", date)
+	log.Error().Err(err).Send()
+	return time.Time{}, err
+}
+
+// the calendar buckets of the grandfather-father-son rules, in UTC
+var retentionBuckets = []struct {
+	name   string
+	count  func(policy models.RetentionPolicy) int
+	bucket func(backupTime time.Time) string
+}{
+	{"daily", func(policy models.RetentionPolicy) int { return policy.KeepDaily }, func(backupTime time.Time) string {
+		return backupTime.Format("2006-01-02")
+	}},
+	{"weekly", func(policy models.RetentionPolicy) int { return policy.KeepWeekly }, func(backupTime time.Time) string {
+		year, week := backupTime.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}},
+	{"monthly", func(policy models.RetentionPolicy) int { return policy.KeepMonthly }, func(backupTime time.Time) string {
+		return backupTime.Format("2006-01")
+	}},
+	{"yearly", func(policy models.RetentionPolicy) int { return policy.KeepYearly }, func(backupTime time.Time) string {
+		return backupTime.Format("2006")
+	}},
+}
+
+// ApplyRetentionPolicy decides which of the backups the policy keeps, the backups are sorted from the oldest to the newest.
+// Every rule keeps the newest backup of each of its most recent buckets, the max age deletes what is older
+// even when a rule keeps it, and the newest MinCount backups are always kept
+func ApplyRetentionPolicy(policy models.RetentionPolicy, backups []models.RetentionDecision, now time.Time) {
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.Before(backups[j].Time) })
+
+	if policy.IsEmpty() {
+		for i := range backups {
+			backups[i].Keep = true
+			backups[i].Reason = "no retention policy"
+		}
+
+		return
+	}
+
+	reasons := make([][]string, len(backups))
+
+	// ######################
+	// The newest backups first
+	// ######################
+	for rank := 0; rank < len(backups); rank++ {
+		i := len(backups) - 1 - rank
+
+		if rank < policy.KeepLast {
+			reasons[i] = append(reasons[i], fmt.Sprintf("recent %d/%d", rank+1, policy.KeepLast))
+		}
+
+		// a policy with nothing but a max age keeps everything younger than it
+		if !policy.HasKeepRules() {
+			reasons[i] = append(reasons[i], "within the max age")
+		}
+	}
+
+	for _, rule := range retentionBuckets {
+		count := rule.count(policy)
+		seen := make(map[string]bool)
+
+		for i := len(backups) - 1; i >= 0 && count > 0; i-- {
+			bucket := rule.bucket(backups[i].Time.UTC())
+			if seen[bucket] {
+				continue
+			}
+
+			if len(seen) == count {
+				break
+			}
+
+			seen[bucket] = true
+			reasons[i] = append(reasons[i], rule.name+" "+bucket)
+		}
+	}
+
+	for i := range backups {
+		backups[i].Keep = len(reasons[i]) > 0
+		backups[i].Reason = "kept as " + strings.Join(reasons[i], ", ")
+
+		if !backups[i].Keep {
+			backups[i].Reason = "not kept by any rule of the retention policy"
+		}
+	}
+
+	// ######################
+	// Nothing older than the max age is kept
+	// ######################
+	if policy.MaxAge > 0 {
+		cutoff := now.Add(-policy.MaxAge)
+
+		for i := range backups {
+			if backups[i].Keep && backups[i].Time.Before(cutoff) {
+				backups[i].Keep = false
+				backups[i].Reason = fmt.Sprintf("older than the max age, taken before %s", cutoff.UTC().Format(HumanReadableTimeFormat))
+			}
+		}
+	}
+
+	// ######################
+	// The newest backups survive every rule
+	// ######################
+	for rank := 0; rank < policy.MinCount && rank < len(backups); rank++ {
+		i := len(backups) - 1 - rank
+
+		if !backups[i].Keep {
+			backups[i].Keep = true
+			backups[i].Reason = fmt.Sprintf("one of the %d most recent backups that are always kept", policy.MinCount)
+		}
+	}
+}
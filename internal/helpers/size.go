@@ -0,0 +1,23 @@
+package helpers
+
+import "fmt"
+
+// FormatBytes formats a size in bytes with binary units, e.g. 1.5 GiB
+func FormatBytes(size int64) string {
+	const unit = 1024
+
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size) / unit
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB"}
+
+	i := 0
+	for value >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
@@ -1,6 +1,7 @@
 package helpers
 
 import (
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -17,11 +18,8 @@ func SortByKeyTimeStamp(contents []types.Object, prefix string) {
 		iTimeString := strings.TrimPrefix(iKey, prefix)
 		jTimeString := strings.TrimPrefix(jKey, prefix)
 
-		iTimeString = strings.TrimSuffix(iTimeString, ".gzip")
-		jTimeString = strings.TrimSuffix(jTimeString, ".gzip")
-
-		iTimeString = strings.TrimSuffix(iTimeString, ".archive")
-		jTimeString = strings.TrimSuffix(jTimeString, ".archive")
+		iTimeString = TrimArchiveExtension(iTimeString)
+		jTimeString = TrimArchiveExtension(jTimeString)
 
 		iTime, err := time.Parse(TimeFormat, iTimeString)
 		if err != nil {
@@ -38,3 +36,25 @@ func SortByKeyTimeStamp(contents []types.Object, prefix string) {
 		return iTime.Before(jTime)
 	})
 }
+
+func SortedTimeStrings(timeStrings []string) []string {
+	sorted := slices.Clone(timeStrings)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		iTime, err := time.Parse(TimeFormat, sorted[i])
+		if err != nil {
+			log.Panic().Err(err).Msgf("Failed to parse time from %s", sorted[i])
+			return false
+		}
+
+		jTime, err := time.Parse(TimeFormat, sorted[j])
+		if err != nil {
+			log.Panic().Err(err).Msgf("Failed to parse time from %s", sorted[j])
+			return false
+		}
+
+		return iTime.Before(jTime)
+	})
+
+	return sorted
+}
@@ -4,41 +4,33 @@ import (
 	"archive/tar"
 	"fmt"
 	"io"
-
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 )
 
-func TarDirectory(sourceDirPath string, fileName string) error {
-	log.Info().Msgf("adding directory %s to %s", sourceDirPath, fileName)
-
-	outputFilePath := sourceDirPath + fileName
-	outFile, err := os.Create(outputFilePath)
-
-	if err != nil {
-		log.Error().Err(err).Msg("could not create tar.gz file")
-		return err
-	}
-
-	defer outFile.Close()
+// TarDirectory writes a tar of every file in the directory to w
+func TarDirectory(sourceDirPath string, w io.Writer) error {
+	log.Info().Msgf("adding directory %s to a tar", sourceDirPath)
 
-	tarWriter := tar.NewWriter(outFile)
-	defer tarWriter.Close()
+	tarWriter := tar.NewWriter(w)
 
-	err = filepath.Walk(sourceDirPath, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(sourceDirPath, func(path string, info os.FileInfo, err error) error {
 
 		if err != nil {
 			log.Err(err).Msg("Failed to walk through the directory")
 			return err
 		}
 
-		if info.IsDir() || outputFilePath == path {
+		if info.IsDir() {
 			return nil
 		}
 
-		log.Info().Msgf("Adding %s to %s", path, outputFilePath)
+		log.Info().Msgf("Adding %s to the tar", path)
 
 		file, err := os.Open(path)
 
@@ -74,7 +66,7 @@ func TarDirectory(sourceDirPath string, fileName string) error {
 			return err
 		}
 
-		log.Info().Msgf("File %s added to %s", path, outputFilePath)
+		log.Info().Msgf("File %s added to the tar", path)
 		return nil
 	})
 
@@ -83,11 +75,18 @@ func TarDirectory(sourceDirPath string, fileName string) error {
 		return err
 	}
 
-	log.Info().Msgf("Directory %s added to %s", sourceDirPath, outputFilePath)
+	if err := tarWriter.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close the tar")
+		return err
+	}
+
+	log.Info().Msgf("Directory %s added to the tar", sourceDirPath)
 	return nil
 }
 
-func ExtractTar(tarPath, destDir string) error {
+// ExtractOplogSegment extracts a tarred oplog segment into destDir. The segments are read from a bucket
+// others may be able to write to, so only the files of a mongodump oplog directory are accepted
+func ExtractOplogSegment(tarPath, destDir string) error {
 	log.Info().Msgf("Extracting %s to %s", tarPath, destDir)
 
 	if err := os.MkdirAll(destDir, 0755); err != nil {
@@ -101,52 +100,99 @@ func ExtractTar(tarPath, destDir string) error {
 	}
 	defer file.Close()
 
-	// Create a tar reader
-	tarReader := tar.NewReader(file)
+	// Detect the compression, uncompressed tars are read as they are
+	reader, err := NewDecompressionReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to open tar file: %w", err)
+	}
+	defer reader.Close()
+
+	tarReader := tar.NewReader(reader)
+
+	extracted := make(map[string]bool)
+	var totalSize int64
 
-	// Iterate through the files in the tar archive
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
-			break // End of tar archive
+			break
 		}
 		if err != nil {
 			return fmt.Errorf("failed to read tar file: %w", err)
 		}
 
-		// Get the individual file path and extract it
-		targetPath := filepath.Join(destDir, header.Name)
+		// ######################
+		// Only accept the plain files of the oplog directory
+		// ######################
+		if filepath.IsAbs(header.Name) || slices.Contains(strings.Split(header.Name, "/"), "..") {
+			return fmt.Errorf("refusing to extract %s from %s: the path escapes the destination", header.Name, tarPath)
+		}
+
+		name := path.Clean(header.Name)
 
-		// Handle directories
 		switch header.Typeflag {
 		case tar.TypeDir:
-			// Create a directory
-			if err := os.MkdirAll(targetPath, os.FileMode(header.Mode)); err != nil {
-				return fmt.Errorf("failed to create directory: %w", err)
+			if name == "." {
+				continue
 			}
+
+			return fmt.Errorf("refusing to extract %s from %s: an oplog backup holds no directories", header.Name, tarPath)
 		case tar.TypeReg:
-			// Create a file
-			outFile, err := os.Create(targetPath)
-			if err != nil {
-				return fmt.Errorf("failed to create file: %w", err)
-			}
-			defer outFile.Close()
+		default:
+			return fmt.Errorf("refusing to extract %s from %s: only regular files are allowed", header.Name, tarPath)
+		}
 
-			// Copy the file content from the tar archive
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				return fmt.Errorf("failed to write file: %w", err)
-			}
+		maxSize, ok := oplogSegmentLayout[name]
+		if !ok {
+			return fmt.Errorf("refusing to extract %s from %s: not a file of an oplog backup", header.Name, tarPath)
+		}
 
-			// Restore file permissions
-			if err := os.Chmod(targetPath, os.FileMode(header.Mode)); err != nil {
-				return fmt.Errorf("failed to set file permissions: %w", err)
-			}
-		default:
-			// Skip unsupported file types
-			continue
+		if extracted[name] {
+			return fmt.Errorf("refusing to extract %s from %s: the file is in the tar more than once", header.Name, tarPath)
+		}
+
+		// ######################
+		// Enforce the size limits before writing anything
+		// ######################
+		if header.Size < 0 || header.Size > maxSize {
+			return fmt.Errorf("refusing to extract %s from %s: %d bytes is over the limit of %d bytes", header.Name, tarPath, header.Size, maxSize)
+		}
+
+		if totalSize += header.Size; totalSize > maxOplogSegmentSize {
+			return fmt.Errorf("refusing to extract %s: the extracted files are over the limit of %d bytes", tarPath, maxOplogSegmentSize)
 		}
+
+		if err := extractTarFile(tarReader, filepath.Join(destDir, name), header.Size); err != nil {
+			return err
+		}
+
+		extracted[name] = true
+	}
+
+	if !extracted[oplogSegmentFileName] && !extracted[oplogSegmentFileName+".gz"] {
+		return fmt.Errorf("no oplog entries found in %s", tarPath)
 	}
 
 	log.Info().Msgf("Extracted %s to %s", tarPath, destDir)
 	return nil
 }
+
+// extractTarFile writes the current entry of the tar to a new file, it never follows
+// or overwrites what already exists at targetPath
+func extractTarFile(tarReader *tar.Reader, targetPath string, size int64) error {
+	outFile, err := os.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	if _, err := io.CopyN(outFile, tarReader, size); err != nil {
+		outFile.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package helpers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ParseTimeBound parses a bound of a time range: an age such as 7d stands for that long before now,
+// a day such as 2026-12-31 for the start of that day in UTC, or its end when it is the upper bound
+func ParseTimeBound(value string, now time.Time, isUpperBound bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if day, err := time.Parse(time.DateOnly, value); err == nil {
+		if isUpperBound {
+			return day.Add(24 * time.Hour), nil
+		}
+
+		return day, nil
+	}
+
+	if age, err := parseAge(value); err == nil {
+		return now.Add(-age), nil
+	}
+
+	for _, layout := range []string{TimeFormat, time.RFC3339} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+
+	err := fmt.Errorf("invalid time %s, expected an age (7d), a day (2026-12-31) or a time (2026-12-31T18:00:00Z)", value)
+	log.Error().Err(err).Send()
+	return time.Time{}, err
+}
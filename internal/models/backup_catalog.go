@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// BackupChain holds the backups of one backup prefix and the oplog backups that extend them
+type BackupChain struct {
+	Database     string `json:"database" yaml:"database"`
+	BackupPrefix string `json:"backup_prefix" yaml:"backup_prefix"`
+	OplogPrefix  string `json:"oplog_prefix" yaml:"oplog_prefix"`
+
+	Backups []CatalogBackup `json:"backups" yaml:"backups"`
+
+	// the oplog backups that end before the oldest backup, no restore can use them
+	OrphanedOplog []CatalogOplogBackup `json:"orphaned_oplog,omitempty" yaml:"orphaned_oplog,omitempty"`
+
+	// the continuous time ranges the chain can restore to any point of
+	Windows []PointInTimeWindow `json:"pitr_windows" yaml:"pitr_windows"`
+}
+
+// CatalogBackup is a backup along with the oplog backups between it and the next backup
+type CatalogBackup struct {
+	Key        string               `json:"key" yaml:"key"`
+	Time       time.Time            `json:"time" yaml:"time"`
+	AgeSeconds int64                `json:"age_seconds" yaml:"age_seconds"`
+	Size       int64                `json:"size" yaml:"size"`
+	Class      string               `json:"class" yaml:"class"`
+	Note       string               `json:"note,omitempty" yaml:"note,omitempty"`
+	Pin        *BackupPin           `json:"pin,omitempty" yaml:"pin,omitempty"`
+	Oplog      []CatalogOplogBackup `json:"oplog,omitempty" yaml:"oplog,omitempty"`
+
+	// the end of the oplog captured with the dump, the backup is restored as of then
+	ConsistentAt time.Time `json:"consistent_at" yaml:"consistent_at"`
+}
+
+type CatalogOplogBackup struct {
+	Key  string    `json:"key" yaml:"key"`
+	From time.Time `json:"from" yaml:"from"`
+	To   time.Time `json:"to" yaml:"to"`
+	Size int64     `json:"size" yaml:"size"`
+
+	// the oplog backup does not start where the one before it ends, restores stop before it
+	GapBefore bool `json:"gap_before,omitempty" yaml:"gap_before,omitempty"`
+}
+
+type PointInTimeWindow struct {
+	From time.Time `json:"from" yaml:"from"`
+	To   time.Time `json:"to" yaml:"to"`
+}
@@ -0,0 +1,11 @@
+package models
+
+// the classes of the backups, every class has its own retention policy
+const (
+	BackupClassScheduled = "scheduled"
+	BackupClassManual    = "manual"
+	BackupClassPreDeploy = "pre-deploy"
+)
+
+// BackupClasses lists the classes of the backups, the scheduled backups first
+var BackupClasses = []string{BackupClassScheduled, BackupClassManual, BackupClassPreDeploy}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ArchiveInspection describes what a backup archive holds
+type ArchiveInspection struct {
+	Key           string                `json:"key"`
+	ServerVersion string                `json:"server_version"`
+	ToolVersion   string                `json:"tool_version"`
+	Databases     []DatabaseInspection  `json:"databases"`
+	UsersAndRoles UsersAndRolesIncluded `json:"users_and_roles"`
+
+	// the oplog captured while the archive was dumped
+	OplogCaptured bool                `json:"oplog_captured"`
+	OplogEntries  int64               `json:"oplog_entries"`
+	OplogFirst    primitive.Timestamp `json:"oplog_first_ts"`
+	OplogLast     primitive.Timestamp `json:"oplog_last_ts"`
+
+	// the number of operations the captured oplog holds for every namespace it writes to
+	OplogNamespaces map[string]int64 `json:"oplog_namespaces,omitempty"`
+}
+
+type DatabaseInspection struct {
+	Name        string                 `json:"name"`
+	Collections []CollectionInspection `json:"collections"`
+}
+
+type CollectionInspection struct {
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	Documents int64             `json:"documents"`
+	Size      int64             `json:"size"`
+	Options   json.RawMessage   `json:"options,omitempty"`
+	Indexes   []IndexInspection `json:"indexes,omitempty"`
+}
+
+type IndexInspection struct {
+	Name    string          `json:"name"`
+	Key     json.RawMessage `json:"key"`
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// UsersAndRolesIncluded counts the users and roles an archive restores
+type UsersAndRolesIncluded struct {
+	Included bool  `json:"included"`
+	Users    int64 `json:"users"`
+	Roles    int64 `json:"roles"`
+}
+
+// OplogInspection describes the entries of an oplog backup
+type OplogInspection struct {
+	Key       string                `json:"key"`
+	Entries   int64                 `json:"entries"`
+	First     primitive.Timestamp   `json:"first_ts"`
+	FirstTime time.Time             `json:"first_time"`
+	Last      primitive.Timestamp   `json:"last_ts"`
+	LastTime  time.Time             `json:"last_time"`
+	Counts    []OplogOperationCount `json:"counts"`
+}
+
+type OplogOperationCount struct {
+	Namespace string `json:"ns"`
+	Operation string `json:"op"`
+	Count     int64  `json:"count"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+type BackupManifest struct {
+	Key           string              `json:"key"`
+	CreatedAt     string              `json:"created_at"`
+	Class         string              `json:"class,omitempty"`
+	Note          string              `json:"note,omitempty"`
+	Source        *ClusterFingerprint `json:"source,omitempty"`
+	Filter        *NamespaceFilter    `json:"filter,omitempty"`
+	Namespaces    []NamespaceManifest `json:"namespaces,omitempty"`
+	Compression   string              `json:"compression,omitempty"`
+	Pin           *BackupPin          `json:"pin,omitempty"`
+	OplogCaptured bool                `json:"oplog_captured"`
+	OplogFrom     primitive.Timestamp `json:"oplog_from"`
+	OplogTo       primitive.Timestamp `json:"oplog_to"`
+}
+
+// BackupClass returns the class of the backup, the backups taken before classes are scheduled backups
+func (manifest *BackupManifest) BackupClass() string {
+	if manifest == nil || manifest.Class == "" {
+		return BackupClassScheduled
+	}
+
+	return manifest.Class
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// BackupPin protects a backup from retention until it expires
+type BackupPin struct {
+	Until    time.Time `json:"until" yaml:"until"`
+	Reason   string    `json:"reason" yaml:"reason"`
+	PinnedAt time.Time `json:"pinned_at" yaml:"pinned_at"`
+}
+
+func (pin *BackupPin) IsActive(now time.Time) bool {
+	return pin != nil && now.Before(pin.Until)
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+)
+
+type ClusterFingerprint struct {
+	ReplicaSetName              string   `json:"replica_set_name"`
+	Hosts                       []string `json:"hosts"`
+	ClusterId                   string   `json:"cluster_id"`
+	FeatureCompatibilityVersion string   `json:"feature_compatibility_version"`
+}
+
+// Id identifies the cluster by its replica set id, or by its replica set name when the id is unknown,
+// so it stays the same across feature compatibility version upgrades and member changes.
+// The hosts only identify the servers that are in no replica set
+func (fingerprint *ClusterFingerprint) Id() string {
+	identity := "replica-set-id|" + fingerprint.ClusterId
+
+	switch {
+	case fingerprint.ClusterId != "":
+	case fingerprint.ReplicaSetName != "":
+		identity = "replica-set-name|" + fingerprint.ReplicaSetName
+	default:
+		hosts := slices.Clone(fingerprint.Hosts)
+		slices.Sort(hosts)
+
+		identity = "hosts|" + strings.Join(hosts, ",")
+	}
+
+	hash := sha256.Sum256([]byte(identity))
+	return hex.EncodeToString(hash[:8])
+}
+
+func (fingerprint *ClusterFingerprint) IsSameCluster(other *ClusterFingerprint) bool {
+	if fingerprint.ClusterId != "" && other.ClusterId != "" {
+		return fingerprint.ClusterId == other.ClusterId
+	}
+
+	hosts := slices.Clone(fingerprint.Hosts)
+	otherHosts := slices.Clone(other.Hosts)
+	slices.Sort(hosts)
+	slices.Sort(otherHosts)
+
+	return fingerprint.ReplicaSetName == other.ReplicaSetName && slices.Equal(hosts, otherHosts)
+}
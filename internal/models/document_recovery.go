@@ -0,0 +1,12 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DeletedDocument is a document recovered from a backup that the oplog deleted afterwards
+type DeletedDocument struct {
+	ID        bson.RawValue
+	Timestamp primitive.Timestamp
+}
@@ -0,0 +1,11 @@
+package models
+
+type DrillReport struct {
+	StartedAt  string         `json:"started_at"`
+	FinishedAt string         `json:"finished_at"`
+	Pick       string         `json:"pick"`
+	Passed     bool           `json:"passed"`
+	Error      string         `json:"error,omitempty"`
+	LagSeconds float64        `json:"lag_seconds"`
+	Restore    *RestoreReport `json:"restore,omitempty"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import "strings"
+
+// NamespaceFilter holds the database and namespace patterns a backup was taken with
+type NamespaceFilter struct {
+	IncludeDatabases  []string `json:"include_databases,omitempty"`
+	ExcludeDatabases  []string `json:"exclude_databases,omitempty"`
+	IncludeNamespaces []string `json:"include_namespaces,omitempty"`
+	ExcludeNamespaces []string `json:"exclude_namespaces,omitempty"`
+}
+
+func (filter *NamespaceFilter) String() string {
+	parts := make([]string, 0, 4)
+
+	for _, patterns := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"include databases", filter.IncludeDatabases},
+		{"exclude databases", filter.ExcludeDatabases},
+		{"include namespaces", filter.IncludeNamespaces},
+		{"exclude namespaces", filter.ExcludeNamespaces},
+	} {
+		if len(patterns.patterns) > 0 {
+			parts = append(parts, patterns.name+" "+strings.Join(patterns.patterns, ","))
+		}
+	}
+
+	return strings.Join(parts, "; ")
+}
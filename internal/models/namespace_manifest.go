@@ -0,0 +1,25 @@
+package models
+
+type NamespaceManifest struct {
+	Database   string          `json:"database"`
+	Collection string          `json:"collection"`
+	Count      int64           `json:"count"`
+	Indexes    []IndexManifest `json:"indexes"`
+	Options    string          `json:"options"`
+	DbHash     string          `json:"db_hash,omitempty"`
+
+	// the collection was written to while it was dumped, so replaying the oplog captured with the dump
+	// changes its count, and its dbHash, taken after the dump, is approximate when this cannot be known
+	ChangedDuringDump bool `json:"changed_during_dump,omitempty"`
+	DbHashApproximate bool `json:"db_hash_approximate,omitempty"`
+}
+
+type IndexManifest struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	Options string `json:"options"`
+}
+
+func (namespace *NamespaceManifest) Namespace() string {
+	return namespace.Database + "." + namespace.Collection
+}
@@ -1,6 +1,16 @@
 package models
 
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
 type PreviousOplogRunInfo struct {
-	OplogTakenFrom string `json:"oplog_taken_from"`
-	OplogTakenTo   string `json:"oplog_taken_to"`
+	OplogTakenFrom          string              `json:"oplog_taken_from"`
+	OplogTakenTo            string              `json:"oplog_taken_to"`
+	OplogTakenFromTimestamp primitive.Timestamp `json:"oplog_taken_from_ts"`
+	OplogTakenToTimestamp   primitive.Timestamp `json:"oplog_taken_to_ts"`
+	OplogWindowSeconds      int64               `json:"oplog_window_seconds,omitempty"`
+	BackupIntervalSeconds   int64               `json:"backup_interval_seconds,omitempty"`
+	ChainBroken             bool                `json:"chain_broken,omitempty"`
+	ChainBrokenAt           string              `json:"chain_broken_at,omitempty"`
+	GapFrom                 primitive.Timestamp `json:"gap_from"`
+	GapTo                   primitive.Timestamp `json:"gap_to"`
 }
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OplogSearchResult holds the oplog entries an oplog search matched
+type OplogSearchResult struct {
+	OplogPrefix string             `json:"oplog_prefix"`
+	Searched    []string           `json:"searched"`
+	Matched     int64              `json:"matched"`
+	Entries     []OplogSearchMatch `json:"entries"`
+
+	// the first destructive entry matched and the restore target just before it
+	FirstDestructive *OplogSearchMatch   `json:"first_destructive,omitempty"`
+	RestoreTarget    *OplogRestoreTarget `json:"restore_target,omitempty"`
+}
+
+// OplogSearchMatch is an oplog entry matched by an oplog search, the operations of a transaction
+// are matched one by one and carry the timestamp of the transaction
+type OplogSearchMatch struct {
+	Key         string              `json:"key"`
+	Timestamp   primitive.Timestamp `json:"ts"`
+	WallTime    time.Time           `json:"wall"`
+	Namespace   string              `json:"ns"`
+	Operation   string              `json:"op"`
+	Command     string              `json:"command,omitempty"`
+	Destructive bool                `json:"destructive"`
+	ID          json.RawMessage     `json:"_id,omitempty"`
+	Object      json.RawMessage     `json:"o,omitempty"`
+	Object2     json.RawMessage     `json:"o2,omitempty"`
+}
+
+// OplogRestoreTarget is the point in time a restore stops at to leave out an oplog entry
+type OplogRestoreTarget struct {
+	// the restore --oplog-limit, the timestamp of the entry, every entry before it is replayed
+	OplogLimit string `json:"oplog_limit"`
+}
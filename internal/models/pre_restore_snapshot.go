@@ -0,0 +1,12 @@
+package models
+
+type PreRestoreSnapshot struct {
+	Id          string   `json:"id"`
+	RestoredKey string   `json:"restored_key"`
+	CreatedAt   string   `json:"created_at"`
+	Namespaces  []string `json:"namespaces"`
+	Archives    []string `json:"archives"`
+
+	// every namespace on the target before the restore, rollback drops the ones the restore created
+	ExistingNamespaces []string `json:"existing_namespaces"`
+}
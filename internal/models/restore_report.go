@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+type RestoreReport struct {
+	Key           string             `json:"key"`
+	Databases     []string           `json:"databases"`
+	Phases        []RestorePhase     `json:"phases"`
+	OplogSegments int                `json:"oplog_segments"`
+	RestoredTo    string             `json:"restored_to"`
+	Incomplete    bool               `json:"incomplete,omitempty"`
+	Validation    []ValidationResult `json:"validation,omitempty"`
+}
+
+type RestorePhase struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+func (report *RestoreReport) AddPhase(name string, startedAt time.Time) {
+	report.Phases = append(report.Phases, RestorePhase{Name: name, Seconds: time.Since(startedAt).Seconds()})
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// RetentionPolicy decides which backups of a prefix are kept, a backup is kept when any rule keeps it
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	MaxAge      time.Duration
+	MinCount    int
+	OplogMaxAge time.Duration
+}
+
+// HasKeepRules reports whether the policy keeps the recent backups or the backups of calendar buckets
+func (policy *RetentionPolicy) HasKeepRules() bool {
+	return policy.KeepLast > 0 || policy.HasCalendarRules()
+}
+
+// HasCalendarRules reports whether the policy keeps the backups of days, weeks, months or years
+func (policy *RetentionPolicy) HasCalendarRules() bool {
+	return policy.KeepDaily > 0 || policy.KeepWeekly > 0 || policy.KeepMonthly > 0 || policy.KeepYearly > 0
+}
+
+// IsEmpty reports whether the policy keeps every backup
+func (policy *RetentionPolicy) IsEmpty() bool {
+	return !policy.HasKeepRules() && policy.MaxAge <= 0
+}
+
+// RetentionDecision records whether a backup or an oplog backup is kept and why
+type RetentionDecision struct {
+	Key    string    `json:"key"`
+	Time   time.Time `json:"time"`
+	Size   int64     `json:"size"`
+	Keep   bool      `json:"keep"`
+	Reason string    `json:"reason"`
+}
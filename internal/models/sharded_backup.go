@@ -0,0 +1,23 @@
+package models
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+type Shard struct {
+	Name           string   `json:"name"`
+	ReplicaSetName string   `json:"replica_set_name"`
+	Hosts          []string `json:"hosts"`
+	IsConfigServer bool     `json:"is_config_server"`
+}
+
+type ShardBackup struct {
+	Shard
+	ArchiveKey string              `json:"archive_key"`
+	OplogKey   string              `json:"oplog_key"`
+	OplogFrom  primitive.Timestamp `json:"oplog_from"`
+}
+
+type ShardedBackup struct {
+	Id          string              `json:"id"`
+	ClusterTime primitive.Timestamp `json:"cluster_time"`
+	Shards      []ShardBackup       `json:"shards"`
+}
@@ -0,0 +1,12 @@
+package models
+
+type ValidationResult struct {
+	Namespace string `json:"namespace"`
+	Check     string `json:"check"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+	Passed    bool   `json:"passed"`
+
+	// an approximate check that diverges is reported without failing the validation
+	Approximate bool `json:"approximate,omitempty"`
+}
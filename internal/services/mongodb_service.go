@@ -2,15 +2,24 @@ package services
 
 import (
 	"context"
+	"fmt"
 	"slices"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/ditkrg/mongodb-backup/internal/helpers"
 	"github.com/ditkrg/mongodb-backup/internal/models"
 	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// the most documents upserted in a single bulk write
+const maxDocumentsPerUpsert = 1000
+
 type MongodbService struct {
 	client *mongo.Client
 }
@@ -174,3 +183,425 @@ func (m *MongodbService) SetOriginalUserRoles(ctx context.Context, usersToSkip [
 
 	return nil
 }
+
+func (m *MongodbService) ListCollectionNames(ctx context.Context, database string) ([]string, error) {
+	log.Info().Msgf("Listing collections of database %s", database)
+
+	names, err := m.client.Database(database).ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		log.Error().Err(err).Msgf("error listing collections of database %s", database)
+		return nil, err
+	}
+
+	return names, nil
+}
+
+func (m *MongodbService) Fingerprint(ctx context.Context) (*models.ClusterFingerprint, error) {
+	log.Info().Msg("Computing the cluster fingerprint")
+
+	// ############################
+	// Get the replica set name and hosts
+	// ############################
+	var hello struct {
+		SetName string   `bson:"setName"`
+		Hosts   []string `bson:"hosts"`
+	}
+
+	if err := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		log.Error().Err(err).Msg("error running hello command")
+		return nil, err
+	}
+
+	fingerprint := &models.ClusterFingerprint{
+		ReplicaSetName: hello.SetName,
+		Hosts:          hello.Hosts,
+	}
+
+	// ############################
+	// Get the cluster id
+	// ############################
+	var replicaSetConfig struct {
+		Config struct {
+			Settings struct {
+				ReplicaSetId primitive.ObjectID `bson:"replicaSetId"`
+			} `bson:"settings"`
+		} `bson:"config"`
+	}
+
+	if hello.SetName != "" {
+		if err := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "replSetGetConfig", Value: 1}}).Decode(&replicaSetConfig); err != nil {
+			log.Warn().Err(err).Msg("could not get the replica set id, the fingerprint will not include it")
+		} else {
+			fingerprint.ClusterId = replicaSetConfig.Config.Settings.ReplicaSetId.Hex()
+		}
+	}
+
+	// ############################
+	// Get the feature compatibility version
+	// ############################
+	var parameter struct {
+		FeatureCompatibilityVersion struct {
+			Version string `bson:"version"`
+		} `bson:"featureCompatibilityVersion"`
+	}
+
+	if err := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "getParameter", Value: 1}, {Key: "featureCompatibilityVersion", Value: 1}}).Decode(&parameter); err != nil {
+		log.Warn().Err(err).Msg("could not get the feature compatibility version, the fingerprint will not include it")
+	} else {
+		fingerprint.FeatureCompatibilityVersion = parameter.FeatureCompatibilityVersion.Version
+	}
+
+	log.Info().Msgf("Cluster fingerprint %s (replica set: %s, hosts: %v, cluster id: %s, fcv: %s)",
+		fingerprint.Id(), fingerprint.ReplicaSetName, fingerprint.Hosts, fingerprint.ClusterId, fingerprint.FeatureCompatibilityVersion)
+
+	return fingerprint, nil
+}
+
+func (m *MongodbService) ListDatabaseNames(ctx context.Context) ([]string, error) {
+	log.Info().Msg("Listing databases")
+
+	names, err := m.client.ListDatabaseNames(ctx, bson.D{})
+	if err != nil {
+		log.Error().Err(err).Msg("error listing databases")
+		return nil, err
+	}
+
+	return names, nil
+}
+
+func (m *MongodbService) NamespaceManifests(ctx context.Context, databases []string, isIncluded func(database string, collection string) bool, withDbHash bool) ([]models.NamespaceManifest, error) {
+	namespaces := make([]models.NamespaceManifest, 0)
+
+	for _, database := range databases {
+		specifications, err := m.client.Database(database).ListCollectionSpecifications(ctx, bson.D{{Key: "type", Value: "collection"}})
+		if err != nil {
+			log.Error().Err(err).Msgf("error listing collections of database %s", database)
+			return nil, err
+		}
+
+		for _, specification := range specifications {
+			if strings.HasPrefix(specification.Name, "system.") || !isIncluded(database, specification.Name) {
+				continue
+			}
+
+			namespace, err := m.NamespaceManifest(ctx, database, specification.Name, withDbHash)
+			if err != nil {
+				return nil, err
+			}
+
+			namespaces = append(namespaces, *namespace)
+		}
+	}
+
+	return namespaces, nil
+}
+
+func (m *MongodbService) NamespaceManifest(ctx context.Context, database string, collection string, withDbHash bool) (*models.NamespaceManifest, error) {
+	log.Debug().Msgf("Collecting the manifest of %s.%s", database, collection)
+
+	namespace := &models.NamespaceManifest{
+		Database:   database,
+		Collection: collection,
+		Indexes:    make([]models.IndexManifest, 0),
+	}
+
+	// ############################
+	// Count the documents
+	// ############################
+	count, err := m.client.Database(database).Collection(collection).CountDocuments(ctx, bson.D{})
+	if err != nil {
+		log.Error().Err(err).Msgf("error counting documents of %s.%s", database, collection)
+		return nil, err
+	}
+
+	namespace.Count = count
+
+	// ############################
+	// Get the collection options
+	// ############################
+	specifications, err := m.client.Database(database).ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: collection}})
+	if err != nil {
+		log.Error().Err(err).Msgf("error getting the options of %s.%s", database, collection)
+		return nil, err
+	}
+
+	if len(specifications) > 0 && specifications[0].Options != nil {
+		namespace.Options = specifications[0].Options.String()
+	}
+
+	// ############################
+	// Get the index definitions
+	// ############################
+	cursor, err := m.client.Database(database).Collection(collection).Indexes().List(ctx)
+	if err != nil {
+		log.Error().Err(err).Msgf("error listing indexes of %s.%s", database, collection)
+		return nil, err
+	}
+
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var index bson.D
+		if err := cursor.Decode(&index); err != nil {
+			log.Error().Err(err).Msgf("error decoding an index of %s.%s", database, collection)
+			return nil, err
+		}
+
+		indexManifest := models.IndexManifest{}
+		indexOptions := bson.D{}
+
+		for _, element := range index {
+			switch element.Key {
+			case "name":
+				indexManifest.Name, _ = element.Value.(string)
+			case "key":
+				key, err := bson.MarshalExtJSON(element.Value, true, false)
+				if err != nil {
+					return nil, err
+				}
+				indexManifest.Key = string(key)
+			case "v", "ns":
+				continue
+			default:
+				indexOptions = append(indexOptions, element)
+			}
+		}
+
+		options, err := bson.MarshalExtJSON(indexOptions, true, false)
+		if err != nil {
+			return nil, err
+		}
+		indexManifest.Options = string(options)
+
+		namespace.Indexes = append(namespace.Indexes, indexManifest)
+	}
+
+	if err := cursor.Err(); err != nil {
+		log.Error().Err(err).Msgf("error iterating through indexes of %s.%s", database, collection)
+		return nil, err
+	}
+
+	sort.Slice(namespace.Indexes, func(i, j int) bool {
+		return namespace.Indexes[i].Name < namespace.Indexes[j].Name
+	})
+
+	// ############################
+	// Hash the collection
+	// ############################
+	if withDbHash {
+		var dbHash struct {
+			Collections map[string]string `bson:"collections"`
+		}
+
+		if err := m.client.Database(database).RunCommand(ctx, bson.D{{Key: "dbHash", Value: 1}, {Key: "collections", Value: bson.A{collection}}}).Decode(&dbHash); err != nil {
+			log.Error().Err(err).Msgf("error hashing %s.%s", database, collection)
+			return nil, err
+		}
+
+		namespace.DbHash = dbHash.Collections[collection]
+	}
+
+	return namespace, nil
+}
+
+func (m *MongodbService) DropDatabase(ctx context.Context, database string) error {
+	log.Info().Msgf("Dropping database %s", database)
+
+	if err := m.client.Database(database).Drop(ctx); err != nil {
+		log.Error().Err(err).Msgf("error dropping database %s", database)
+		return err
+	}
+
+	return nil
+}
+
+func (m *MongodbService) DropCollection(ctx context.Context, database string, collection string) error {
+	log.Info().Msgf("Dropping collection %s.%s", database, collection)
+
+	if err := m.client.Database(database).Collection(collection).Drop(ctx); err != nil {
+		log.Error().Err(err).Msgf("error dropping collection %s.%s", database, collection)
+		return err
+	}
+
+	return nil
+}
+
+func (m *MongodbService) IsMongos(ctx context.Context) (bool, error) {
+	var hello struct {
+		Msg string `bson:"msg"`
+	}
+
+	if err := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		log.Error().Err(err).Msg("error running hello command")
+		return false, err
+	}
+
+	return hello.Msg == "isdbgrid", nil
+}
+
+func (m *MongodbService) ListShards(ctx context.Context) ([]models.Shard, error) {
+	log.Info().Msg("Listing the shards of the cluster")
+
+	// ############################
+	// Get the shards
+	// ############################
+	var listShards struct {
+		Shards []struct {
+			Id   string `bson:"_id"`
+			Host string `bson:"host"`
+		} `bson:"shards"`
+	}
+
+	if err := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "listShards", Value: 1}}).Decode(&listShards); err != nil {
+		log.Error().Err(err).Msg("error listing shards")
+		return nil, err
+	}
+
+	// ############################
+	// Get the config server replica set
+	// ############################
+	var shardMap struct {
+		Map map[string]string `bson:"map"`
+	}
+
+	if err := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "getShardMap", Value: 1}}).Decode(&shardMap); err != nil {
+		log.Error().Err(err).Msg("error getting the shard map")
+		return nil, err
+	}
+
+	configServerHost, exists := shardMap.Map["config"]
+	if !exists {
+		err := fmt.Errorf("the shard map has no config server")
+		log.Error().Err(err).Send()
+		return nil, err
+	}
+
+	replicaSetName, hosts := helpers.ParseShardHost(configServerHost)
+	shards := []models.Shard{{Name: "config", ReplicaSetName: replicaSetName, Hosts: hosts, IsConfigServer: true}}
+
+	for _, shard := range listShards.Shards {
+		replicaSetName, hosts := helpers.ParseShardHost(shard.Host)
+		shards = append(shards, models.Shard{Name: shard.Id, ReplicaSetName: replicaSetName, Hosts: hosts})
+	}
+
+	log.Info().Msgf("Found %d shards and the config server", len(listShards.Shards))
+	return shards, nil
+}
+
+func (m *MongodbService) StopBalancer(ctx context.Context) error {
+	log.Info().Msg("Stopping the balancer")
+
+	if result := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "balancerStop", Value: 1}}); result.Err() != nil {
+		log.Error().Err(result.Err()).Msg("error stopping the balancer")
+		return result.Err()
+	}
+
+	return nil
+}
+
+func (m *MongodbService) StartBalancer(ctx context.Context) error {
+	log.Info().Msg("Starting the balancer")
+
+	if result := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "balancerStart", Value: 1}}); result.Err() != nil {
+		log.Error().Err(result.Err()).Msg("error starting the balancer")
+		return result.Err()
+	}
+
+	return nil
+}
+
+func (m *MongodbService) LatestOplogTimestamp(ctx context.Context) (primitive.Timestamp, error) {
+	return m.oplogTimestamp(ctx, -1)
+}
+
+func (m *MongodbService) OldestOplogTimestamp(ctx context.Context) (primitive.Timestamp, error) {
+	return m.oplogTimestamp(ctx, 1)
+}
+
+// TailOplog tails the oplog after from, only the entries of database are returned unless it is empty
+func (m *MongodbService) TailOplog(ctx context.Context, from primitive.Timestamp, database string, maxAwaitTime time.Duration) (*mongo.Cursor, error) {
+	log.Info().Msgf("Tailing the oplog after %d:%d", from.T, from.I)
+
+	filter := bson.D{{Key: "ts", Value: bson.D{{Key: "$gt", Value: from}}}}
+	if database != "" {
+		filter = append(filter, helpers.OplogDatabaseFilter(database)...)
+	}
+
+	cursor, err := m.client.Database("local").Collection("oplog.rs").Find(
+		ctx,
+		filter,
+		options.Find().SetCursorType(options.TailableAwait).SetMaxAwaitTime(maxAwaitTime).SetNoCursorTimeout(true),
+	)
+
+	if err != nil {
+		log.Error().Err(err).Msg("error tailing the oplog")
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+func (m *MongodbService) oplogTimestamp(ctx context.Context, direction int) (primitive.Timestamp, error) {
+	var entry struct {
+		Ts primitive.Timestamp `bson:"ts"`
+	}
+
+	err := m.client.Database("local").Collection("oplog.rs").FindOne(
+		ctx,
+		bson.D{},
+		options.FindOne().SetSort(bson.D{{Key: "$natural", Value: direction}}).SetProjection(bson.D{{Key: "ts", Value: 1}}),
+	).Decode(&entry)
+
+	if err != nil {
+		log.Error().Err(err).Msg("error reading the oplog")
+		return primitive.Timestamp{}, err
+	}
+
+	return entry.Ts, nil
+}
+
+func (m *MongodbService) UpdateShardHost(ctx context.Context, shard string, host string) error {
+	log.Info().Msgf("Pointing shard %s at %s", shard, host)
+
+	if _, err := m.client.Database("config").Collection("shards").UpdateOne(
+		ctx,
+		bson.D{{Key: "_id", Value: shard}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "host", Value: host}}}},
+	); err != nil {
+		log.Error().Err(err).Msgf("error updating the host of shard %s", shard)
+		return err
+	}
+
+	return nil
+}
+
+// UpsertDocuments replaces the documents of a collection that have the same _id, and inserts the others
+func (m *MongodbService) UpsertDocuments(ctx context.Context, database string, collection string, documents []bson.D) (int64, int64, error) {
+	log.Info().Msgf("Upserting %d documents into %s.%s", len(documents), database, collection)
+
+	var replaced, inserted int64
+
+	for batch := range slices.Chunk(documents, maxDocumentsPerUpsert) {
+		writes := make([]mongo.WriteModel, 0, len(batch))
+
+		for _, document := range batch {
+			for _, field := range document {
+				if field.Key == "_id" {
+					writes = append(writes, mongo.NewReplaceOneModel().SetFilter(bson.D{field}).SetReplacement(document).SetUpsert(true))
+					break
+				}
+			}
+		}
+
+		result, err := m.client.Database(database).Collection(collection).BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			log.Error().Err(err).Msgf("error upserting documents into %s.%s", database, collection)
+			return replaced, inserted, err
+		}
+
+		replaced += result.MatchedCount
+		inserted += result.UpsertedCount
+	}
+
+	return replaced, inserted, nil
+}
@@ -1,12 +1,17 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"slices"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsHttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
@@ -14,6 +19,9 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// the minimum size of every part but the last of a multipart upload is 5MiB
+const uploadPartSize = 8 * 1024 * 1024
+
 type S3Service struct {
 	*s3.Client
 }
@@ -49,6 +57,59 @@ func (s3Service *S3Service) List(ctx context.Context, bucket string, prefix stri
 	return resp, nil
 }
 
+// ListAll lists every object under the prefix, following the pagination of ListObjectsV2
+func (s3Service *S3Service) ListAll(ctx context.Context, bucket string, prefix string) ([]types.Object, error) {
+	log.Info().Msgf("Listing all objects in %s/%s", bucket, prefix)
+
+	objects := make([]types.Object, 0)
+
+	paginator := s3.NewListObjectsV2Paginator(s3Service.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list objects in S3 bucket")
+			return nil, err
+		}
+
+		objects = append(objects, page.Contents...)
+	}
+
+	log.Info().Msgf("successfully listed %d objects in %s/%s", len(objects), bucket, prefix)
+	return objects, nil
+}
+
+// ListDirectories lists the directories right under the prefix, the common prefixes up to the next /
+func (s3Service *S3Service) ListDirectories(ctx context.Context, bucket string, prefix string) ([]string, error) {
+	log.Info().Msgf("Listing the directories in %s/%s", bucket, prefix)
+
+	directories := make([]string, 0)
+
+	paginator := s3.NewListObjectsV2Paginator(s3Service.Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list the directories in S3 bucket")
+			return nil, err
+		}
+
+		for _, commonPrefix := range page.CommonPrefixes {
+			directories = append(directories, aws.ToString(commonPrefix.Prefix))
+		}
+	}
+
+	log.Info().Msgf("successfully listed %d directories in %s/%s", len(directories), bucket, prefix)
+	return directories, nil
+}
+
 func (s3Service *S3Service) ObjectsExistsAt(ctx context.Context, bucket string, prefix string) (bool, error) {
 	log.Info().Msgf("Checking if objects exists in %s/%s", bucket, prefix)
 
@@ -69,6 +130,10 @@ func (s3Service *S3Service) ObjectsExistsAt(ctx context.Context, bucket string,
 }
 
 func (s3Service *S3Service) UploadFile(ctx context.Context, bucket string, key string, filePath string) error {
+	return s3Service.UploadFileWithMetadata(ctx, bucket, key, filePath, nil)
+}
+
+func (s3Service *S3Service) UploadFileWithMetadata(ctx context.Context, bucket string, key string, filePath string, metadata map[string]string) error {
 	log.Info().Msgf("Uploading file %s to S3", filePath)
 
 	file, err := os.Open(filePath)
@@ -81,9 +146,10 @@ func (s3Service *S3Service) UploadFile(ctx context.Context, bucket string, key s
 	defer file.Close()
 
 	if _, err := s3Service.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Body:   file,
-		Key:    aws.String(key),
+		Bucket:   aws.String(bucket),
+		Body:     file,
+		Key:      aws.String(key),
+		Metadata: metadata,
 	}); err != nil {
 		log.Error().Err(err).Msgf("Failed to open %s", filePath)
 		return err
@@ -93,39 +159,137 @@ func (s3Service *S3Service) UploadFile(ctx context.Context, bucket string, key s
 	return nil
 }
 
-func (s3Service *S3Service) Delete(ctx context.Context, bucket string, objectsToDelete []types.ObjectIdentifier) error {
-	if len(objectsToDelete) == 0 {
-		log.Info().Msg("No objects to delete from S3")
-		return nil
+// UploadStream uploads everything read from the reader without knowing its size up front,
+// using a multipart upload once it outgrows a single part
+func (s3Service *S3Service) UploadStream(ctx context.Context, bucket string, key string, reader io.Reader, metadata map[string]string) error {
+	log.Info().Msgf("Streaming %s to S3", key)
+
+	part := make([]byte, uploadPartSize)
+
+	n, err := io.ReadFull(reader, part)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		log.Error().Err(err).Msgf("Failed to read the content of %s", key)
+		return err
 	}
 
-	log.Info().Msgf("Deleting %d objects from S3", len(objectsToDelete))
+	// ######################
+	// Small enough for a single request
+	// ######################
+	if n < uploadPartSize {
+		if _, err := s3Service.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			Body:     bytes.NewReader(part[:n]),
+			Metadata: metadata,
+		}); err != nil {
+			log.Error().Err(err).Msgf("Failed to upload %s", key)
+			return err
+		}
 
-	deleteObjectsOutput, err := s3Service.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-		Bucket: aws.String(bucket),
-		Delete: &types.Delete{
-			Objects: objectsToDelete,
-		},
+		log.Info().Msgf("Uploaded %s to S3", key)
+		return nil
+	}
+
+	upload, err := s3Service.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Metadata: metadata,
 	})
 
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to delete object from S3")
+		log.Error().Err(err).Msgf("Failed to start the upload of %s", key)
 		return err
 	}
 
-	if len(deleteObjectsOutput.Deleted) != len(objectsToDelete) {
-		err := fmt.Errorf("failed to delete all object from S3")
-		log.Error().Err(err).Send()
-		return err
+	completedParts := make([]types.CompletedPart, 0)
+
+	for partNumber := int32(1); n > 0; partNumber++ {
+		uploadedPart, err := s3Service.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(partNumber),
+			Body:       bytes.NewReader(part[:n]),
+		})
+
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to upload part %d of %s", partNumber, key)
+			return s3Service.abortUpload(ctx, bucket, key, upload.UploadId, err)
+		}
+
+		completedParts = append(completedParts, types.CompletedPart{ETag: uploadedPart.ETag, PartNumber: aws.Int32(partNumber)})
+
+		if n, err = io.ReadFull(reader, part); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			log.Error().Err(err).Msgf("Failed to read the content of %s", key)
+			return s3Service.abortUpload(ctx, bucket, key, upload.UploadId, err)
+		}
+	}
+
+	if _, err := s3Service.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completedParts},
+	}); err != nil {
+		log.Error().Err(err).Msgf("Failed to complete the upload of %s", key)
+		return s3Service.abortUpload(ctx, bucket, key, upload.UploadId, err)
+	}
+
+	log.Info().Msgf("Uploaded %s to S3 in %d parts", key, len(completedParts))
+	return nil
+}
+
+func (s3Service *S3Service) abortUpload(ctx context.Context, bucket string, key string, uploadId *string, uploadErr error) error {
+	if _, err := s3Service.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: uploadId,
+	}); err != nil {
+		log.Error().Err(err).Msgf("Failed to abort the upload of %s", key)
+		return errors.Join(uploadErr, err)
+	}
+
+	return uploadErr
+}
+
+// S3 deletes at most this many objects per request
+const maxObjectsPerDelete = 1000
+
+func (s3Service *S3Service) Delete(ctx context.Context, bucket string, objectsToDelete []types.ObjectIdentifier) error {
+	if len(objectsToDelete) == 0 {
+		log.Info().Msg("No objects to delete from S3")
+		return nil
 	}
 
-	if deleteObjectsOutput.Errors != nil {
-		for _, err := range deleteObjectsOutput.Errors {
-			s3Err := fmt.Errorf("error deleting object, code :%s, Key: %s, message :%s", *err.Code, *err.Key, *err.Message)
-			log.Error().Err(s3Err).Send()
+	log.Info().Msgf("Deleting %d objects from S3", len(objectsToDelete))
+
+	for batch := range slices.Chunk(objectsToDelete, maxObjectsPerDelete) {
+		deleteObjectsOutput, err := s3Service.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{
+				Objects: batch,
+			},
+		})
+
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to delete object from S3")
+			return err
+		}
+
+		if deleteObjectsOutput.Errors != nil {
+			for _, err := range deleteObjectsOutput.Errors {
+				s3Err := fmt.Errorf("error deleting object, code :%s, Key: %s, message :%s", *err.Code, *err.Key, *err.Message)
+				log.Error().Err(s3Err).Send()
+			}
+
+			return errors.New("failed to delete all objects from S3")
 		}
 
-		return errors.New("failed to delete all objects from S3")
+		if len(deleteObjectsOutput.Deleted) != len(batch) {
+			err := fmt.Errorf("failed to delete all object from S3")
+			log.Error().Err(err).Send()
+			return err
+		}
 	}
 
 	log.Info().Msgf("Deleted %d objects from S3", len(objectsToDelete))
@@ -148,3 +312,27 @@ func (s3Service *S3Service) Get(ctx context.Context, bucket string, key string)
 	log.Info().Msgf("Got object %s from S3", key)
 	return resp, nil
 }
+
+func (s3Service *S3Service) Head(ctx context.Context, bucket string, key string) (*s3.HeadObjectOutput, error) {
+	resp, err := s3Service.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		log.Err(err).Msgf("Failed to get the metadata of %s from S3", key)
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func IsNotFound(err error) bool {
+	var responseError *awsHttp.ResponseError
+
+	if ok := errors.As(err, &responseError); !ok {
+		return false
+	}
+
+	return responseError.ResponseError.HTTPStatusCode() == http.StatusNotFound
+}
@@ -12,9 +12,20 @@ import (
 type CLI struct {
 	Version kong.VersionFlag `short:"v" help:"Print the version number"`
 
-	List    commands.ListCommand            `cmd:"" name:"list" help:"List backups"`
-	Dump    commands.DumpCommand            `cmd:"" name:"dump" help:"Take a database or point-in-time backup"`
-	Restore commands.DatabaseRestoreCommand `cmd:"" name:"restore" help:"Restore a Database"`
+	List         commands.ListCommand            `cmd:"" name:"list" help:"List backups"`
+	Dump         commands.DumpCommand            `cmd:"" name:"dump" help:"Take a database or point-in-time backup"`
+	Restore      commands.DatabaseRestoreCommand `cmd:"" name:"restore" help:"Restore a Database"`
+	Rollback     commands.RollbackCommand        `cmd:"" name:"rollback" help:"Roll back a restore using its pre-restore snapshot"`
+	Drill        commands.DrillCommand           `cmd:"" name:"drill" help:"Restore a full backup into a scratch MongoDB, validate it and drop it"`
+	OplogStream  commands.OplogStreamCommand     `cmd:"" name:"oplog-stream" help:"Continuously stream the oplog to S3"`
+	CompactOplog commands.CompactOplogCommand    `cmd:"" name:"compact-oplog" help:"Merge adjacent oplog backups into larger ones"`
+	Prune        commands.PruneCommand           `cmd:"" name:"prune" help:"Delete the backups and oplog backups the retention policy no longer keeps"`
+	Pin          commands.PinCommand             `cmd:"" name:"pin" help:"Protect a backup from the retention policy until a date"`
+	Unpin        commands.UnpinCommand           `cmd:"" name:"unpin" help:"Remove the pin of a backup"`
+	Delete       commands.DeleteCommand          `cmd:"" name:"delete" help:"Delete a backup along with the oplog backups that depend on it"`
+	Inspect      commands.InspectCommand         `cmd:"" name:"inspect" help:"Show what a backup or an oplog backup holds without restoring it"`
+	Oplog        commands.OplogCommand           `cmd:"" name:"oplog" help:"Search the oplog backups"`
+	RecoverDocs  commands.RecoverDocsCommand     `cmd:"" name:"recover-docs" help:"Recover individual documents from a backup into a live collection"`
 }
 
 func main() {